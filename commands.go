@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// command is a subcommand of the CLI.
+type command struct {
+	name    string
+	summary string
+	// run runs the command with the arguments after its name.
+	run func(ctx context.Context, args []string)
+}
+
+// commands are the subcommands, in the order they are listed in the usage.
+var commands = []command{
+	{"import", "Copy files from the card to the library, verify them, and clean up (the default)", importMain},
+	{"clean-zombies", "Delete edit files whose RAW is gone from the library, without a card", cleanZombiesMain},
+	{"verify", "Check that the files on the card are safely in the library, exiting with status 1 if any isn't", verifyMain},
+	{"wipe-source", "Remove files from the card that are safely in the library, copying nothing", wipeSourceMain},
+	{"status", "Show the last import, the recorded runs and the trash of the library", statusMain},
+	{"undo", "Reverse a recorded run", undoMain},
+}
+
+// printUsage writes the list of commands to w.
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: clean-sd-card [command] [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-14s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "\nRun clean-sd-card <command> -h for the flags of a command.\n")
+}
+
+// jobFlags are the flags of a command that runs a job: the job flags it
+// takes (see registerJobFlags) plus -config, -job and -print-config.
+// Commands define any flags of their own on the embedded FlagSet before
+// calling parse.
+type jobFlags struct {
+	*flag.FlagSet
+	cli         *jobConfig
+	configPath  *string
+	jobName     *string
+	printConfig *bool
+}
+
+// newJobFlags returns the flags of the command called name, with the job
+// flags called names and the log flags, or all of them if no names are
+// given.
+func newJobFlags(name string, names ...string) *jobFlags {
+	if len(names) > 0 {
+		names = append(names, logFlagNames...)
+	}
+	cli := defaultJobConfig()
+	f := &jobFlags{FlagSet: flag.NewFlagSet(name, flag.ExitOnError), cli: &cli}
+	registerJobFlags(f.FlagSet, f.cli, names...)
+	f.configPath = f.String("config", "", "Config file with named jobs (default: clean-sd-card/config.yaml in the user config directory, if it exists)")
+	f.jobName = f.String("job", "", "Job from the config file to run; flags set on the command line override its values (default: the config file's default job)")
+	f.printConfig = f.Bool("print-config", false, "Print the effective configuration, after merging the config file and flags, and exit")
+	return f
+}
+
+// parse parses args and returns the job they select: the built-in defaults,
+// overridden by the job from the config file, overridden by the flags set in
+// args. With -print-config, it prints the job and exits.
+func (f *jobFlags) parse(args []string) jobConfig {
+	f.Parse(args)
+
+	cfg, err := loadConfigFile(*f.configPath)
+	if err != nil {
+		fatal(slog.Default(), "invalid -config", errAttr(err))
+	}
+	fileJob, err := cfg.job(*f.jobName)
+	if err != nil {
+		fatal(slog.Default(), "invalid -job", errAttr(err))
+	}
+	job := applyExplicitFlags(mergeJobs(defaultJobConfig(), fileJob), f.FlagSet, *f.cli)
+
+	if *f.printConfig {
+		out, err := yaml.Marshal(job)
+		if err != nil {
+			fatal(slog.Default(), "failed printing config", errAttr(err))
+		}
+		fmt.Print(string(out))
+		os.Exit(0)
+	}
+	return job
+}
+
+// cleanZombiesMain runs the clean-zombies command with args: delete the
+// zombie edit files in the library (see planCleanZombies).
+func cleanZombiesMain(ctx context.Context, args []string) {
+	job := newJobFlags("clean-zombies", "dst", "profile", "trash", "trash-retention", "dry-run", "concurrency").parse(args)
+	logger := setUpLogging(job)
+	profile, err := job.cameraProfile()
+	if err != nil {
+		fatal(logger, "invalid -profile", errAttr(err))
+	}
+	opts := job.options()
+	opts.Logger = logger
+
+	logger.Info("cleaning up zombie edit files", "dst", job.Dst, "profile", profile.Name)
+	plan, err := planCleanZombies(ctx, osFileSystem{}, job.Extensions.Edit, profile, job.Dst, opts)
+	if err != nil {
+		fatal(logger, "failed planning zombie cleanup", errAttr(err))
+	}
+	report, err := runPlan(ctx, osFileSystem{}, plan, opts)
+	if err != nil {
+		exitRunError(logger, "failed cleaning up zombie edit files", report, err)
+	}
+	logSummary(logger, report)
+}
+
+// verifyMain runs the verify command with args: check that the files on the
+// card are safely in the library (see verifyCard), or with -journal, that
+// the files of the last import still are (see verifyImport). It exits with
+// status 1 if any file isn't.
+func verifyMain(ctx context.Context, args []string) {
+	f := newJobFlags("verify",
+		"src", "dst", "dst-jpg", "dst-video", "profile", "layout", "card-label", "event",
+		"keep-jpg", "copy-video", "concurrency",
+	)
+	fromJournal := f.Bool("journal", false, "Check the files the last import recorded in its journal in -dst against their copies, without a card")
+	job := f.parse(args)
+	logger := setUpLogging(job)
+
+	var (
+		results []verifyResult
+		err     error
+	)
+	if *fromJournal {
+		results, err = verifyImport(ctx, osFileSystem{}, job.Dst, job.Concurrency, logger)
+	} else {
+		profile, perr := job.cameraProfile()
+		if perr != nil {
+			fatal(logger, "invalid -profile", errAttr(perr))
+		}
+		opts := job.options()
+		opts.Logger = logger
+		results, err = verifyCard(ctx, osFileSystem{}, profile, job.Src, job.Dst, job.DstJPG, job.DstVideo, opts)
+	}
+	if err != nil {
+		fatal(logger, "failed verifying", errAttr(err))
+	}
+	ok, err := printVerifyReport(os.Stdout, results)
+	if err != nil {
+		fatal(logger, "failed printing report", errAttr(err))
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// wipeSourceMain runs the wipe-source command with args: remove the files
+// on the card that are safely in the library (see planWipeSource).
+func wipeSourceMain(ctx context.Context, args []string) {
+	job := newJobFlags("wipe-source",
+		"src", "dst", "dst-jpg", "dst-video", "profile", "layout", "card-label", "event",
+		"keep-jpg", "copy-video", "trash-sources", "dry-run", "concurrency",
+	).parse(args)
+	logger := setUpLogging(job)
+	profile, err := job.cameraProfile()
+	if err != nil {
+		fatal(logger, "invalid -profile", errAttr(err))
+	}
+	opts := job.options()
+	opts.Logger = logger
+
+	logger.Info("removing files from the card that are safely in the library", "src", job.Src, "dst", job.Dst, "profile", profile.Name)
+	plan, err := planWipeSource(ctx, osFileSystem{}, profile, job.Src, job.Dst, job.DstJPG, job.DstVideo, opts)
+	if err != nil {
+		fatal(logger, "failed planning source wipe", errAttr(err))
+	}
+	report, err := runPlan(ctx, osFileSystem{}, plan, opts)
+	if err != nil {
+		exitRunError(logger, "failed wiping source", report, err)
+	}
+	logSummary(logger, report)
+}
+
+// statusMain runs the status command with args.
+func statusMain(_ context.Context, args []string) {
+	job := newJobFlags("status", "dst").parse(args)
+	logger := setUpLogging(job)
+
+	st, err := readLibraryStatus(osFileSystem{}, job.Dst, logger)
+	if err != nil {
+		fatal(logger, "failed reading status", errAttr(err))
+	}
+	if err := st.print(os.Stdout); err != nil {
+		fatal(logger, "failed printing status", errAttr(err))
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFileName is where the config file lives under the user config
+// directory (os.UserConfigDir) when -config isn't given.
+const configFileName = "clean-sd-card/config.yaml"
+
+// configFile is the YAML config file: named jobs, each a set of values for
+// the command-line flags, e.g.
+//
+//	default: a7iv
+//	jobs:
+//	  a7iv:
+//	    src: E:\
+//	    dst: D:\raw
+//	    layout: date
+//	    keep-src: false
+//	    extensions:
+//	      raw: [arw]
+type configFile struct {
+	// Default names the job used when -job isn't given.
+	Default string               `yaml:"default"`
+	Jobs    map[string]jobConfig `yaml:"jobs"`
+}
+
+// jobConfig is one job of the config file, and also the effective
+// configuration of a run once the built-in defaults, the job and the flags
+// set on the command line are merged (see mergeJobs and applyExplicitFlags).
+// Keys match the flag names. Unset fields of a job (empty strings and lists,
+// nil bools, zero ints) leave the value beneath them in place.
+type jobConfig struct {
+	Src      string `yaml:"src,omitempty"`
+	Dst      string `yaml:"dst,omitempty"`
+	DstJPG   string `yaml:"dst-jpg,omitempty"`
+	DstVideo string `yaml:"dst-video,omitempty"`
+	Profile  string `yaml:"profile,omitempty"`
+	// Extensions override those of the camera profile.
+	Extensions extensionsConfig `yaml:"extensions,omitempty"`
+
+	Layout    string `yaml:"layout,omitempty"`
+	CardLabel string `yaml:"card-label,omitempty"`
+	Event     string `yaml:"event,omitempty"`
+	// OnConflict names a conflictPolicy. Overwrite, when true, is
+	// conflictOverwrite whatever OnConflict says.
+	OnConflict string `yaml:"on-conflict,omitempty"`
+
+	DryRun                *bool `yaml:"dry-run,omitempty"`
+	Overwrite             *bool `yaml:"overwrite,omitempty"`
+	KeepJPG               *bool `yaml:"keep-jpg,omitempty"`
+	CopyVideo             *bool `yaml:"copy-video,omitempty"`
+	KeepSrc               *bool `yaml:"keep-src,omitempty"`
+	DeleteZombieEditFiles *bool `yaml:"delete-zombie-edit-files,omitempty"`
+	Trash                 *bool `yaml:"trash,omitempty"`
+	TrashSources          *bool `yaml:"trash-sources,omitempty"`
+	TrashRetention        int   `yaml:"trash-retention,omitempty"`
+	KeepGoing             *bool `yaml:"keep-going,omitempty"`
+	// FreeSpaceMargin is in megabytes.
+	FreeSpaceMargin int `yaml:"free-space-margin,omitempty"`
+	Concurrency     int `yaml:"concurrency,omitempty"`
+
+	// LogLevel, LogFormat and LogFile set up the log (see setUpLogging).
+	LogLevel  string `yaml:"log-level,omitempty"`
+	LogFormat string `yaml:"log-format,omitempty"`
+	LogFile   string `yaml:"log-file,omitempty"`
+}
+
+// extensionsConfig are the extension lists a job can set. Each list that is
+// set replaces the camera profile's (see applyExtensions).
+type extensionsConfig struct {
+	Raw     []string `yaml:"raw,omitempty,flow"`
+	Image   []string `yaml:"image,omitempty,flow"`
+	Video   []string `yaml:"video,omitempty,flow"`
+	Sidecar []string `yaml:"sidecar,omitempty,flow"`
+	// Edit are the extensions of edit sidecars deleted as zombies once
+	// their RAW is gone.
+	Edit []string `yaml:"edit,omitempty,flow"`
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// defaultJobConfig returns the built-in defaults, which the config file and
+// the flags override.
+func defaultJobConfig() jobConfig {
+	return jobConfig{
+		Src:      defaultDirSrc,
+		Dst:      defaultDirDst,
+		DstJPG:   defaultDirDstJPG,
+		DstVideo: defaultDirDstVideo,
+		Profile:  profileAuto,
+		Extensions: extensionsConfig{
+			Edit: []string{"xmp"}, // lightroom's default edit file extension when edited in local machine
+		},
+		Layout:                layoutFlat,
+		OnConflict:            string(conflictSkipIfIdentical),
+		DryRun:                boolPtr(false),
+		Overwrite:             boolPtr(false),
+		KeepJPG:               boolPtr(true),
+		CopyVideo:             boolPtr(false),
+		KeepSrc:               boolPtr(true),
+		DeleteZombieEditFiles: boolPtr(true),
+		Trash:                 boolPtr(false),
+		TrashSources:          boolPtr(false),
+		KeepGoing:             boolPtr(false),
+		FreeSpaceMargin:       defaultFreeSpaceMargin,
+		Concurrency:           defaultConcurrency,
+		LogLevel:              "info",
+		LogFormat:             logFormatText,
+	}
+}
+
+// registerJobFlags defines the flags called names that set the fields of job
+// on fs, or all of them if no names are given, with job's current values as
+// their defaults. job's bool fields must be non-nil.
+func registerJobFlags(fs *flag.FlagSet, job *jobConfig, names ...string) {
+	if len(names) == 0 {
+		defineJobFlags(fs, job)
+		return
+	}
+	all := flag.NewFlagSet("", flag.ContinueOnError)
+	defineJobFlags(all, job)
+	for _, name := range names {
+		f := all.Lookup(name)
+		if f == nil {
+			panic("unknown job flag " + name)
+		}
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+}
+
+// defineJobFlags defines every flag that sets a field of job on fs.
+func defineJobFlags(fs *flag.FlagSet, job *jobConfig) {
+	fs.BoolVar(job.DryRun, "dry-run", *job.DryRun, "Simulate operations without modifying files, logging the plan instead: every copy, skip, source removal and zombie edit file deletion, with its reason (default: false)")
+	fs.BoolVar(job.Overwrite, "overwrite", *job.Overwrite, "Overwrite existing files in destination; short for -on-conflict=overwrite (default: false)")
+	fs.StringVar(&job.OnConflict, "on-conflict", job.OnConflict, "What to do with a file whose name is taken in destination: \"skip-if-identical\" (skip it if identical, leave it on the card otherwise), \"skip\" (skip it without comparing, leaving it on the card with a warning), \"overwrite\", \"rename\" (copy it, and the rest of its shot, with _1, _2, ... appended, the lowest number free for all of them) or \"fail\" (copy nothing if any file differs) (default: skip-if-identical)")
+	fs.BoolVar(job.KeepJPG, "keep-jpg", *job.KeepJPG, "Keep JPG files in destination (default: true)")
+	fs.BoolVar(job.CopyVideo, "copy-video", *job.CopyVideo, "Copy video clips (and their metadata sidecars) to -dst-video, verified and removed like RAWs; with -src at the card root or DCIM, clips outside DCIM such as PRIVATE/M4ROOT/CLIP are included (default: false)")
+	fs.BoolVar(job.KeepSrc, "keep-src", *job.KeepSrc, "Keep files in the source (SD card) directory after copying instead of removing them; only files with a verified or identical copy in the library are ever removed (default: true)")
+	fs.BoolVar(job.DeleteZombieEditFiles, "delete-zombie-edit-files", *job.DeleteZombieEditFiles, "Delete zombie edit files: edit files in -dst whose RAW is gone, from whichever camera it was shot with (default: true)")
+	fs.BoolVar(job.Trash, "trash", *job.Trash, "Move zombie edit files into the dated trash folder "+trashDirName+" under -dst instead of deleting them, keeping their path relative to -dst, so that undo can restore them; a file trashed twice the same day gets a numbered name (default: false)")
+	fs.BoolVar(job.TrashSources, "trash-sources", *job.TrashSources, "Move source files into the trash under -dst instead of deleting them, keeping their path on the card, when -keep-src=false (default: false)")
+	fs.IntVar(&job.TrashRetention, "trash-retention", job.TrashRetention, "Purge trash folders older than this many days on each run; 0 keeps them until deleted by hand (default: 0)")
+	fs.BoolVar(job.KeepGoing, "keep-going", *job.KeepGoing, "Go on with the other files when some fail to read, copy or remove, removing the sources of those copied and cleaning up zombie edit files, and exit with status 3 listing the failed files (default: false)")
+	fs.IntVar(&job.FreeSpaceMargin, "free-space-margin", job.FreeSpaceMargin, fmt.Sprintf("Megabytes to leave free on each destination disk, counting destinations on the same disk together; a run that would leave less refuses to start, and a dry run reports the shortfall (default: %d)", defaultFreeSpaceMargin))
+	fs.IntVar(&job.Concurrency, "concurrency", job.Concurrency, "Maximum number of files to copy/remove concurrently (default: 4). Tune based on your card reader's actual throughput.")
+	fs.StringVar(&job.Layout, "layout", job.Layout, "Destination layout: \"flat\", \"date\" (YYYY/YYYY-MM-DD subfolders by capture date), or a template such as \"{year}/{date}_{event}/{camera}/{name}{ext}\" using the tokens {year}, {month}, {day}, {date}, {time} (capture time, from EXIF or the modification time), {make}, {camera}, {seq} or {seq:04} (per-day number, carrying on from the highest at the destination), {name}, {folder}, {label}, {event} and {ext} (only at the end; appended if omitted) (default: flat)")
+	fs.StringVar(&job.CardLabel, "card-label", job.CardLabel, "Card label for the {label} layout token")
+	fs.StringVar(&job.Event, "event", job.Event, "Event name for the {event} layout token")
+	fs.StringVar(&job.Profile, "profile", job.Profile, fmt.Sprintf("Camera profile deciding which extensions and card directories are imported: %s, or %q to infer it from the card (default: %s)", strings.Join(profileNames(), ", "), profileAuto, profileAuto))
+	fs.StringVar(&job.Src, "src", job.Src, "Source directory: the card root, its DCIM directory (every DCF folder in it and the camera's video directories are imported), or a single folder")
+	fs.StringVar(&job.Dst, "dst", job.Dst, "Destination directory")
+	fs.StringVar(&job.DstJPG, "dst-jpg", job.DstJPG, "Destination directory for JPG files")
+	fs.StringVar(&job.DstVideo, "dst-video", job.DstVideo, "Destination directory for video clips")
+	fs.StringVar(&job.LogLevel, "log-level", job.LogLevel, "Least important log records to write: \"debug\" (every file, including those skipped), \"info\", \"warn\" or \"error\" (default: info)")
+	fs.StringVar(&job.LogFormat, "log-format", job.LogFormat, "Log format: \"text\" (key=value pairs) or \"json\" (one object per line, for log shippers) (default: text)")
+	fs.StringVar(&job.LogFile, "log-file", job.LogFile, "Append the log to this file instead of writing it to stderr")
+}
+
+// applyExplicitFlags returns base with every field whose flag was set on the
+// command line replaced by its value in job, as filled in by the flags
+// registerJobFlags defined on fs. Unlike mergeJobs, it replaces fields set to
+// their zero value too: -trash-retention=0 or -card-label= override the job.
+func applyExplicitFlags(base jobConfig, fs *flag.FlagSet, job jobConfig) jobConfig {
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "dry-run":
+			base.DryRun = boolPtr(*job.DryRun)
+		case "overwrite":
+			base.Overwrite = boolPtr(*job.Overwrite)
+		case "on-conflict":
+			base.OnConflict = job.OnConflict
+		case "keep-jpg":
+			base.KeepJPG = boolPtr(*job.KeepJPG)
+		case "copy-video":
+			base.CopyVideo = boolPtr(*job.CopyVideo)
+		case "keep-src":
+			base.KeepSrc = boolPtr(*job.KeepSrc)
+		case "delete-zombie-edit-files":
+			base.DeleteZombieEditFiles = boolPtr(*job.DeleteZombieEditFiles)
+		case "trash":
+			base.Trash = boolPtr(*job.Trash)
+		case "trash-sources":
+			base.TrashSources = boolPtr(*job.TrashSources)
+		case "trash-retention":
+			base.TrashRetention = job.TrashRetention
+		case "keep-going":
+			base.KeepGoing = boolPtr(*job.KeepGoing)
+		case "free-space-margin":
+			base.FreeSpaceMargin = job.FreeSpaceMargin
+		case "concurrency":
+			base.Concurrency = job.Concurrency
+		case "layout":
+			base.Layout = job.Layout
+		case "card-label":
+			base.CardLabel = job.CardLabel
+		case "event":
+			base.Event = job.Event
+		case "profile":
+			base.Profile = job.Profile
+		case "src":
+			base.Src = job.Src
+		case "dst":
+			base.Dst = job.Dst
+		case "dst-jpg":
+			base.DstJPG = job.DstJPG
+		case "dst-video":
+			base.DstVideo = job.DstVideo
+		case "log-level":
+			base.LogLevel = job.LogLevel
+		case "log-format":
+			base.LogFormat = job.LogFormat
+		case "log-file":
+			base.LogFile = job.LogFile
+		}
+	})
+	return base
+}
+
+// mergeJobs returns base with every field that is set in overrides replaced,
+// applying overrides in order.
+func mergeJobs(base jobConfig, overrides ...jobConfig) jobConfig {
+	str := func(dst *string, src string) {
+		if src != "" {
+			*dst = src
+		}
+	}
+	list := func(dst *[]string, src []string) {
+		if src != nil {
+			*dst = slices.Clone(src)
+		}
+	}
+	boolean := func(dst **bool, src *bool) {
+		if src != nil {
+			*dst = boolPtr(*src)
+		}
+	}
+	for _, o := range overrides {
+		str(&base.Src, o.Src)
+		str(&base.Dst, o.Dst)
+		str(&base.DstJPG, o.DstJPG)
+		str(&base.DstVideo, o.DstVideo)
+		str(&base.Profile, o.Profile)
+		list(&base.Extensions.Raw, o.Extensions.Raw)
+		list(&base.Extensions.Image, o.Extensions.Image)
+		list(&base.Extensions.Video, o.Extensions.Video)
+		list(&base.Extensions.Sidecar, o.Extensions.Sidecar)
+		list(&base.Extensions.Edit, o.Extensions.Edit)
+		str(&base.Layout, o.Layout)
+		str(&base.CardLabel, o.CardLabel)
+		str(&base.Event, o.Event)
+		str(&base.OnConflict, o.OnConflict)
+		boolean(&base.DryRun, o.DryRun)
+		boolean(&base.Overwrite, o.Overwrite)
+		boolean(&base.KeepJPG, o.KeepJPG)
+		boolean(&base.CopyVideo, o.CopyVideo)
+		boolean(&base.KeepSrc, o.KeepSrc)
+		boolean(&base.DeleteZombieEditFiles, o.DeleteZombieEditFiles)
+		boolean(&base.Trash, o.Trash)
+		boolean(&base.TrashSources, o.TrashSources)
+		boolean(&base.KeepGoing, o.KeepGoing)
+		if o.TrashRetention != 0 {
+			base.TrashRetention = o.TrashRetention
+		}
+		if o.FreeSpaceMargin != 0 {
+			base.FreeSpaceMargin = o.FreeSpaceMargin
+		}
+		if o.Concurrency != 0 {
+			base.Concurrency = o.Concurrency
+		}
+		str(&base.LogLevel, o.LogLevel)
+		str(&base.LogFormat, o.LogFormat)
+		str(&base.LogFile, o.LogFile)
+	}
+	return base
+}
+
+// defaultConfigPath returns where the config file is looked for when -config
+// isn't given.
+func defaultConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.FromSlash(configFileName)), nil
+}
+
+// loadConfigFile reads the config file at path. If path is empty the default
+// location is used, and a missing file there is not an error: it returns an
+// empty config.
+func loadConfigFile(path string) (configFile, error) {
+	explicit := path != ""
+	if !explicit {
+		var err error
+		if path, err = defaultConfigPath(); err != nil {
+			return configFile{}, nil
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return configFile{}, nil
+	}
+	if err != nil {
+		return configFile{}, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	// Unknown keys are refused rather than ignored: a misspelled keep-src
+	// would otherwise run the job with the opposite of what it says.
+	var cfg configFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return configFile{}, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if cfg.Default != "" {
+		if _, ok := cfg.Jobs[cfg.Default]; !ok {
+			return configFile{}, fmt.Errorf("config file %s: default job %q is not defined", path, cfg.Default)
+		}
+	}
+	return cfg, nil
+}
+
+// job returns the job called name, or the default job if name is empty. It
+// returns an empty job if name is empty and there is no default.
+func (c configFile) job(name string) (jobConfig, error) {
+	if name == "" {
+		name = c.Default
+		if name == "" {
+			return jobConfig{}, nil
+		}
+	}
+	job, ok := c.Jobs[name]
+	if !ok {
+		names := make([]string, 0, len(c.Jobs))
+		for n := range c.Jobs {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return jobConfig{}, fmt.Errorf("unknown job %q (defined: %s)", name, strings.Join(names, ", "))
+	}
+	return job, nil
+}
+
+// options returns the Options of a merged job.
+func (j jobConfig) options() Options {
+	onConflict := conflictPolicy(j.OnConflict)
+	if *j.Overwrite {
+		onConflict = conflictOverwrite
+	}
+	return Options{
+		DryRun:                *j.DryRun,
+		KeepJPG:               *j.KeepJPG,
+		CopyVideo:             *j.CopyVideo,
+		KeepSrc:               *j.KeepSrc,
+		OnConflict:            onConflict,
+		DeleteZombieEditFiles: *j.DeleteZombieEditFiles,
+		Trash:                 *j.Trash,
+		TrashSources:          *j.TrashSources,
+		TrashRetention:        j.TrashRetention,
+		KeepGoing:             *j.KeepGoing,
+		FreeSpaceMargin:       int64(j.FreeSpaceMargin) * megabyte,
+		Concurrency:           j.Concurrency,
+		Layout:                j.Layout,
+		CardLabel:             j.CardLabel,
+		Event:                 j.Event,
+	}
+}
+
+// cameraProfile returns the camera profile of a merged job, with the
+// extensions it sets applied (see applyExtensions).
+func (j jobConfig) cameraProfile() (cameraProfile, error) {
+	profile, err := lookupProfile(j.Profile)
+	if err != nil {
+		return cameraProfile{}, err
+	}
+	return applyExtensions(profile, j.Extensions), nil
+}
+
+// applyExtensions returns profile with each extension list set in ext
+// replacing the profile's. A customized profile is renamed so that it is no
+// longer profileAuto: the lists it was told to use aren't narrowed down by
+// detectProfile.
+func applyExtensions(profile cameraProfile, ext extensionsConfig) cameraProfile {
+	customized := false
+	replace := func(dst *[]string, src []string) {
+		if src != nil {
+			*dst = slices.Clone(src)
+			customized = true
+		}
+	}
+	replace(&profile.RawExtensions, ext.Raw)
+	replace(&profile.ImageExtensions, ext.Image)
+	replace(&profile.VideoExtensions, ext.Video)
+	replace(&profile.SidecarExtensions, ext.Sidecar)
+	if customized {
+		profile.Name += "+custom"
+	}
+	return profile
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+default: a7
+jobs:
+  a7:
+    src: /card
+    dst: /photos/raw
+    profile: sony
+    layout: date
+    keep-src: false
+    concurrency: 2
+    extensions:
+      raw: [arw]
+      edit: [xmp, dop]
+  studio:
+    event: studio
+`), 0644))
+
+	cfg, err := loadConfigFile(path)
+	require.NoError(t, err)
+
+	job, err := cfg.job("")
+	require.NoError(t, err)
+	assert.Equal(t, "/card", job.Src)
+	assert.Equal(t, "/photos/raw", job.Dst)
+	assert.Equal(t, "date", job.Layout)
+	require.NotNil(t, job.KeepSrc)
+	assert.False(t, *job.KeepSrc)
+	assert.Nil(t, job.DryRun)
+	assert.Equal(t, 2, job.Concurrency)
+	assert.Equal(t, []string{"xmp", "dop"}, job.Extensions.Edit)
+
+	job, err = cfg.job("studio")
+	require.NoError(t, err)
+	assert.Equal(t, "studio", job.Event)
+
+	_, err = cfg.job("wedding")
+	assert.Error(t, err)
+
+	t.Run("missing explicit file", func(t *testing.T) {
+		_, err := loadConfigFile(filepath.Join(t.TempDir(), "missing.yaml"))
+		assert.Error(t, err)
+	})
+
+	t.Run("misspelled key", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(path, []byte("jobs:\n  a7:\n    keep_src: false\n"), 0644))
+		_, err := loadConfigFile(path)
+		assert.ErrorContains(t, err, "keep_src")
+	})
+
+	t.Run("empty file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(path, nil, 0644))
+		cfg, err := loadConfigFile(path)
+		require.NoError(t, err)
+		assert.Empty(t, cfg.Jobs)
+	})
+
+	t.Run("undefined default job", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(path, []byte("default: a7\n"), 0644))
+		_, err := loadConfigFile(path)
+		assert.Error(t, err)
+	})
+}
+
+func TestMergeJobs(t *testing.T) {
+	fileJob := jobConfig{
+		Src:        "/card",
+		Layout:     "date",
+		KeepSrc:    boolPtr(false),
+		KeepGoing:  boolPtr(true),
+		LogFormat:  logFormatJSON,
+		Extensions: extensionsConfig{Raw: []string{"arw"}},
+
+		TrashRetention:  30,
+		FreeSpaceMargin: 10,
+		CardLabel:       "a7",
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cli := defaultJobConfig()
+	registerJobFlags(fs, &cli)
+	require.NoError(t, fs.Parse([]string{"-layout=flat", "-dry-run", "-log-level=debug", "-trash-retention=0", "-free-space-margin=0", "-card-label="}))
+
+	job := applyExplicitFlags(mergeJobs(defaultJobConfig(), fileJob), fs, cli)
+
+	assert.Equal(t, "/card", job.Src, "file value over the default")
+	assert.Equal(t, defaultDirDst, job.Dst, "default when neither sets it")
+	assert.Equal(t, "flat", job.Layout, "flag over the file value")
+	assert.True(t, *job.DryRun)
+	assert.False(t, *job.KeepSrc, "unset flag defaults don't override the file")
+	assert.Equal(t, defaultConcurrency, job.Concurrency)
+	assert.Equal(t, []string{"arw"}, job.Extensions.Raw)
+	assert.Equal(t, []string{"xmp"}, job.Extensions.Edit)
+	assert.Equal(t, "debug", job.LogLevel)
+	assert.Equal(t, logFormatJSON, job.LogFormat)
+	assert.Zero(t, job.TrashRetention, "flags set to zero override the file value")
+	assert.Zero(t, job.FreeSpaceMargin)
+	assert.Empty(t, job.CardLabel)
+
+	opts := job.options()
+	assert.True(t, opts.DryRun)
+	assert.False(t, opts.KeepSrc)
+	assert.True(t, opts.KeepGoing)
+	assert.True(t, opts.KeepJPG)
+}
+
+func TestRegisterJobFlagsSubset(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cli := defaultJobConfig()
+	registerJobFlags(fs, &cli, "dst", "dry-run")
+
+	assert.NotNil(t, fs.Lookup("dst"))
+	assert.Nil(t, fs.Lookup("src"))
+	assert.Error(t, fs.Parse([]string{"-src=/card"}))
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	cli = defaultJobConfig()
+	registerJobFlags(fs, &cli, "dst", "dry-run")
+	require.NoError(t, fs.Parse([]string{"-dst=/library", "-dry-run"}))
+	job := applyExplicitFlags(defaultJobConfig(), fs, cli)
+	assert.Equal(t, "/library", job.Dst)
+	assert.True(t, *job.DryRun)
+}
+
+func TestJobCameraProfile(t *testing.T) {
+	job := mergeJobs(defaultJobConfig(), jobConfig{Profile: "sony"})
+	profile, err := job.cameraProfile()
+	require.NoError(t, err)
+	assert.Equal(t, "sony", profile.Name)
+
+	job = mergeJobs(job, jobConfig{Extensions: extensionsConfig{Raw: []string{"arw"}, Video: []string{}}})
+	profile, err = job.cameraProfile()
+	require.NoError(t, err)
+	assert.Equal(t, "sony+custom", profile.Name)
+	assert.Equal(t, []string{"arw"}, profile.RawExtensions)
+	assert.Empty(t, profile.VideoExtensions)
+	assert.Equal(t, []string{"jpg", "jpeg", "hif", "heif"}, profile.ImageExtensions)
+
+	_, err = mergeJobs(defaultJobConfig(), jobConfig{Profile: "polaroid"}).cameraProfile()
+	assert.Error(t, err)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// conflictPolicy is what an import does with a file whose destination is
+// taken by a file of the same name (see planCopies).
+type conflictPolicy string
+
+const (
+	// conflictSkip leaves the file on the card without comparing it to the
+	// file at its destination. Since it isn't known to be safely in the
+	// library, it isn't removed from the card.
+	conflictSkip conflictPolicy = "skip"
+	// conflictOverwrite replaces the file at the destination.
+	conflictOverwrite conflictPolicy = "overwrite"
+	// conflictRename copies the file under a free name, with _1, _2, ...
+	// appended to its base name, together with the rest of its shot (see
+	// renameConflicts), unless it is identical to the file at its
+	// destination.
+	conflictRename conflictPolicy = "rename"
+	// conflictSkipIfIdentical skips the file if it is identical to the file
+	// at its destination, and leaves it on the card as a name collision
+	// otherwise. It is the default.
+	conflictSkipIfIdentical conflictPolicy = "skip-if-identical"
+	// conflictFail refuses to import the card if any file has a different
+	// file at its destination. Identical files are skipped.
+	conflictFail conflictPolicy = "fail"
+)
+
+// conflictPolicies are the valid policies, in the order they are listed in
+// the usage.
+var conflictPolicies = []conflictPolicy{conflictSkipIfIdentical, conflictSkip, conflictOverwrite, conflictRename, conflictFail}
+
+// errNameConflict is returned (wrapped in a fileCopyError) when a different
+// file is at a file's destination, or is copied there by the same run, and
+// the policy is conflictFail.
+var errNameConflict = errors.New("a different file with the same name is already at the destination (-on-conflict=fail)")
+
+// validate checks that p is one of conflictPolicies. The zero value is
+// conflictSkipIfIdentical.
+func (p conflictPolicy) validate() error {
+	if p == "" {
+		return nil
+	}
+	for _, valid := range conflictPolicies {
+		if p == valid {
+			return nil
+		}
+	}
+	names := make([]string, len(conflictPolicies))
+	for i, valid := range conflictPolicies {
+		names[i] = string(valid)
+	}
+	return fmt.Errorf("unknown conflict policy %q (valid: %s)", p, strings.Join(names, ", "))
+}
+
+// renameConflicts gives the copies planCopies and planCollisions marked
+// reasonRenamed a free destination, and with them every other file of the same shot being copied
+// -- a RAW's JPG, a clip's XML sidecar -- so that the shot's files keep
+// matching names: DSC00042.ARW and DSC00042.JPG become DSC00042_1.ARW and
+// DSC00042_1.JPG. The suffix is the lowest one free for every file of the
+// shot, both on fsys and among the other planned destinations. A file whose
+// renamed destination already holds an identical copy, from an earlier run,
+// is skipped, and one that can't be compared to it fails (see planFailure).
+func renameConflicts(ctx context.Context, fsys FileSystem, actions []Action, opts Options) error {
+	shotOf := func(src string) string {
+		return filepath.Join(filepath.Dir(src), shotKey(filepath.Base(src)))
+	}
+	renamed := make(map[string]bool)
+	taken := make(map[string]bool)
+	for _, a := range actions {
+		if a.Kind == actionCopy || a.Kind == actionSkip {
+			taken[filepath.Clean(a.Dst)] = true
+		}
+		if a.Kind == actionCopy && a.Reason == reasonRenamed {
+			renamed[shotOf(a.Src)] = true
+		}
+	}
+
+	// the copies of each shot being renamed, in plan order
+	var shots []string
+	members := make(map[string][]int)
+	for i, a := range actions {
+		if a.Kind != actionCopy || a.Overwrite || !renamed[shotOf(a.Src)] {
+			continue
+		}
+		shot := shotOf(a.Src)
+		if members[shot] == nil {
+			shots = append(shots, shot)
+		}
+		members[shot] = append(members[shot], i)
+	}
+
+	for _, shot := range shots {
+		for n := 1; ; n++ {
+			dsts := make([]string, len(members[shot]))
+			identical := make([]bool, len(members[shot]))
+			free, failed := true, false
+			for j, i := range members[shot] {
+				dsts[j] = renamedPath(actions[i].Src, actions[i].Dst, n)
+				if _, err := fsys.Stat(dsts[j]); err == nil {
+					same, err := sameContent(ctx, fsys, actions[i].Src, dsts[j])
+					if err != nil {
+						if err := planFailure(ctx, &actions[i], err, opts); err != nil {
+							return fileCopyError{fileName: filepath.Base(actions[i].Src), err: err}
+						}
+						// Try this suffix again for the rest of the shot.
+						members[shot] = slices.Delete(members[shot], j, j+1)
+						failed = true
+						break
+					}
+					identical[j] = same
+					free = same
+				} else if taken[filepath.Clean(dsts[j])] {
+					free = false
+				}
+				if !free {
+					break
+				}
+			}
+			if failed {
+				n--
+				continue
+			}
+			if !free {
+				continue
+			}
+
+			for j, i := range members[shot] {
+				taken[filepath.Clean(dsts[j])] = true
+				actions[i].Dst, actions[i].Reason = dsts[j], reasonRenamed
+				if identical[j] {
+					actions[i].Kind, actions[i].Reason = actionSkip, reasonIdentical
+				}
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// renamedPath returns dst with _n inserted after the base name it shares
+// with the rest of src's shot: DSC00042.ARW becomes DSC00042_1.ARW, and
+// C0001M01.XML becomes C0001_1M01.XML.
+func renamedPath(src, dst string, n int) string {
+	name := filepath.Base(src)
+	suffix := name[len(shotBase(name)):]
+	base := filepath.Base(dst)
+	if len(suffix) > len(base) || !strings.EqualFold(base[len(base)-len(suffix):], suffix) {
+		suffix = filepath.Ext(base)
+	}
+	stem := base[:len(base)-len(suffix)]
+	return filepath.Join(filepath.Dir(dst), fmt.Sprintf("%s_%d%s", stem, n, base[len(stem):]))
+}
+
+// planCollisions plans the copies in actions whose destination an earlier
+// copy in actions is planned to as well: files of the same name in two card
+// folders, as after the camera's file counter was reset, or from two camera
+// bodies. The earlier copy keeps the destination. A later one identical to it
+// is skipped, and is safe to remove once the earlier one is copied, and one
+// that can't be compared to it fails (see planFailure). A
+// different one is planned by policy as if the destination were taken on disk
+// (see planConflict): renamed with its shot under conflictRename (see
+// renameConflicts), refused under conflictFail, and left on the card as a
+// name collision, logged to logger, otherwise. A file copied by the same run
+// isn't replaced, though: under conflictOverwrite a different file is left
+// on the card too, and under conflictSkip any file is, without comparing.
+func planCollisions(ctx context.Context, fsys FileSystem, actions []Action, opts Options) error {
+	policy, logger := opts.OnConflict, opts.logger()
+	// the source of the copy planned to each destination
+	claimed := make(map[string]string)
+	for i := range actions {
+		a := &actions[i]
+		if a.Kind != actionCopy {
+			continue
+		}
+		dst := filepath.Clean(a.Dst)
+		first, ok := claimed[dst]
+		if !ok {
+			claimed[dst] = a.Src
+			continue
+		}
+
+		if policy != conflictSkip {
+			identical, err := sameContent(ctx, fsys, first, a.Src)
+			if err != nil {
+				if err := planFailure(ctx, a, err, opts); err != nil {
+					return fileCopyError{fileName: filepath.Base(a.Src), err: err}
+				}
+				continue
+			}
+			if identical {
+				a.Kind, a.Reason, a.Overwrite = actionSkip, reasonSameCopy, false
+				continue
+			}
+		}
+		switch policy {
+		case conflictRename:
+			a.Reason, a.Overwrite = reasonRenamed, false
+		case conflictFail:
+			return fileCopyError{fileName: filepath.Base(a.Src), err: fmt.Errorf("%w: %s is copied to %s too", errNameConflict, first, a.Dst)}
+		default:
+			logger.Warn("name collision: a different file on the card is copied to the same destination; leaving it on the card", "file", a.Src, "dst", a.Dst, "other", first)
+			a.Kind, a.Reason, a.Overwrite = actionSkip, reasonClash, false
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// conflictTestFiles are a card whose DSC00042 shot has the name of a
+// different shot already in the library, from another camera body.
+var conflictTestFiles = map[string]string{
+	"src/DSC00042.ARW": "body B raw",
+	"src/DSC00042.JPG": "body B jpg",
+	"dst/DSC00042.ARW": "body A raw",
+	"dst/DSC00042.xmp": "edit of body A's shot",
+}
+
+func TestPlanImportOnConflict(t *testing.T) {
+	ctx := t.Context()
+	raw, jpg := filepath.Join("src", "DSC00042.ARW"), filepath.Join("src", "DSC00042.JPG")
+	newJPG := Action{Kind: actionCopy, Src: jpg, Dst: filepath.Join("dst-jpg", "DSC00042.JPG"), Size: int64(len("body B jpg")), Reason: reasonNew}
+	rawAt := func(kind ActionKind, dst, reason string) Action {
+		return Action{Kind: kind, Src: raw, Dst: dst, Size: int64(len("body B raw")), Reason: reason}
+	}
+
+	tests := []struct {
+		policy  conflictPolicy
+		actions []Action
+	}{
+		{conflictSkipIfIdentical, []Action{rawAt(actionSkip, filepath.Join("dst", "DSC00042.ARW"), reasonDifferent), newJPG}},
+		{conflictSkip, []Action{rawAt(actionSkip, filepath.Join("dst", "DSC00042.ARW"), reasonExists), newJPG}},
+		{conflictOverwrite, []Action{
+			{Kind: actionCopy, Src: raw, Dst: filepath.Join("dst", "DSC00042.ARW"), Size: int64(len("body B raw")), Overwrite: true, Reason: reasonOverwrite},
+			newJPG,
+		}},
+		{conflictRename, []Action{
+			rawAt(actionCopy, filepath.Join("dst", "DSC00042_1.ARW"), reasonRenamed),
+			{Kind: actionCopy, Src: jpg, Dst: filepath.Join("dst-jpg", "DSC00042_1.JPG"), Size: int64(len("body B jpg")), Reason: reasonRenamed},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			plan, err := planImport(ctx, newFakeFileSystemWith(conflictTestFiles), []string{"xmp"}, testProfile, "src", "dst", "dst-jpg", "dst-video",
+				Options{KeepJPG: true, KeepSrc: true, OnConflict: tt.policy, Concurrency: testConcurrency})
+			require.NoError(t, err)
+			assert.Equal(t, tt.actions, plan.Actions)
+		})
+	}
+
+	t.Run(string(conflictFail), func(t *testing.T) {
+		_, err := planImport(ctx, newFakeFileSystemWith(conflictTestFiles), []string{"xmp"}, testProfile, "src", "dst", "dst-jpg", "dst-video",
+			Options{KeepJPG: true, KeepSrc: true, OnConflict: conflictFail, Concurrency: testConcurrency})
+		assert.ErrorIs(t, err, errNameConflict)
+	})
+
+	t.Run("skip keeps the source with a warning", func(t *testing.T) {
+		h := &recordingHandler{}
+		plan, err := planWipeSource(ctx, newFakeFileSystemWith(conflictTestFiles), testProfile, "src", "dst", "dst-jpg", "dst-video",
+			Options{KeepJPG: true, OnConflict: conflictSkip, Logger: slog.New(h), Concurrency: testConcurrency})
+		require.NoError(t, err)
+		assert.Equal(t, []Action{rawAt(actionSkip, filepath.Join("dst", "DSC00042.ARW"), reasonExists)}, plan.Actions, "nothing is removed")
+		kept := h.find("keeping source file: -on-conflict=skip doesn't check it against the file at its destination")
+		require.Len(t, kept, 1)
+		assert.Equal(t, slog.LevelWarn, kept[0]["level"])
+		assert.Equal(t, raw, kept[0]["file"])
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := planImport(ctx, newFakeFileSystemWith(conflictTestFiles), []string{"xmp"}, testProfile, "src", "dst", "dst-jpg", "dst-video",
+			Options{OnConflict: "merge", Concurrency: testConcurrency})
+		assert.ErrorContains(t, err, `unknown conflict policy "merge"`)
+	})
+}
+
+func TestCleanSDCardRenamesConflicts(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystemWith(conflictTestFiles)
+	// a suffix taken by either file of the shot is passed over
+	fsys.addFile(filepath.Join("dst-jpg", "DSC00042_1.JPG"), "body C jpg")
+
+	report, err := cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "src", "dst", "dst-jpg", "dst-video",
+		Options{KeepJPG: true, OnConflict: conflictRename, Concurrency: testConcurrency})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Copied)
+	assert.Equal(t, 2, report.Removed, "both files are safely copied")
+
+	for path, want := range map[string]string{
+		filepath.Join("dst", "DSC00042.ARW"):       "body A raw",
+		filepath.Join("dst", "DSC00042.xmp"):       "edit of body A's shot",
+		filepath.Join("dst", "DSC00042_2.ARW"):     "body B raw",
+		filepath.Join("dst-jpg", "DSC00042_1.JPG"): "body C jpg",
+		filepath.Join("dst-jpg", "DSC00042_2.JPG"): "body B jpg",
+	} {
+		content, ok := fsys.readFile(path)
+		if assert.True(t, ok, path) {
+			assert.Equal(t, want, content, path)
+		}
+	}
+}
+
+func TestCleanSDCardOnConflictBetweenCopies(t *testing.T) {
+	ctx := t.Context()
+	dcim := filepath.Join("card", "DCIM")
+	// two camera bodies' DSC00042 shots, copied onto one card
+	fsys := newFakeFileSystem()
+	fsys.addFile(filepath.Join(dcim, "100MSDCF", "DSC00042.ARW"), "body A raw")
+	fsys.addFile(filepath.Join(dcim, "100MSDCF", "DSC00042.JPG"), "body A jpg")
+	fsys.addFile(filepath.Join(dcim, "101MSDCF", "DSC00042.ARW"), "body B raw")
+	fsys.addFile(filepath.Join(dcim, "101MSDCF", "DSC00042.JPG"), "body B jpg")
+
+	_, err := cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "card", "dst", "dst-jpg", "dst-video",
+		Options{KeepJPG: true, OnConflict: conflictFail, Concurrency: testConcurrency})
+	require.ErrorIs(t, err, errNameConflict)
+	_, ok := fsys.readFile(filepath.Join("dst", "DSC00042.ARW"))
+	assert.False(t, ok, "nothing is copied")
+
+	report, err := cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "card", "dst", "dst-jpg", "dst-video",
+		Options{KeepJPG: true, OnConflict: conflictRename, Concurrency: testConcurrency})
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.Copied)
+	assert.Equal(t, 4, report.Removed, "every file is safely copied")
+
+	for path, want := range map[string]string{
+		filepath.Join("dst", "DSC00042.ARW"):       "body A raw",
+		filepath.Join("dst-jpg", "DSC00042.JPG"):   "body A jpg",
+		filepath.Join("dst", "DSC00042_1.ARW"):     "body B raw",
+		filepath.Join("dst-jpg", "DSC00042_1.JPG"): "body B jpg",
+	} {
+		content, ok := fsys.readFile(path)
+		if assert.True(t, ok, path) {
+			assert.Equal(t, want, content, path)
+		}
+	}
+}
+
+func TestRenamedPath(t *testing.T) {
+	tests := []struct {
+		src, dst string
+		want     string
+	}{
+		{"DSC00042.ARW", filepath.Join("dst", "DSC00042.ARW"), filepath.Join("dst", "DSC00042_1.ARW")},
+		{"C0001M01.XML", filepath.Join("dst", "C0001M01.XML"), filepath.Join("dst", "C0001_1M01.XML")},
+		{"DSC00042.ARW", filepath.Join("dst", "2024", "2024-05-01_0007.ARW"), filepath.Join("dst", "2024", "2024-05-01_0007_1.ARW")},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, renamedPath(filepath.Join("src", tt.src), tt.dst, 1))
+	}
+}
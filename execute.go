@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// errDestinationExists is returned (wrapped in a fileCopyError) for a planned
+// copy whose destination was free when the plan was made but is taken now.
+var errDestinationExists = errors.New("destination file appeared since the plan was made")
+
+// errFilesFailed is returned (wrapped, with the failures) by a run in
+// keep-going mode that failed on some files but did the rest (see
+// executePlan).
+var errFilesFailed = errors.New("some files failed")
+
+// runPlan carries out plan, or in dry-run mode only logs what it would do:
+// every copy and skip, and every source file and zombie edit file it would
+// remove. Either way it first checks that the destinations have room for the
+// copies and opts.FreeSpaceMargin more (see checkFreeSpace), and refuses to
+// start if not. It returns the report of what it did -- in dry-run mode, of
+// what it would do -- and any error.
+func runPlan(ctx context.Context, fsys FileSystem, plan *Plan, opts Options) (*Report, error) {
+	logger := opts.logger()
+	report := newReport(opts.DryRun)
+	spaceErr := checkFreeSpace(fsys, plan, opts.FreeSpaceMargin, logger)
+	if opts.DryRun {
+		if spaceErr != nil {
+			logger.Warn("[dry-run] a real run would refuse to start", errAttr(spaceErr))
+		}
+		for _, a := range plan.Actions {
+			logger.Info("[dry-run] "+a.preview(), a.logAttrs()...)
+			report.record(a, "", 0, a.planErr())
+		}
+		logger.Info("[dry-run] planned",
+			"copies", plan.count(actionCopy), "source-removals", plan.count(actionRemove), "zombie-deletions", plan.count(actionDeleteZombie))
+		report.Copied, report.Removed = plan.count(actionCopy), plan.count(actionRemove)+plan.count(actionDeleteZombie)
+		return report.finish(nil)
+	}
+	if spaceErr != nil {
+		return report.finish(spaceErr)
+	}
+	var size int64
+	for _, a := range plan.Actions {
+		if a.Kind == actionCopy {
+			size += a.Size
+		}
+	}
+	var err error
+	report.Copied, report.Removed, err = executePlan(ctx, fsys, plan, opts.Concurrency, opts.KeepGoing, newProgress(opts.Progress, plan.count(actionCopy), size), report, logger)
+	return report.finish(err)
+}
+
+// executePlan carries out plan: it copies and verifies every planned copy
+// (see copyAndVerify), then removes the planned source files and deletes the
+// planned zombie edit files, moving those planned to go to the trash there
+// instead, and finally purges the planned trash folders. It saves the library
+// indexes the plan was made with (see libraryIndex) first. Each file's
+// progress is recorded in the journal in plan.JournalDir, and what the run
+// did in its run record in plan.RecordDir, for undo (see runRecord); either
+// is skipped if the plan has no directory for it.
+// What it does is checked against the filesystem as it is now rather than as
+// it was when the plan was made, so that a saved plan applied later can't do
+// harm: a copy never replaces a file that has appeared at its destination
+// unless it was planned to, nothing is removed from the source if any copy
+// failed or if a copy of it is no longer at the destination, and an edit file
+// whose RAW has turned up is not deleted.
+// At most maxConcurrency files are processed at once. The copies' progress is
+// shown by prog, and every action done or failed is recorded in report,
+// either if not nil, and logged to logger.
+// A file that fails to copy or remove stops the run once the files in
+// progress are done -- and a failed copy before anything is removed. In
+// keepGoing mode the run goes on instead: the source files whose copies
+// succeeded are still removed, only those of the failed copies kept, and the
+// zombie edit files deleted; it then returns errFilesFailed with the
+// failures, each of which is in report too. Files planning failed on in
+// keep-going mode (see planFailure) count as failures too, and stop a run
+// that isn't in keepGoing mode before anything is copied.
+// Once ctx is done, no more files are copied or removed: copies in progress
+// either finish or have their temp file removed (see copyAndVerify), and if
+// it happens before every copy is done, nothing is removed at all. The
+// journal then has what is left for -resume.
+// It returns the number of files copied, the number of files removed, and
+// any error.
+func executePlan(ctx context.Context, fsys FileSystem, plan *Plan, maxConcurrency int, keepGoing bool, prog *progress, report *Report, logger *slog.Logger) (int, int, error) {
+	indexes := make(map[string]*libraryIndex)
+	for _, ix := range plan.indexes {
+		indexes[ix.root] = ix
+	}
+	for _, dir := range plan.DstDirs {
+		if err := fsys.MkdirAll(dir, 0755); err != nil {
+			return 0, 0, fmt.Errorf("failed to create destination directory: %w", err)
+		}
+		// Planning walked the library to index it, and found the stale temp
+		// files on the way; only a plan loaded from a file walks it again.
+		var err error
+		if ix, ok := indexes[dir]; ok {
+			_, err = ix.removeStaleTemps(fsys, logger)
+		} else {
+			_, err = removeStaleTempFiles(ctx, fsys, dir, maxConcurrency, logger)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to clean up stale temp files in %s: %w", dir, err)
+		}
+	}
+	// The indexes only cache hashes, so failing to save one costs the next
+	// run some hashing, nothing more.
+	for _, ix := range plan.indexes {
+		if err := ix.save(fsys); err != nil {
+			logger.Warn("failed to save library index", "dir", ix.root, errAttr(err))
+		}
+	}
+
+	var j *journal
+	if plan.JournalDir != "" {
+		var err error
+		if j, err = openJournal(fsys, plan.JournalDir, plan.Resume); err != nil {
+			return 0, 0, err
+		}
+		defer j.Close()
+	}
+	var rec *runRecord
+	if plan.RecordDir != "" {
+		rec = newRunRecord(fsys, plan.RecordDir, time.Now())
+		defer rec.Close()
+	}
+
+	// failed collects the failures the run went on after in keepGoing mode.
+	var failed error
+	// stop returns the error to stop the run with on err, or nil if the run
+	// goes on after it.
+	stop := func(err error) error {
+		if keepGoing && ctx.Err() == nil {
+			failed = errors.Join(failed, err)
+			return nil
+		}
+		if failed != nil {
+			return errors.Join(failed, err)
+		}
+		return err
+	}
+
+	var copies, removals, zombies, purges []Action
+	// dstsBySrc holds where each source file has a copy once the copies are
+	// done, to check before removing it.
+	dstsBySrc := make(map[string][]string)
+	for _, a := range plan.Actions {
+		switch a.Kind {
+		case actionCopy:
+			copies = append(copies, a)
+			dstsBySrc[a.Src] = append(dstsBySrc[a.Src], a.Dst)
+		case actionSkip:
+			if err := a.planErr(); err != nil {
+				// Planning failed on the file, in keep-going mode.
+				logger.Warn("skipped: failed to plan it", a.logAttrs()...)
+				report.record(a, "", 0, err)
+				if err := stop(fileCopyError{fileName: filepath.Base(a.Src), err: err}); err != nil {
+					return 0, 0, err
+				}
+				continue
+			}
+			logger.Debug("skipped", a.logAttrs()...)
+			report.record(a, "", 0, nil)
+			if a.leavesKnownGoodCopy() {
+				dstsBySrc[a.Src] = append(dstsBySrc[a.Src], a.Dst)
+			}
+		case actionRemove:
+			removals = append(removals, a)
+		case actionDeleteZombie:
+			zombies = append(zombies, a)
+		case actionPurgeTrash:
+			purges = append(purges, a)
+		}
+	}
+
+	// Record everything that is about to be copied before copying any of
+	// it, so that an interrupted run leaves a complete list of what's left.
+	for _, a := range copies {
+		if err := j.record(a.Src, a.Dst, a.Size, "", journalPlanned); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	var mu sync.Mutex
+	// failedDsts are the destinations a copy to which failed, and that so
+	// hold no known-good copy of any source file.
+	failedDsts := make(map[string]bool)
+	prog.start()
+	totalCopied, err := forEachEntryConcurrently(ctx, copies, maxConcurrency, func(a Action) (int, error) {
+		started := time.Now()
+		f := prog.startFile(a.Src, a.Size)
+		hash, err := copyPlanned(ctx, fsys, j, a, f, logger)
+		prog.finishFile(f, err == nil)
+		report.record(a, hash, time.Since(started), err)
+		if err != nil {
+			mu.Lock()
+			failedDsts[filepath.Clean(a.Dst)] = true
+			mu.Unlock()
+			return 0, err
+		}
+		if err := rec.record(a); err != nil {
+			return 0, err
+		}
+		logger.Info("copied", "file", a.Src, "dst", a.Dst, "bytes", a.Size, "reason", a.Reason)
+		return 1, nil
+	})
+	prog.stop()
+	if err != nil {
+		if err := stop(fmt.Errorf("failed to copy files (copied %d): %w", totalCopied, err)); err != nil {
+			return totalCopied, 0, err
+		}
+		logger.Warn("some files failed to copy; going on with the rest", "failed", len(failedDsts))
+	}
+
+	var removable []Action
+	for _, a := range removals {
+		if slices.ContainsFunc(dstsBySrc[a.Src], func(dst string) bool { return failedDsts[filepath.Clean(dst)] }) {
+			logger.Warn("keeping source file: its copy failed", "file", a.Src)
+		} else if hasCopies(fsys, dstsBySrc[a.Src]) {
+			removable = append(removable, a)
+		} else {
+			logger.Warn("keeping source file: its copy is no longer at the destination", "file", a.Src)
+		}
+	}
+	removedCount, err := removeFiles(ctx, fsys, j, rec, report, removable, maxConcurrency, logger)
+	if err != nil {
+		if err := stop(fmt.Errorf("failed to remove source files: %w", err)); err != nil {
+			return totalCopied, removedCount, err
+		}
+	}
+
+	count, err := forEachEntryConcurrently(ctx, zombies, maxConcurrency, func(a Action) (int, error) {
+		hasRaw, err := hasRawFile(fsys, a.Dst, plan.RawExtensions)
+		if err != nil {
+			return 0, err
+		}
+		if hasRaw {
+			logger.Info("keeping edit file: its RAW has appeared", "file", a.Dst)
+			return 0, nil
+		}
+		started := time.Now()
+		a, err = deleteZombie(ctx, fsys, a, logger)
+		report.record(a, "", time.Since(started), err)
+		if err != nil {
+			return 0, err
+		}
+		if err := rec.record(a); err != nil {
+			return 0, err
+		}
+		if a.Trash != "" {
+			logger.Info("moved zombie edit file to the trash", "file", a.Dst, "trash", a.Trash)
+		} else {
+			logger.Info("removed zombie edit file", "file", a.Dst)
+		}
+		return 1, nil
+	})
+	removedCount += count
+	if err != nil {
+		if err := stop(fmt.Errorf("failed to delete zombie edit files: %w", err)); err != nil {
+			return totalCopied, removedCount, err
+		}
+	}
+
+	// Purged trash isn't counted as removed: it was counted when trashed.
+	for _, a := range purges {
+		if err := ctx.Err(); err != nil {
+			return totalCopied, removedCount, stop(err)
+		}
+		started := time.Now()
+		err := removeTree(fsys, a.Dst)
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		report.record(a, "", time.Since(started), err)
+		if err != nil {
+			if err := stop(fmt.Errorf("failed to purge trash: %w", err)); err != nil {
+				return totalCopied, removedCount, err
+			}
+			continue
+		}
+		logger.Info("purged trash folder", "dir", a.Dst)
+	}
+
+	if failed != nil {
+		return totalCopied, removedCount, fmt.Errorf("%w: %w", errFilesFailed, failed)
+	}
+	return totalCopied, removedCount, nil
+}
+
+// copyPlanned carries out the planned copy a (see copyAndVerify), reporting
+// its progress to f, and returns the hash it was verified against.
+func copyPlanned(ctx context.Context, fsys FileSystem, j *journal, a Action, f *fileProgress, logger *slog.Logger) (string, error) {
+	name := filepath.Base(a.Src)
+	if !a.Overwrite {
+		if _, err := fsys.Stat(a.Dst); err == nil {
+			return "", fileCopyError{fileName: name, err: errDestinationExists}
+		}
+	}
+	if err := fsys.MkdirAll(filepath.Dir(a.Dst), 0755); err != nil {
+		return "", fileCopyError{fileName: name, err: err}
+	}
+	hash, err := copyAndVerify(ctx, fsys, j, a.Src, a.Dst, f.onRead(), logger)
+	if err != nil {
+		return "", fileCopyError{fileName: name, err: err}
+	}
+	return hash, nil
+}
+
+// deleteZombie deletes the zombie edit file a.Dst, or moves it to the trash
+// if a has a Trash path, and returns a with the path it was moved to.
+func deleteZombie(ctx context.Context, fsys FileSystem, a Action, logger *slog.Logger) (Action, error) {
+	if a.Trash != "" {
+		trashed, err := moveToTrash(ctx, fsys, a.Dst, a.Trash, logger)
+		if err != nil {
+			return a, err
+		}
+		a.Trash = trashed
+		return a, nil
+	}
+	if err := fsys.Remove(a.Dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return a, fmt.Errorf("failed to remove zombie edit file %s: %w", filepath.Base(a.Dst), err)
+	}
+	return a, nil
+}
+
+// hasCopies reports whether there is at least one of dsts and every one of
+// them exists.
+func hasCopies(fsys FileSystem, dsts []string) bool {
+	for _, dst := range dsts {
+		if _, err := fsys.Stat(dst); err != nil {
+			return false
+		}
+	}
+	return len(dsts) > 0
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -14,29 +20,53 @@ import (
 // correctness doesn't depend on the real disk (and its OS-specific quirks,
 // such as transient file locks held by indexers/antivirus on Windows).
 type fakeFileSystem struct {
-	mu    sync.Mutex
-	files map[string][]byte
-	dirs  map[string]bool
+	mu       sync.Mutex
+	files    map[string][]byte
+	modTimes map[string]time.Time
+	dirs     map[string]bool
+	// disks are the simulated disks by the directory they are mounted at;
+	// everything else is on a disk with room to spare.
+	disks map[string]diskSpace
 }
 
 func newFakeFileSystem() *fakeFileSystem {
 	return &fakeFileSystem{
-		files: make(map[string][]byte),
-		dirs:  map[string]bool{".": true},
+		files:    make(map[string][]byte),
+		modTimes: make(map[string]time.Time),
+		dirs:     map[string]bool{".": true},
+		disks:    make(map[string]diskSpace),
 	}
 }
 
+// newFakeFileSystemWith returns a fake file system holding files, by
+// slash-separated path, for a test.
+func newFakeFileSystemWith(files map[string]string) *fakeFileSystem {
+	f := newFakeFileSystem()
+	for path, content := range files {
+		f.addFile(filepath.FromSlash(path), content)
+	}
+	return f
+}
+
 func cleanFakePath(p string) string {
 	return filepath.ToSlash(filepath.Clean(p))
 }
 
-// addFile seeds a file (and its parent directories) for a test.
+// addFile seeds a file (and its parent directories) for a test, modified
+// now.
 func (f *fakeFileSystem) addFile(path, content string) {
+	f.addFileWithModTime(path, content, time.Now())
+}
+
+// addFileWithModTime seeds a file (and its parent directories) with the given
+// modification time for a test.
+func (f *fakeFileSystem) addFileWithModTime(path, content string, modTime time.Time) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
 	path = cleanFakePath(path)
 	f.files[path] = []byte(content)
+	f.modTimes[path] = modTime
 	f.markDirTree(cleanFakePath(filepath.Dir(path)))
 }
 
@@ -71,9 +101,11 @@ func (f *fakeFileSystem) ReadDir(dir string) ([]os.DirEntry, error) {
 	}
 
 	isDirByName := make(map[string]bool)
-	for path := range f.files {
+	infoByName := make(map[string]fakeFileInfo)
+	for path, content := range f.files {
 		if cleanFakePath(filepath.Dir(path)) == dir {
 			isDirByName[filepath.Base(path)] = false
+			infoByName[filepath.Base(path)] = fakeFileInfo{name: filepath.Base(path), size: int64(len(content)), modTime: f.modTimes[path]}
 		}
 	}
 	for path := range f.dirs {
@@ -87,7 +119,11 @@ func (f *fakeFileSystem) ReadDir(dir string) ([]os.DirEntry, error) {
 
 	entries := make([]os.DirEntry, 0, len(isDirByName))
 	for name, isDir := range isDirByName {
-		entries = append(entries, fakeDirEntry{name: name, isDir: isDir})
+		info, ok := infoByName[name]
+		if !ok {
+			info = fakeFileInfo{name: name, isDir: isDir}
+		}
+		entries = append(entries, fakeDirEntry{info: info})
 	}
 	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
 	return entries, nil
@@ -99,7 +135,7 @@ func (f *fakeFileSystem) Stat(path string) (os.FileInfo, error) {
 
 	path = cleanFakePath(path)
 	if content, ok := f.files[path]; ok {
-		return fakeFileInfo{name: filepath.Base(path), size: int64(len(content))}, nil
+		return fakeFileInfo{name: filepath.Base(path), size: int64(len(content)), modTime: f.modTimes[path]}, nil
 	}
 	if f.dirs[path] {
 		return fakeFileInfo{name: filepath.Base(path), isDir: true}, nil
@@ -107,15 +143,43 @@ func (f *fakeFileSystem) Stat(path string) (os.FileInfo, error) {
 	return nil, fmt.Errorf("stat %s: %w", path, os.ErrNotExist)
 }
 
+func (f *fakeFileSystem) Open(path string) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path = cleanFakePath(path)
+	content, ok := f.files[path]
+	if !ok {
+		return nil, fmt.Errorf("open %s: %w", path, os.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
 func (f *fakeFileSystem) Remove(path string) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
 	path = cleanFakePath(path)
+	if f.dirs[path] {
+		// Like os.Remove, only an empty directory can be removed.
+		for p := range f.files {
+			if cleanFakePath(filepath.Dir(p)) == path {
+				return fmt.Errorf("remove %s: directory not empty", path)
+			}
+		}
+		for p := range f.dirs {
+			if p != path && cleanFakePath(filepath.Dir(p)) == path {
+				return fmt.Errorf("remove %s: directory not empty", path)
+			}
+		}
+		delete(f.dirs, path)
+		return nil
+	}
 	if _, ok := f.files[path]; !ok {
 		return fmt.Errorf("remove %s: %w", path, os.ErrNotExist)
 	}
 	delete(f.files, path)
+	delete(f.modTimes, path)
 	return nil
 }
 
@@ -127,45 +191,183 @@ func (f *fakeFileSystem) MkdirAll(path string, _ os.FileMode) error {
 	return nil
 }
 
-func (f *fakeFileSystem) CopyFile(src, dst string) error {
+func (f *fakeFileSystem) CopyFile(ctx context.Context, src, dst string, onRead func(n int64)) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
 	src = cleanFakePath(src)
 	content, ok := f.files[src]
 	if !ok {
-		return fmt.Errorf("open %s: %w", src, os.ErrNotExist)
+		return "", fmt.Errorf("open %s: %w", src, os.ErrNotExist)
 	}
 
 	dst = cleanFakePath(dst)
 	f.files[dst] = append([]byte(nil), content...)
+	f.modTimes[dst] = time.Now()
 	f.markDirTree(cleanFakePath(filepath.Dir(dst)))
+	if onRead != nil {
+		onRead(int64(len(content)))
+	}
+	return fakeHash(content), nil
+}
+
+func (f *fakeFileSystem) HashFile(ctx context.Context, path string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path = cleanFakePath(path)
+	content, ok := f.files[path]
+	if !ok {
+		return "", fmt.Errorf("open %s: %w", path, os.ErrNotExist)
+	}
+	return fakeHash(content), nil
+}
+
+func (f *fakeFileSystem) Rename(oldPath, newPath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	oldPath = cleanFakePath(oldPath)
+	content, ok := f.files[oldPath]
+	if !ok {
+		return fmt.Errorf("rename %s: %w", oldPath, os.ErrNotExist)
+	}
+
+	newPath = cleanFakePath(newPath)
+	if !f.dirs[cleanFakePath(filepath.Dir(newPath))] {
+		return fmt.Errorf("rename %s: %w", newPath, os.ErrNotExist)
+	}
+	delete(f.files, oldPath)
+	f.files[newPath] = content
+	f.modTimes[newPath] = f.modTimes[oldPath]
+	delete(f.modTimes, oldPath)
 	return nil
 }
 
-type fakeDirEntry struct {
-	name  string
-	isDir bool
+// crossDeviceFileSystem wraps a fakeFileSystem whose top-level directories
+// are separate volumes -- a card and a library disk -- failing renames from
+// one to another as the OS does.
+type crossDeviceFileSystem struct {
+	*fakeFileSystem
 }
 
-func (e fakeDirEntry) Name() string { return e.name }
-func (e fakeDirEntry) IsDir() bool  { return e.isDir }
+func (f crossDeviceFileSystem) Rename(oldPath, newPath string) error {
+	volume := func(p string) string {
+		return strings.SplitN(cleanFakePath(p), "/", 2)[0]
+	}
+	if volume(oldPath) != volume(newPath) {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: errCrossDevice}
+	}
+	return f.fakeFileSystem.Rename(oldPath, newPath)
+}
 
-func (e fakeDirEntry) Type() fs.FileMode {
-	if e.isDir {
-		return fs.ModeDir
+func (f *fakeFileSystem) Chtimes(path string, _, mtime time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path = cleanFakePath(path)
+	if _, ok := f.files[path]; !ok {
+		return fmt.Errorf("chtimes %s: %w", path, os.ErrNotExist)
 	}
-	return 0
+	f.modTimes[path] = mtime
+	return nil
 }
 
-func (e fakeDirEntry) Info() (fs.FileInfo, error) {
-	return fakeFileInfo{name: e.name, isDir: e.isDir}, nil
+func (f *fakeFileSystem) AppendFile(path string) (io.WriteCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path = cleanFakePath(path)
+	if !f.dirs[cleanFakePath(filepath.Dir(path))] {
+		return nil, fmt.Errorf("open %s: %w", path, os.ErrNotExist)
+	}
+	if _, ok := f.files[path]; !ok {
+		f.files[path] = nil
+		f.modTimes[path] = time.Now()
+	}
+	return fakeAppender{fsys: f, path: path}, nil
 }
 
+// setDiskSpace mounts a simulated disk with available bytes free at dir.
+func (f *fakeFileSystem) setDiskSpace(dir string, available uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.disks[cleanFakePath(dir)] = diskSpace{Device: cleanFakePath(dir), Available: available}
+}
+
+func (f *fakeFileSystem) DiskSpace(path string) (diskSpace, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path = cleanFakePath(path)
+	if _, ok := f.files[path]; !ok && !f.dirs[path] {
+		return diskSpace{}, fmt.Errorf("statfs %s: %w", path, os.ErrNotExist)
+	}
+	for p := path; ; p = filepath.Dir(p) {
+		if d, ok := f.disks[p]; ok {
+			return d, nil
+		}
+		if p == "." || p == filepath.Dir(p) {
+			return diskSpace{Device: "fake", Available: 1 << 50}, nil
+		}
+	}
+}
+
+// fakeAppender appends what is written to it to a fakeFileSystem file.
+type fakeAppender struct {
+	fsys *fakeFileSystem
+	path string
+}
+
+func (a fakeAppender) Write(p []byte) (int, error) {
+	a.fsys.mu.Lock()
+	defer a.fsys.mu.Unlock()
+
+	if _, ok := a.fsys.files[a.path]; !ok {
+		return 0, fmt.Errorf("write %s: %w", a.path, os.ErrNotExist)
+	}
+	a.fsys.files[a.path] = append(a.fsys.files[a.path], p...)
+	return len(p), nil
+}
+
+func (a fakeAppender) Close() error { return nil }
+
+// readFile returns the content of a seeded or copied file for assertions.
+func (f *fakeFileSystem) readFile(path string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	content, ok := f.files[cleanFakePath(path)]
+	return string(content), ok
+}
+
+func fakeHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+type fakeDirEntry struct {
+	info fakeFileInfo
+}
+
+func (e fakeDirEntry) Name() string               { return e.info.name }
+func (e fakeDirEntry) IsDir() bool                { return e.info.isDir }
+func (e fakeDirEntry) Type() fs.FileMode          { return e.info.Mode().Type() }
+func (e fakeDirEntry) Info() (fs.FileInfo, error) { return e.info, nil }
+
 type fakeFileInfo struct {
-	name  string
-	size  int64
-	isDir bool
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
 }
 
 func (i fakeFileInfo) Name() string { return i.name }
@@ -178,7 +380,7 @@ func (i fakeFileInfo) Mode() fs.FileMode {
 	return 0
 }
 
-func (i fakeFileInfo) ModTime() time.Time { return time.Time{} }
+func (i fakeFileInfo) ModTime() time.Time { return i.modTime }
 func (i fakeFileInfo) IsDir() bool        { return i.isDir }
 func (i fakeFileInfo) Sys() any           { return nil }
 
@@ -206,3 +408,67 @@ func (f *readDirCountingFileSystem) callsFor(dir string) int {
 	defer f.mu.Unlock()
 	return f.readDirCalls[dir]
 }
+
+// corruptingFileSystem wraps a fakeFileSystem and silently corrupts the
+// destination of every CopyFile whose source base name is in corrupt, while
+// still reporting the source's hash -- simulating a bad write that only
+// verification can catch.
+type corruptingFileSystem struct {
+	*fakeFileSystem
+	corrupt map[string]bool
+}
+
+func (f *corruptingFileSystem) CopyFile(ctx context.Context, src, dst string, onRead func(n int64)) (string, error) {
+	hash, err := f.fakeFileSystem.CopyFile(ctx, src, dst, onRead)
+	if err != nil || !f.corrupt[filepath.Base(src)] {
+		return hash, err
+	}
+	f.addFile(dst, "corrupted")
+	return hash, nil
+}
+
+// hashCountingFileSystem wraps a FileSystem and counts HashFile calls per
+// path, so tests can assert a file isn't hashed again.
+type hashCountingFileSystem struct {
+	FileSystem
+	mu        sync.Mutex
+	hashCalls map[string]int
+}
+
+func newHashCountingFileSystem(fsys FileSystem) *hashCountingFileSystem {
+	return &hashCountingFileSystem{FileSystem: fsys, hashCalls: make(map[string]int)}
+}
+
+func (f *hashCountingFileSystem) HashFile(ctx context.Context, path string) (string, error) {
+	f.mu.Lock()
+	f.hashCalls[path]++
+	f.mu.Unlock()
+	return f.FileSystem.HashFile(ctx, path)
+}
+
+func (f *hashCountingFileSystem) callsFor(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.hashCalls[path]
+}
+
+// cancellingFileSystem wraps a fakeFileSystem and calls cancel once after
+// copies have been made, simulating a Ctrl-C in the middle of an import.
+type cancellingFileSystem struct {
+	*fakeFileSystem
+	cancel context.CancelFunc
+	after  int
+
+	mu     sync.Mutex
+	copies int
+}
+
+func (f *cancellingFileSystem) CopyFile(ctx context.Context, src, dst string, onRead func(n int64)) (string, error) {
+	hash, err := f.fakeFileSystem.CopyFile(ctx, src, dst, onRead)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.copies++; f.copies == f.after {
+		f.cancel()
+	}
+	return hash, err
+}
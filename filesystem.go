@@ -1,26 +1,50 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
-// FileSystem abstracts the filesystem operations that copyFiles, removeFiles,
-// and deleteZombieEditFiles depend on, so that callers (tests, in particular)
-// can substitute a fake implementation instead of touching the real disk.
+// FileSystem abstracts the filesystem operations that planning and executing
+// an import depend on, so that callers (tests, in particular) can substitute
+// a fake implementation instead of touching the real disk.
 type FileSystem interface {
 	ReadDir(dir string) ([]os.DirEntry, error)
 	Stat(path string) (os.FileInfo, error)
+	Open(path string) (io.ReadCloser, error)
 	Remove(path string) error
 	MkdirAll(path string, perm os.FileMode) error
-	CopyFile(src, dst string) error
+	// CopyFile copies src to dst and returns the hex-encoded SHA-256 of the
+	// bytes it read from src, so callers can verify dst against it. dst is
+	// created with src's permission bits. Once ctx is done it stops with
+	// ctx's error, leaving dst partly written. onRead, if not nil, is called
+	// with the number of bytes of each read from src as the copy goes, for
+	// progress reporting.
+	CopyFile(ctx context.Context, src, dst string, onRead func(n int64)) (string, error)
+	// HashFile returns the hex-encoded SHA-256 of the file at path. Once ctx
+	// is done it stops with ctx's error.
+	HashFile(ctx context.Context, path string) (string, error)
+	// Rename moves oldPath to newPath, replacing newPath if it exists.
+	Rename(oldPath, newPath string) error
+	// Chtimes sets the access and modification times of path.
+	Chtimes(path string, atime, mtime time.Time) error
+	// AppendFile opens path for appending, creating it if it doesn't exist.
+	AppendFile(path string) (io.WriteCloser, error)
+	// DiskSpace reports the free space of the disk holding path, which must
+	// exist, or errDiskSpaceUnknown if it can't be told.
+	DiskSpace(path string) (diskSpace, error)
 }
 
 // osFileSystem implements FileSystem using the real OS filesystem.
@@ -34,6 +58,10 @@ func (osFileSystem) Stat(path string) (os.FileInfo, error) {
 	return os.Stat(path)
 }
 
+func (osFileSystem) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
 func (osFileSystem) Remove(path string) error {
 	return os.Remove(path)
 }
@@ -42,23 +70,108 @@ func (osFileSystem) MkdirAll(path string, perm os.FileMode) error {
 	return os.MkdirAll(path, perm)
 }
 
-func (osFileSystem) CopyFile(src, dst string) error {
+func (osFileSystem) CopyFile(ctx context.Context, src, dst string, onRead func(n int64)) (string, error) {
 	in, err := os.Open(src)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer in.Close()
 
-	out, err := os.Create(dst)
+	info, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	var r io.Reader = contextReader{ctx, in}
+	if onRead != nil {
+		r = countingReader{r, onRead}
+	}
+	h := sha256.New()
+	if _, err := io.Copy(out, io.TeeReader(r, h)); err != nil {
+		out.Close()
+		return "", err
+	}
+	// Flush to stable storage before the caller renames dst into place, so
+	// a power loss can't leave a complete-looking name with missing data.
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return "", err
 	}
-	defer out.Close()
+	// A failed flush on close is a short write too, so don't drop its error.
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (osFileSystem) HashFile(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, contextReader{ctx, f}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// contextReader reads from r until ctx is done, and then fails with ctx's
+// error, so that copying or hashing a large file stops between two reads.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// countingReader reads from r and reports the number of bytes of each read
+// to onRead.
+type countingReader struct {
+	r      io.Reader
+	onRead func(n int64)
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if n > 0 {
+		cr.onRead(int64(n))
+	}
+	return n, err
+}
+
+func (osFileSystem) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (osFileSystem) Chtimes(path string, atime, mtime time.Time) error {
+	return os.Chtimes(path, atime, mtime)
+}
+
+func (osFileSystem) AppendFile(path string) (io.WriteCloser, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
 
-	_, err = io.Copy(out, in)
-	return err
+func (osFileSystem) DiskSpace(path string) (diskSpace, error) {
+	return diskSpaceOf(path)
 }
 
+// errChecksumMismatch is returned (wrapped in a fileCopyError) when a copied
+// file's destination content doesn't hash to the same value as the source.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
 type fileCopyError struct {
 	fileName string
 	err      error
@@ -68,12 +181,18 @@ func (e fileCopyError) Error() string {
 	return fmt.Sprintf("failed to copy file %s: %s", e.fileName, e.err.Error())
 }
 
+func (e fileCopyError) Unwrap() error {
+	return e.err
+}
+
 // forEachEntryConcurrently runs fn for each entry, aggregating the increments
 // fn reports and any errors it returns. At most maxConcurrency invocations of
 // fn run at once (values <= 0 are treated as 1), so callers touching a
 // bottlenecked device (e.g. an SD card) can bound how many concurrent
 // operations hit it instead of spawning one goroutine per entry.
-func forEachEntryConcurrently(entries []os.DirEntry, maxConcurrency int, fn func(entry os.DirEntry) (int, error)) (int, error) {
+// Once ctx is done no more invocations are started; those running are
+// waited for, and ctx's error is returned with theirs.
+func forEachEntryConcurrently[E any](ctx context.Context, entries []E, maxConcurrency int, fn func(entry E) (int, error)) (int, error) {
 	if maxConcurrency <= 0 {
 		maxConcurrency = 1
 	}
@@ -83,8 +202,20 @@ func forEachEntryConcurrently(entries []os.DirEntry, maxConcurrency int, fn func
 	errsChan := make(chan error, len(entries))
 	sem := make(chan struct{}, maxConcurrency)
 
+	stopped := false
 	for _, entry := range entries {
-		sem <- struct{}{}
+		if ctx.Err() != nil {
+			stopped = true
+			break
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			stopped = true
+		}
+		if stopped {
+			break
+		}
 		wg.Go(func() {
 			defer func() { <-sem }()
 			n, err := fn(entry)
@@ -103,6 +234,9 @@ func forEachEntryConcurrently(entries []os.DirEntry, maxConcurrency int, fn func
 	for e := range errsChan {
 		errs = errors.Join(errs, e)
 	}
+	if stopped && !errors.Is(errs, ctx.Err()) {
+		errs = errors.Join(errs, ctx.Err())
+	}
 
 	return int(count.Load()), errs
 }
@@ -118,89 +252,250 @@ func matchesAnyExtension(name string, exts []string) bool {
 	return false
 }
 
-// copyFiles copies entries whose extension is in exts from srcDir to dstDir.
-// entries is a directory listing of srcDir supplied by the caller so that a
-// single srcDir listing can be shared across multiple extension groups
-// instead of re-reading the (potentially slow, e.g. SD card) source directory
-// once per group. At most maxConcurrency files are copied at once.
-// If flagDryRun is true, it counts files without copying.
-// If flagOverwrite is true, it overwrites existing files in dstDir.
-// It returns the number of files copied and any error.
-func copyFiles(fsys FileSystem, entries []os.DirEntry, srcDir, dstDir string, exts []string, flagDryRun, flagOverwrite bool, maxConcurrency int) (int, error) {
-	return forEachEntryConcurrently(entries, maxConcurrency, func(entry os.DirEntry) (int, error) {
-		if entry.IsDir() {
-			return 0, nil
-		}
+// destinationPath returns where the source file at srcPath is copied to in
+// dstDir: its path in dstRelPaths (see planDestinations) if it has one, and
+// directly in dstDir under its own name otherwise.
+func destinationPath(dstDir, srcPath string, dstRelPaths map[string]string) string {
+	if relPath, ok := dstRelPaths[srcPath]; ok {
+		return filepath.Join(dstDir, relPath)
+	}
+	return filepath.Join(dstDir, filepath.Base(srcPath))
+}
 
-		name := entry.Name()
-		if !matchesAnyExtension(name, exts) {
-			return 0, nil
-		}
+// sameContent reports whether the files at a and b hash to the same value.
+func sameContent(ctx context.Context, fsys FileSystem, a, b string) (bool, error) {
+	hashA, err := fsys.HashFile(ctx, a)
+	if err != nil {
+		return false, err
+	}
+	hashB, err := fsys.HashFile(ctx, b)
+	if err != nil {
+		return false, err
+	}
+	return hashA == hashB, nil
+}
 
-		srcPath := filepath.Join(srcDir, name)
-		dstPath := filepath.Join(dstDir, name)
+// hashCachingFileSystem wraps a FileSystem and remembers the hash of each
+// file it hashes, for planning: nothing changes while a plan is made, so a
+// card file compared with its destination and then looked up in the library,
+// say, is only read once.
+type hashCachingFileSystem struct {
+	FileSystem
+	mu     sync.Mutex
+	hashes map[string]string
+}
 
-		if !flagOverwrite {
-			if _, statErr := fsys.Stat(dstPath); statErr == nil {
-				log.Printf("skipping copying existing file: %s\n", name)
-				return 0, nil
-			}
-		}
+func newHashCachingFileSystem(fsys FileSystem) *hashCachingFileSystem {
+	return &hashCachingFileSystem{FileSystem: fsys, hashes: make(map[string]string)}
+}
+
+func (f *hashCachingFileSystem) HashFile(ctx context.Context, path string) (string, error) {
+	f.mu.Lock()
+	hash, ok := f.hashes[path]
+	f.mu.Unlock()
+	if ok {
+		return hash, nil
+	}
+	hash, err := f.FileSystem.HashFile(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	f.hashes[path] = hash
+	f.mu.Unlock()
+	return hash, nil
+}
+
+// tempFileSuffix marks the hidden temp files copyAndVerify writes into the
+// destination directory before renaming them into place.
+const tempFileSuffix = ".clean-sd-card.tmp"
+
+// tempPathFor returns the hidden temp path that dstPath is written to before
+// being renamed into place. It lives in the same directory as dstPath so the
+// rename stays on one filesystem and is atomic.
+func tempPathFor(dstPath string) string {
+	return filepath.Join(filepath.Dir(dstPath), "."+filepath.Base(dstPath)+tempFileSuffix)
+}
+
+// isTempFileName reports whether name is one of copyAndVerify's temp files.
+func isTempFileName(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, tempFileSuffix)
+}
 
-		if flagDryRun {
-			log.Printf("[dry-run] would copy %s\n", name)
-			return 1, nil
+// copyAndVerify copies srcPath to a temp file next to dstPath, re-reads it to
+// check that it hashes to the same value as the bytes read from srcPath,
+// stamps it with srcPath's modification time (photo tools and backup software
+// sort and diff by mtime, so a copy shouldn't look newer than the shot), and
+// only then renames it to dstPath. An interrupted or corrupt copy therefore
+// never appears under dstPath, where a later run would mistake it for a
+// complete file and skip it; the temp file is removed on failure, and any
+// left behind by a killed run are cleaned up by removeStaleTempFiles.
+// The copy's progress is recorded in j, and the bytes read from srcPath are
+// reported to onRead, if not nil (see FileSystem.CopyFile).
+// Failing to remove the temp file is logged to logger. It returns the hash
+// the copy was verified against.
+func copyAndVerify(ctx context.Context, fsys FileSystem, j *journal, srcPath, dstPath string, onRead func(n int64), logger *slog.Logger) (string, error) {
+	tmpPath := tempPathFor(dstPath)
+
+	size, hash, err := copyAndVerifyTemp(ctx, fsys, j, srcPath, dstPath, tmpPath, onRead)
+	if err != nil {
+		if rmErr := fsys.Remove(tmpPath); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) {
+			logger.Warn("failed to remove temp file", "file", tmpPath, errAttr(rmErr))
 		}
+		return "", err
+	}
 
-		if copyErr := fsys.CopyFile(srcPath, dstPath); copyErr != nil {
-			return 0, fileCopyError{fileName: name, err: copyErr}
+	if err := fsys.Rename(tmpPath, dstPath); err != nil {
+		if rmErr := fsys.Remove(tmpPath); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) {
+			logger.Warn("failed to remove temp file", "file", tmpPath, errAttr(rmErr))
 		}
+		return "", fmt.Errorf("failed to move copy into place: %w", err)
+	}
 
-		log.Printf("copied %s\n", name)
-		return 1, nil
-	})
+	return hash, j.record(srcPath, dstPath, size, hash, journalVerified)
 }
 
-// removeFiles removes all files in entries, a directory listing of dir
-// supplied by the caller (see copyFiles). At most maxConcurrency files are
-// removed at once.
+// copyAndVerifyTemp does copyAndVerify's work up to the rename, and returns
+// the size and hash of the verified temp file.
+func copyAndVerifyTemp(ctx context.Context, fsys FileSystem, j *journal, srcPath, dstPath, tmpPath string, onRead func(n int64)) (int64, string, error) {
+	srcInfo, err := fsys.Stat(srcPath)
+	if err != nil {
+		return 0, "", err
+	}
+
+	srcHash, err := fsys.CopyFile(ctx, srcPath, tmpPath, onRead)
+	if err != nil {
+		return 0, "", err
+	}
+	if err := j.record(srcPath, dstPath, srcInfo.Size(), srcHash, journalCopied); err != nil {
+		return 0, "", err
+	}
+
+	dstHash, err := fsys.HashFile(ctx, tmpPath)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to verify copy: %w", err)
+	}
+
+	if dstHash != srcHash {
+		return 0, "", fmt.Errorf("%w: source %s, destination %s", errChecksumMismatch, srcHash, dstHash)
+	}
+
+	if err := fsys.Chtimes(tmpPath, srcInfo.ModTime(), srcInfo.ModTime()); err != nil {
+		return 0, "", fmt.Errorf("failed to preserve modification time: %w", err)
+	}
+
+	return srcInfo.Size(), srcHash, nil
+}
+
+// removeStaleTempFiles removes temp files that copyAndVerify left in dir or
+// any of its subdirectories because a previous run was interrupted
+// mid-copy. A missing dir is not an error: there is nothing to clean up.
+// At most maxConcurrency entries are processed at once per directory level.
+// Each removal is logged to logger.
 // It returns the number of files removed and any error.
-func removeFiles(fsys FileSystem, entries []os.DirEntry, dir string, maxConcurrency int) (int, error) {
-	return forEachEntryConcurrently(entries, maxConcurrency, func(entry os.DirEntry) (int, error) {
+func removeStaleTempFiles(ctx context.Context, fsys FileSystem, dir string, maxConcurrency int, logger *slog.Logger) (int, error) {
+	entries, err := fsys.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("reading directory: %w", err)
+	}
+
+	return forEachEntryConcurrently(ctx, entries, maxConcurrency, func(entry os.DirEntry) (int, error) {
+		path := filepath.Join(dir, entry.Name())
 		if entry.IsDir() {
+			n, err := removeStaleTempFiles(ctx, fsys, path, maxConcurrency, logger)
+			if err != nil {
+				return 0, fmt.Errorf("failed to process subdirectory %s: %w", entry.Name(), err)
+			}
+			return n, nil
+		}
+		if !isTempFileName(entry.Name()) {
 			return 0, nil
 		}
-
-		path := filepath.Join(dir, entry.Name())
 		if err := fsys.Remove(path); err != nil {
-			return 0, fmt.Errorf("failed to remove file %s: %w", entry.Name(), err)
+			return 0, fmt.Errorf("failed to remove stale temp file %s: %w", entry.Name(), err)
 		}
-		log.Printf("removed %s\n", entry.Name())
+		logger.Info("removed stale temp file", "file", path)
 		return 1, nil
 	})
 }
 
-// deleteZombieEditFiles deletes edit files that have no corresponding raw file.
-// It checks for raw files with extensions in rawFileExtensions.
+// removeFiles removes the source files of removals, moving each one that has
+// a Trash path to the trash instead (see moveToTrash). Callers pass only the
+// removals of source files with a known-good copy at the destination (see
+// removableSources), so nothing is removed unless it is safe. At most
+// maxConcurrency files are removed at once. Each removal is recorded in j, in
+// rec and in report, and logged to logger.
+// It returns the number of files removed and any error.
+func removeFiles(ctx context.Context, fsys FileSystem, j *journal, rec *runRecord, report *Report, removals []Action, maxConcurrency int, logger *slog.Logger) (int, error) {
+	return forEachEntryConcurrently(ctx, removals, maxConcurrency, func(a Action) (int, error) {
+		started := time.Now()
+		a, err := removeSource(ctx, fsys, a, logger)
+		report.record(a, "", time.Since(started), err)
+		if err != nil {
+			return 0, err
+		}
+		if err := j.record(a.Src, "", 0, "", journalSourceRemoved); err != nil {
+			return 0, err
+		}
+		if err := rec.record(a); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	})
+}
+
+// removeSource removes the source file a.Src, or moves it to the trash if a
+// has a Trash path, and returns a with the path it was moved to.
+func removeSource(ctx context.Context, fsys FileSystem, a Action, logger *slog.Logger) (Action, error) {
+	if a.Trash != "" {
+		trashed, err := moveToTrash(ctx, fsys, a.Src, a.Trash, logger)
+		if err != nil {
+			return a, err
+		}
+		a.Trash = trashed
+		logger.Info("moved source file to the trash", "file", a.Src, "trash", trashed)
+		return a, nil
+	}
+	if err := fsys.Remove(a.Src); err != nil {
+		return a, fmt.Errorf("failed to remove file %s: %w", a.Src, err)
+	}
+	logger.Info("removed source file", "file", a.Src)
+	return a, nil
+}
+
+// findZombieEditFiles returns the paths of edit files in dir that have no
+// corresponding raw file: no file with the edit file's name and one of
+// rawFileExtensions next to it, and none in incoming, the set of (cleaned)
+// paths raw files are about to be copied to.
 // If isRecursive is true, it processes subdirectories recursively. At most
 // maxConcurrency entries are processed at once per directory level.
-// It returns the number of files deleted and any error.
-func deleteZombieEditFiles(fsys FileSystem, editFileExtension, dir string, rawFileExtensions []string, isRecursive bool, maxConcurrency int) (int, error) {
+func findZombieEditFiles(ctx context.Context, fsys FileSystem, editFileExtension, dir string, rawFileExtensions []string, incoming map[string]bool, isRecursive bool, maxConcurrency int) ([]string, error) {
 	entries, err := fsys.ReadDir(dir)
 	if err != nil {
-		return 0, fmt.Errorf("reading directory: %w", err)
+		return nil, fmt.Errorf("reading directory: %w", err)
 	}
 
-	return forEachEntryConcurrently(entries, maxConcurrency, func(entry os.DirEntry) (int, error) {
+	var (
+		mu      sync.Mutex
+		zombies []string
+	)
+	_, err = forEachEntryConcurrently(ctx, entries, maxConcurrency, func(entry os.DirEntry) (int, error) {
 		if entry.IsDir() {
-			if !isRecursive {
+			// What's in the trash is dead already.
+			if !isRecursive || entry.Name() == trashDirName {
 				return 0, nil
 			}
-			n, err := deleteZombieEditFiles(fsys, editFileExtension, filepath.Join(dir, entry.Name()), rawFileExtensions, isRecursive, maxConcurrency)
+			found, err := findZombieEditFiles(ctx, fsys, editFileExtension, filepath.Join(dir, entry.Name()), rawFileExtensions, incoming, isRecursive, maxConcurrency)
 			if err != nil {
 				return 0, fmt.Errorf("failed to process subdirectory %s: %w", entry.Name(), err)
 			}
-			return n, nil
+			mu.Lock()
+			zombies = append(zombies, found...)
+			mu.Unlock()
+			return len(found), nil
 		}
 
 		editFileName := entry.Name()
@@ -208,22 +503,49 @@ func deleteZombieEditFiles(fsys FileSystem, editFileExtension, dir string, rawFi
 			return 0, nil
 		}
 
-		editFileNameWithoutExt := strings.TrimSuffix(editFileName, "."+editFileExtension)
-
+		editFilePath := filepath.Join(dir, editFileName)
+		hasRaw, err := hasRawFile(fsys, editFilePath, rawFileExtensions)
+		if err != nil {
+			return 0, err
+		}
+		if hasRaw {
+			return 0, nil
+		}
 		for _, rawFileExt := range rawFileExtensions {
-			expectedRawFileName := editFileNameWithoutExt + "." + rawFileExt
-			if _, err := fsys.Stat(filepath.Join(dir, expectedRawFileName)); err == nil {
+			if incoming[filepath.Clean(rawFilePath(editFilePath, rawFileExt))] {
 				return 0, nil
-			} else if !errors.Is(err, os.ErrNotExist) {
-				return 0, fmt.Errorf("failed to check if %s exists: %w", expectedRawFileName, err)
 			}
 		}
 
-		if err := fsys.Remove(filepath.Join(dir, editFileName)); err != nil {
-			return 0, fmt.Errorf("failed to remove zombie edit file %s: %w", editFileName, err)
-		}
-
-		log.Printf("removed zombie edit file: %s\n", editFileName)
+		mu.Lock()
+		zombies = append(zombies, editFilePath)
+		mu.Unlock()
 		return 1, nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(zombies)
+	return zombies, nil
+}
+
+// rawFilePath returns the path the raw file with extension rawFileExt that
+// the edit file at editFilePath belongs to would have.
+func rawFilePath(editFilePath, rawFileExt string) string {
+	return strings.TrimSuffix(editFilePath, filepath.Ext(editFilePath)) + "." + rawFileExt
+}
+
+// hasRawFile reports whether the edit file at editFilePath has a raw file
+// with one of rawFileExtensions next to it.
+func hasRawFile(fsys FileSystem, editFilePath string, rawFileExtensions []string) (bool, error) {
+	for _, rawFileExt := range rawFileExtensions {
+		expectedRawFilePath := rawFilePath(editFilePath, rawFileExt)
+		if _, err := fsys.Stat(expectedRawFilePath); err == nil {
+			return true, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return false, fmt.Errorf("failed to check if %s exists: %w", filepath.Base(expectedRawFilePath), err)
+		}
+	}
+	return false, nil
 }
@@ -1,28 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"runtime"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestForEachEntryConcurrentlyBoundsConcurrency(t *testing.T) {
+	ctx := t.Context()
 	const maxConcurrency = 3
 	const entryCount = 20
 
 	entries := make([]os.DirEntry, entryCount)
 	for i := range entries {
-		entries[i] = fakeDirEntry{name: fmt.Sprintf("file%d", i)}
+		entries[i] = fakeDirEntry{info: fakeFileInfo{name: fmt.Sprintf("file%d", i)}}
 	}
 
 	var current atomic.Int32
 	var maxObserved atomic.Int32
 
-	_, err := forEachEntryConcurrently(entries, maxConcurrency, func(entry os.DirEntry) (int, error) {
+	_, err := forEachEntryConcurrently(ctx, entries, maxConcurrency, func(entry os.DirEntry) (int, error) {
 		n := current.Add(1)
 		defer current.Add(-1)
 
@@ -43,3 +50,121 @@ func TestForEachEntryConcurrentlyBoundsConcurrency(t *testing.T) {
 	assert.LessOrEqual(t, int(maxObserved.Load()), maxConcurrency, "concurrency exceeded the configured limit")
 	assert.Equal(t, int32(maxConcurrency), maxObserved.Load(), "expected concurrency to actually reach the configured limit, not stay needlessly under it")
 }
+
+func TestForEachEntryConcurrentlyStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	entries := make([]int, 20)
+
+	var calls atomic.Int32
+	count, err := forEachEntryConcurrently(ctx, entries, 1, func(int) (int, error) {
+		if calls.Add(1) == 3 {
+			cancel()
+		}
+		return 1, nil
+	})
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, int32(3), calls.Load(), "nothing is started once cancelled")
+	assert.Equal(t, 3, count, "what was started is finished and counted")
+}
+
+func TestCopyAndVerifyCancelledLeavesNoPartialFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.arw")
+	dst := filepath.Join(dir, "dst.arw")
+	require.NoError(t, os.WriteFile(src, []byte("raw image data"), 0644))
+
+	_, err := copyAndVerify(ctx, osFileSystem{}, nil, src, dst, nil, slog.Default())
+	assert.ErrorIs(t, err, context.Canceled)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "neither the copy nor its temp file is left behind")
+	assert.Equal(t, "src.arw", entries[0].Name())
+}
+
+func TestOSFileSystemCopyFileReturnsVerifiableHash(t *testing.T) {
+	ctx := t.Context()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.arw")
+	dst := filepath.Join(dir, "dst.arw")
+	require.NoError(t, os.WriteFile(src, []byte("raw image data"), 0644))
+
+	fsys := osFileSystem{}
+	srcHash, err := fsys.CopyFile(ctx, src, dst, nil)
+	require.NoError(t, err)
+
+	dstHash, err := fsys.HashFile(ctx, dst)
+	require.NoError(t, err)
+	assert.Equal(t, srcHash, dstHash)
+	assert.Equal(t, fakeHash([]byte("raw image data")), srcHash)
+}
+
+func TestCopyAndVerifyRenamesTempFileIntoPlace(t *testing.T) {
+	ctx := t.Context()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.arw")
+	dst := filepath.Join(dir, "dst.arw")
+	require.NoError(t, os.WriteFile(src, []byte("raw image data"), 0644))
+
+	_, err := copyAndVerify(ctx, osFileSystem{}, nil, src, dst, nil, slog.Default())
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	assert.Equal(t, "raw image data", string(content))
+
+	_, err = os.Stat(tempPathFor(dst))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestCopyAndVerifyPreservesModTimeAndMode(t *testing.T) {
+	ctx := t.Context()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.arw")
+	dst := filepath.Join(dir, "dst.arw")
+	require.NoError(t, os.WriteFile(src, []byte("raw image data"), 0600))
+	shotAt := time.Date(2024, 5, 17, 9, 30, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(src, shotAt, shotAt))
+
+	_, err := copyAndVerify(ctx, osFileSystem{}, nil, src, dst, nil, slog.Default())
+	require.NoError(t, err)
+
+	info, err := os.Stat(dst)
+	require.NoError(t, err)
+	assert.True(t, shotAt.Equal(info.ModTime()), "expected copy to carry the source mtime %s, got %s", shotAt, info.ModTime())
+	if runtime.GOOS != "windows" {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+}
+
+func TestOSDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "sub")
+	require.NoError(t, os.Mkdir(sub, 0755))
+
+	space, err := osFileSystem{}.DiskSpace(dir)
+	require.NoError(t, err)
+	assert.NotZero(t, space.Available)
+	subSpace, err := osFileSystem{}.DiskSpace(sub)
+	require.NoError(t, err)
+	assert.Equal(t, space.Device, subSpace.Device, "a directory is on the same disk as its parent")
+
+	_, err = osFileSystem{}.DiskSpace(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestOSFileSystemCopyFileReportsReads(t *testing.T) {
+	ctx := t.Context()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.arw")
+	data := bytes.Repeat([]byte("raw image data"), 10000)
+	require.NoError(t, os.WriteFile(src, data, 0644))
+
+	var read int64
+	_, err := osFileSystem{}.CopyFile(ctx, src, filepath.Join(dir, "dst.arw"), func(n int64) { read += n })
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), read)
+}
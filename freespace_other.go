@@ -0,0 +1,8 @@
+//go:build !unix && !windows
+
+package main
+
+// diskSpaceOf can't tell the free space on this platform.
+func diskSpaceOf(string) (diskSpace, error) {
+	return diskSpace{}, errDiskSpaceUnknown
+}
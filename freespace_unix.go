@@ -0,0 +1,23 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// diskSpaceOf returns the space available to an unprivileged user on the
+// filesystem holding path, which is told apart from others by its device
+// number.
+func diskSpaceOf(path string) (diskSpace, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return diskSpace{}, err
+	}
+	var info syscall.Stat_t
+	if err := syscall.Stat(path, &info); err != nil {
+		return diskSpace{}, err
+	}
+	return diskSpace{Device: fmt.Sprint(info.Dev), Available: uint64(st.Bavail) * uint64(st.Bsize)}, nil
+}
@@ -0,0 +1,32 @@
+//go:build windows
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceExW = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// diskSpaceOf returns the space available to the current user on the volume
+// holding path, which is told apart from others by its drive letter or UNC
+// share.
+func diskSpaceOf(path string) (diskSpace, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return diskSpace{}, err
+	}
+	p, err := syscall.UTF16PtrFromString(abs)
+	if err != nil {
+		return diskSpace{}, err
+	}
+	var available uint64
+	ok, _, err := procGetDiskFreeSpaceExW.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&available)), 0, 0)
+	if ok == 0 {
+		return diskSpace{}, err
+	}
+	return diskSpace{Device: strings.ToUpper(filepath.VolumeName(abs)), Available: available}, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexFileName is the content-hash index kept in each destination directory
+// (see libraryIndex).
+const indexFileName = ".clean-sd-card-index.json"
+
+// ownFilePrefix starts the names of the files and directories clean-sd-card
+// keeps in a destination directory: the journal, the index, the run records
+// and the trash.
+const ownFilePrefix = ".clean-sd-card"
+
+// indexEntry is what the index knows of one file in the library.
+type indexEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// SHA256 is the file's hash, once it has been needed.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// libraryIndex is an index of the files in a destination directory by
+// content, for finding a file already in the library under another name. It
+// is kept in the directory (see indexFileName) between runs. Files are only
+// hashed when a file of the same size is looked up, since that's the only
+// time their hash can matter, and a hash is reused for as long as the file
+// keeps its size and modification time.
+type libraryIndex struct {
+	root string
+
+	mu     sync.Mutex
+	files  map[string]indexEntry // by path relative to root
+	bySize map[int64][]string
+	// dirty is set once files differs from what is saved.
+	dirty bool
+	// staleTemps are the temp files interrupted copies left in root, found
+	// on the walk (see removeStaleTemps).
+	staleTemps []string
+}
+
+// loadLibraryIndex lists the files in root and its subdirectories, reusing
+// the hashes of those unchanged since the index saved there was, if any. A
+// missing root is an empty library.
+func loadLibraryIndex(fsys FileSystem, root string, logger *slog.Logger) (*libraryIndex, error) {
+	ix := &libraryIndex{root: root, files: make(map[string]indexEntry), bySize: make(map[int64][]string)}
+	saved := readIndexFile(fsys, filepath.Join(root, indexFileName), logger)
+
+	if err := ix.walk(fsys, root, saved); err != nil {
+		return nil, fmt.Errorf("failed to index %s: %w", root, err)
+	}
+	if len(saved) != len(ix.files) {
+		ix.dirty = true
+	}
+	for size := range ix.bySize {
+		sort.Strings(ix.bySize[size])
+	}
+	return ix, nil
+}
+
+// readIndexFile reads the index saved at path. A missing or unreadable index
+// is an empty one: it is only a cache. An unreadable one is logged to logger.
+func readIndexFile(fsys FileSystem, path string, logger *slog.Logger) map[string]indexEntry {
+	files := make(map[string]indexEntry)
+	f, err := fsys.Open(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("ignoring unreadable index", "file", path, errAttr(err))
+		}
+		return files
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&files); err != nil {
+		logger.Warn("ignoring unreadable index", "file", path, errAttr(err))
+		return make(map[string]indexEntry)
+	}
+	return files
+}
+
+// walk adds the files in dir and its subdirectories to ix, except for
+// clean-sd-card's own files and temp files, which it notes in ix.staleTemps.
+func (ix *libraryIndex) walk(fsys FileSystem, dir string, saved map[string]indexEntry) error {
+	entries, err := fsys.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ownFilePrefix) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if isTempFileName(entry.Name()) {
+			if !entry.IsDir() {
+				ix.staleTemps = append(ix.staleTemps, path)
+			}
+			continue
+		}
+		if entry.IsDir() {
+			if err := ix.walk(fsys, path, saved); err != nil {
+				return err
+			}
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(ix.root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		e := indexEntry{Size: info.Size(), ModTime: info.ModTime()}
+		if prev, ok := saved[rel]; ok && prev.Size == e.Size && prev.ModTime.Equal(e.ModTime) {
+			e.SHA256 = prev.SHA256
+		} else {
+			ix.dirty = true
+		}
+		ix.files[rel] = e
+		ix.bySize[e.Size] = append(ix.bySize[e.Size], rel)
+	}
+	return nil
+}
+
+// find returns the path of a file in the library with the given size and
+// hash, if there is one, hashing the files of that size not hashed yet. A nil
+// index finds nothing.
+func (ix *libraryIndex) find(ctx context.Context, fsys FileSystem, size int64, hash string) (string, bool, error) {
+	if ix == nil {
+		return "", false, nil
+	}
+
+	ix.mu.Lock()
+	candidates := slices.Clone(ix.bySize[size])
+	ix.mu.Unlock()
+	for _, rel := range candidates {
+		ix.mu.Lock()
+		e := ix.files[rel]
+		ix.mu.Unlock()
+		path := filepath.Join(ix.root, filepath.FromSlash(rel))
+		if e.SHA256 == "" {
+			h, err := fsys.HashFile(ctx, path)
+			if err != nil {
+				return "", false, fmt.Errorf("failed to hash %s: %w", path, err)
+			}
+			e.SHA256 = h
+			ix.mu.Lock()
+			ix.files[rel] = e
+			ix.dirty = true
+			ix.mu.Unlock()
+		}
+		if e.SHA256 == hash {
+			return path, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// removeStaleTemps removes the temp files interrupted copies left in the
+// library, as found when ix was loaded, so that the library needn't be walked
+// again to clean them up (see removeStaleTempFiles). A temp file gone since is
+// no error. Each removal is logged to logger.
+// It returns the number of files removed and any error.
+func (ix *libraryIndex) removeStaleTemps(fsys FileSystem, logger *slog.Logger) (int, error) {
+	removed := 0
+	for _, path := range ix.staleTemps {
+		if err := fsys.Remove(path); errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return removed, fmt.Errorf("failed to remove stale temp file %s: %w", filepath.Base(path), err)
+		}
+		logger.Info("removed stale temp file", "file", path)
+		removed++
+	}
+	ix.staleTemps = nil
+	return removed, nil
+}
+
+// hasSize reports whether the library has a file of size, i.e. whether a
+// file of that size can be in it under another name.
+func (ix *libraryIndex) hasSize(size int64) bool {
+	if ix == nil {
+		return false
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return len(ix.bySize[size]) > 0
+}
+
+// save writes the index to its directory if it has changed, replacing the
+// saved one only once it is completely written. An index of a directory that
+// doesn't exist isn't saved.
+func (ix *libraryIndex) save(fsys FileSystem) error {
+	if ix == nil {
+		return nil
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if !ix.dirty {
+		return nil
+	}
+	if _, err := fsys.Stat(ix.root); err != nil {
+		return nil
+	}
+
+	data, err := json.Marshal(ix.files)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(ix.root, indexFileName)
+	tmpPath := tempPathFor(path)
+	if err := fsys.Remove(tmpPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to save index: %w", err)
+	}
+	w, err := fsys.AppendFile(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to save index: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to save index: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to save index: %w", err)
+	}
+	if err := fsys.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to save index: %w", err)
+	}
+	ix.dirty = false
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanSDCardSkipsDuplicatesInLibrary(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	fsys.addFile(filepath.Join("src", "DSC00001.ARW"), "shot")
+	fsys.addFile(filepath.Join("src", "DSC00002.ARW"), "other")
+	fsys.addFile(filepath.Join("dst", "2024", "renamed.arw"), "shot")
+	fsys.addFile(filepath.Join("dst", "2024", "same-size.arw"), "shop")
+
+	report, err := cleanSDCard(
+		ctx,
+		fsys,
+		[]string{"xmp"},
+		testProfile,
+		"src",
+		"dst",
+		"dst-jpg",
+		"dst-video",
+		Options{Concurrency: testConcurrency},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Copied, "only the file not in the library yet")
+	assert.Equal(t, 2, report.Removed, "the duplicate is safely in the library")
+
+	_, ok := fsys.readFile(filepath.Join("dst", "DSC00001.ARW"))
+	assert.False(t, ok, "a duplicate must not be copied again")
+	content, ok := fsys.readFile(filepath.Join("dst", "DSC00002.ARW"))
+	require.True(t, ok)
+	assert.Equal(t, "other", content)
+
+	_, ok = fsys.readFile(filepath.Join("dst", indexFileName))
+	assert.True(t, ok, "the index is saved in the library")
+}
+
+func TestPlanCopiesFlagsNameCollisions(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	fsys.addFile(filepath.Join("src", "a.arw"), "card a")
+	fsys.addFile(filepath.Join("src", "b.arw"), "card b")
+	fsys.addFile(filepath.Join("dst", "a.arw"), "library a")
+	fsys.addFile(filepath.Join("dst", "b.arw"), "library b")
+	fsys.addFile(filepath.Join("dst", "old", "b-copy.arw"), "card b")
+
+	index, err := loadLibraryIndex(fsys, "dst", slog.Default())
+	require.NoError(t, err)
+	dirs, err := discoverSourceDirs(fsys, "src", nil)
+	require.NoError(t, err)
+	require.Len(t, dirs, 1)
+
+	actions, err := planCopies(ctx, fsys, nil, index, dirs[0], "dst", nil, []string{"arw"}, Options{Concurrency: testConcurrency})
+	require.NoError(t, err)
+	assert.Equal(t, []Action{
+		{Kind: actionSkip, Src: filepath.Join("src", "a.arw"), Dst: filepath.Join("dst", "a.arw"), Size: int64(len("card a")), Reason: reasonDifferent},
+		{Kind: actionSkip, Src: filepath.Join("src", "b.arw"), Dst: filepath.Join("dst", "old", "b-copy.arw"), Size: int64(len("card b")), Reason: reasonDuplicate},
+	}, actions)
+}
+
+func TestLibraryIndexReusesSavedHashes(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeFileSystem()
+	fake.addFile(filepath.Join("dst", "a.arw"), "aaaa")
+	fake.addFile(filepath.Join("dst", "sub", "b.arw"), "bbbb")
+	fake.addFile(filepath.Join("dst", "c.arw"), "c")
+	fsys := newHashCountingFileSystem(fake)
+
+	index, err := loadLibraryIndex(fsys, "dst", slog.Default())
+	require.NoError(t, err)
+	path, found, err := index.find(ctx, fsys, 4, fakeHash([]byte("bbbb")))
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, filepath.Join("dst", "sub", "b.arw"), path)
+	assert.Equal(t, 0, fsys.callsFor(filepath.Join("dst", "c.arw")), "files of other sizes aren't hashed")
+	require.NoError(t, index.save(fsys))
+
+	// a changed file is hashed again, an unchanged one isn't
+	fake.addFile(filepath.Join("dst", "a.arw"), "AAAA")
+	index, err = loadLibraryIndex(fsys, "dst", slog.Default())
+	require.NoError(t, err)
+	_, found, err = index.find(ctx, fsys, 4, fakeHash([]byte("cccc")))
+	require.NoError(t, err)
+	assert.False(t, found)
+	assert.Equal(t, 2, fsys.callsFor(filepath.Join("dst", "a.arw")))
+	assert.Equal(t, 1, fsys.callsFor(filepath.Join("dst", "sub", "b.arw")))
+}
+
+func TestLoadLibraryIndexIgnoresCorruptIndex(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	fsys.addFile(filepath.Join("dst", "a.arw"), "a")
+	fsys.addFile(filepath.Join("dst", indexFileName), "{not json")
+
+	index, err := loadLibraryIndex(fsys, "dst", slog.Default())
+	require.NoError(t, err)
+	path, found, err := index.find(ctx, fsys, 1, fakeHash([]byte("a")))
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, filepath.Join("dst", "a.arw"), path)
+}
+
+func TestCleanSDCardReadsLibraryAndCardOnce(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeFileSystemWith(map[string]string{
+		"src/a.arw":     "card a",
+		"dst/a.arw":     "lib a",
+		"dst/old/b.arw": "card b", // same size as src/a.arw, so it is hashed
+	})
+	fake.addFile(tempPathFor(filepath.Join("dst", "old", "c.arw")), "left by a killed run")
+	hashes := newHashCountingFileSystem(fake)
+	fsys := newReadDirCountingFileSystem(hashes)
+
+	_, err := cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "src", "dst", "dst-jpg", "dst-video",
+		Options{KeepSrc: true, Concurrency: testConcurrency})
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, fsys.callsFor(filepath.Join("dst", "old")), "the library is walked once")
+	_, ok := fake.readFile(tempPathFor(filepath.Join("dst", "old", "c.arw")))
+	assert.False(t, ok, "stale temp files found on the walk are removed")
+	assert.Equal(t, 1, hashes.callsFor(filepath.Join("src", "a.arw")), "the card file is compared with its destination and the library, but read once")
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journalFileName is the journal cleanSDCard keeps in the RAW destination
+// directory.
+const journalFileName = ".clean-sd-card-journal.jsonl"
+
+// journalState is how far a source file has got through an import.
+type journalState string
+
+const (
+	// journalPlanned means the file is to be copied to its destination.
+	journalPlanned journalState = "planned"
+	// journalCopied means the file was copied to a temp file next to its
+	// destination and the bytes read hashed, but the copy is not yet
+	// verified or in place (see copyAndVerify).
+	journalCopied journalState = "copied"
+	// journalVerified means a copy with the source's content is in place at
+	// the destination.
+	journalVerified journalState = "verified"
+	// journalSourceRemoved means the file was removed from the source after
+	// being verified.
+	journalSourceRemoved journalState = "source-removed"
+)
+
+// complete reports whether a file in this state needs nothing more copied.
+func (s journalState) complete() bool {
+	return s == journalVerified || s == journalSourceRemoved
+}
+
+// journalEntry is one line of the journal: a source file reaching a state.
+// Fields not known yet at that state are left empty.
+type journalEntry struct {
+	Time   time.Time    `json:"time"`
+	Src    string       `json:"src"`
+	Dst    string       `json:"dst,omitempty"`
+	Size   int64        `json:"size,omitempty"`
+	SHA256 string       `json:"sha256,omitempty"`
+	State  journalState `json:"state"`
+}
+
+// journal is an append-only, JSON-lines record of an import's progress,
+// written as it goes so that an interrupted run can be picked up where it
+// stopped (see loadJournal). A nil *journal records nothing, so that callers
+// that don't need one can pass nil.
+type journal struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// openJournal opens the journal in dir. If resume is true, the journal a
+// previous run left there is appended to; otherwise it is replaced by a new
+// one.
+func openJournal(fsys FileSystem, dir string, resume bool) (*journal, error) {
+	path := filepath.Join(dir, journalFileName)
+	j := &journal{}
+
+	if resume {
+		// The lines it skips were logged when the journal was loaded for
+		// planning.
+		_, tornLine, err := readJournalFile(fsys, path, slog.New(slog.DiscardHandler))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read journal: %w", err)
+		}
+		w, err := fsys.AppendFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open journal: %w", err)
+		}
+		j.w = w
+		if tornLine {
+			// Terminate the partial line a killed run left, so the next
+			// entry starts on a line of its own.
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				w.Close()
+				return nil, fmt.Errorf("failed to write journal: %w", err)
+			}
+		}
+		return j, nil
+	}
+
+	if err := fsys.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove previous journal: %w", err)
+	}
+	w, err := fsys.AppendFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	j.w = w
+	return j, nil
+}
+
+// journalHistory is the last known state of each source file, by source
+// path, from the journal of a run being resumed.
+type journalHistory map[string]journalEntry
+
+// loadJournal reads back the journal a previous run left in dir, logging the
+// lines it skips to logger. A missing journal is not an error: the history is
+// empty.
+func loadJournal(fsys FileSystem, dir string, logger *slog.Logger) (journalHistory, error) {
+	history, _, err := readJournalFile(fsys, filepath.Join(dir, journalFileName), logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+	return history, nil
+}
+
+// readJournalFile reads the journal at path, merging the entries of each
+// source file so that fields recorded at earlier states (the hash, say) are
+// kept. A missing journal is not an error. It also reports whether the
+// journal ends in a partial line, as a run killed mid-write leaves; such a
+// line is skipped, as are unreadable ones, and logged to logger.
+func readJournalFile(fsys FileSystem, path string, logger *slog.Logger) (journalHistory, bool, error) {
+	history := make(journalHistory)
+	f, err := fsys.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return history, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for lineNo := 1; ; lineNo++ {
+		line, err := r.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			if strings.TrimSpace(line) != "" {
+				logger.Warn("skipping partial journal line", "file", path, "line", lineNo)
+				return history, true, nil
+			}
+			return history, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		var e journalEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			logger.Warn("skipping unreadable journal line", "file", path, "line", lineNo, errAttr(err))
+			continue
+		}
+		prev := history[e.Src]
+		if e.Dst == "" {
+			e.Dst = prev.Dst
+		}
+		if e.Size == 0 {
+			e.Size = prev.Size
+		}
+		if e.SHA256 == "" {
+			e.SHA256 = prev.SHA256
+		}
+		history[e.Src] = e
+	}
+}
+
+// record appends an entry for src reaching state.
+func (j *journal) record(src, dst string, size int64, hash string, state journalState) error {
+	if j == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(journalEntry{Time: time.Now(), Src: src, Dst: dst, Size: size, SHA256: hash, State: state})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.w.Write(line); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	// A state the disk doesn't have yet is of no use to the next run if
+	// this one dies.
+	if s, ok := j.w.(interface{ Sync() error }); ok {
+		if err := s.Sync(); err != nil {
+			return fmt.Errorf("failed to write journal: %w", err)
+		}
+	}
+	return nil
+}
+
+// completed reports whether the resumed run has src already copied to
+// dstPath, and the file there still has the size it was copied with.
+func (h journalHistory) completed(fsys FileSystem, src, dstPath string) bool {
+	e, ok := h[src]
+	if !ok || !e.State.complete() || e.Dst != dstPath {
+		return false
+	}
+	info, err := fsys.Stat(dstPath)
+	return err == nil && info.Size() == e.Size
+}
+
+// restoreDestinations sets the destination of each source file the resumed
+// run planned to copy into dstDir with one of exts in dstRelPaths (see
+// planDestinations), so that a resumed run copies files where the
+// interrupted one meant to.
+func (h journalHistory) restoreDestinations(dstRelPaths map[string]string, dstDir string, exts []string) {
+	for src, e := range h {
+		if e.Dst == "" || !matchesAnyExtension(src, exts) {
+			continue
+		}
+		rel, err := filepath.Rel(dstDir, e.Dst)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		dstRelPaths[src] = rel
+	}
+}
+
+// Close closes the journal file.
+func (j *journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.w.Close()
+}
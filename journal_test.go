@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyFileSystem wraps a fakeFileSystem, failing CopyFile and Remove for
+// the source base names in failCopy and failRemove -- simulating a card
+// reader glitch midway through a run -- and HashFile too for those in
+// failRead, and counting CopyFile calls per source base name.
+type flakyFileSystem struct {
+	*fakeFileSystem
+	failCopy, failRemove, failRead map[string]bool
+
+	mu     sync.Mutex
+	copies map[string]int
+}
+
+var errFlaky = errors.New("card reader glitch")
+
+func (f *flakyFileSystem) CopyFile(ctx context.Context, src, dst string, onRead func(n int64)) (string, error) {
+	f.mu.Lock()
+	if f.copies == nil {
+		f.copies = make(map[string]int)
+	}
+	f.copies[filepath.Base(src)]++
+	f.mu.Unlock()
+
+	if f.failCopy[filepath.Base(src)] {
+		return "", errFlaky
+	}
+	return f.fakeFileSystem.CopyFile(ctx, src, dst, onRead)
+}
+
+func (f *flakyFileSystem) HashFile(ctx context.Context, path string) (string, error) {
+	if f.failRead[filepath.Base(path)] {
+		return "", errFlaky
+	}
+	return f.fakeFileSystem.HashFile(ctx, path)
+}
+
+func (f *flakyFileSystem) Remove(path string) error {
+	if f.failRemove[filepath.Base(path)] {
+		return errFlaky
+	}
+	return f.fakeFileSystem.Remove(path)
+}
+
+func (f *flakyFileSystem) copiesOf(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.copies[name]
+}
+
+// readJournal returns the entries of the journal in dir.
+func readJournal(t *testing.T, fsys *fakeFileSystem, dir string) []journalEntry {
+	t.Helper()
+	content, ok := fsys.readFile(filepath.Join(dir, journalFileName))
+	require.True(t, ok, "journal should exist")
+
+	var entries []journalEntry
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		var e journalEntry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestCleanSDCardJournal(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	src := filepath.Join("src", "DSC00001.ARW")
+	fsys.addFile(src, "raw")
+
+	_, err := cleanSDCard(
+		ctx,
+		fsys,
+		[]string{"xmp"},
+		testProfile,
+		"src",
+		"dst",
+		"dst-jpg",
+		"dst-video",
+		Options{KeepSrc: false, Concurrency: testConcurrency},
+	)
+	require.NoError(t, err)
+
+	entries := readJournal(t, fsys, "dst")
+	states := make([]journalState, len(entries))
+	for i, e := range entries {
+		assert.Equal(t, src, e.Src)
+		states[i] = e.State
+	}
+	assert.Equal(t, []journalState{journalPlanned, journalCopied, journalVerified, journalSourceRemoved}, states)
+	assert.Equal(t, filepath.Join("dst", "DSC00001.ARW"), entries[0].Dst)
+	assert.Equal(t, int64(len("raw")), entries[0].Size)
+	assert.Equal(t, fakeHash([]byte("raw")), entries[2].SHA256)
+
+	t.Run("a new run starts a new journal", func(t *testing.T) {
+		fsys.addFile(filepath.Join("src", "DSC00002.ARW"), "raw")
+		_, err := cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "src", "dst", "dst-jpg", "dst-video", Options{KeepSrc: true, Concurrency: testConcurrency})
+		require.NoError(t, err)
+		for _, e := range readJournal(t, fsys, "dst") {
+			assert.Equal(t, filepath.Join("src", "DSC00002.ARW"), e.Src)
+		}
+	})
+}
+
+func TestCleanSDCardResume(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeFileSystem()
+	shotAt := time.Date(2024, 5, 17, 9, 30, 0, 0, time.Local)
+	for _, name := range []string{"DSC00001.ARW", "DSC00002.ARW", "DSC00003.ARW", "DSC00004.ARW"} {
+		fake.addFileWithModTime(filepath.Join("src", name), name, shotAt)
+	}
+	fsys := &flakyFileSystem{
+		fakeFileSystem: fake,
+		failCopy:       map[string]bool{"DSC00004.ARW": true},
+		failRemove:     map[string]bool{},
+	}
+	opts := Options{KeepSrc: false, Layout: "{seq:04}{ext}", Concurrency: testConcurrency}
+	run := func(opts Options) (*Report, error) {
+		return cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "src", "dst", "dst-jpg", "dst-video", opts)
+	}
+
+	// The first run copies three files and then fails on the fourth, before
+	// removing anything.
+	_, err := run(opts)
+	require.ErrorIs(t, err, errFlaky)
+
+	// The second run gets through the copies but fails to remove one file,
+	// after removing the others.
+	delete(fsys.failCopy, "DSC00004.ARW")
+	fsys.failRemove["DSC00002.ARW"] = true
+	opts.Resume = true
+	report, err := run(opts)
+	require.ErrorIs(t, err, errFlaky)
+	assert.Equal(t, 1, report.Copied, "only the file the first run failed on should be copied")
+	assert.Equal(t, 3, report.Removed)
+	for _, name := range []string{"DSC00001.ARW", "DSC00002.ARW", "DSC00003.ARW"} {
+		assert.Equal(t, 1, fsys.copiesOf(name), "%s should not be copied again", name)
+	}
+
+	// The third run only has the removal left to do. The layout alone would
+	// now number the one file left on the card 0001, but it was copied as
+	// 0002 and must be recognized as such.
+	delete(fsys.failRemove, "DSC00002.ARW")
+	report, err = run(opts)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Copied)
+	assert.Equal(t, 1, report.Removed)
+	assert.Equal(t, 1, fsys.copiesOf("DSC00002.ARW"))
+
+	for i, name := range []string{"DSC00001.ARW", "DSC00002.ARW", "DSC00003.ARW", "DSC00004.ARW"} {
+		content, ok := fake.readFile(filepath.Join("dst", []string{"0001", "0002", "0003", "0004"}[i]+".ARW"))
+		assert.True(t, ok)
+		assert.Equal(t, name, content)
+		_, ok = fake.readFile(filepath.Join("src", name))
+		assert.False(t, ok, "%s should be removed from the source", name)
+	}
+}
+
+func TestJournalResumesTornJournal(t *testing.T) {
+	fsys := newFakeFileSystem()
+	verified, err := json.Marshal(journalEntry{Src: "src/a.arw", Dst: "dst/a.arw", Size: 3, SHA256: "abc", State: journalVerified})
+	require.NoError(t, err)
+	fsys.addFile(filepath.Join("dst", journalFileName), string(verified)+"\n"+`{"src":"src/b.arw","sta`)
+
+	history, err := loadJournal(fsys, "dst", slog.Default())
+	require.NoError(t, err)
+	require.Contains(t, history, "src/a.arw")
+	assert.NotContains(t, history, "src/b.arw")
+	assert.Equal(t, journalVerified, history["src/a.arw"].State)
+
+	j, err := openJournal(fsys, "dst", true)
+	require.NoError(t, err)
+	require.NoError(t, j.record("src/a.arw", "", 0, "", journalSourceRemoved))
+	require.NoError(t, j.Close())
+
+	content, _ := fsys.readFile(filepath.Join("dst", journalFileName))
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	require.Len(t, lines, 3)
+	var e journalEntry
+	require.NoError(t, json.Unmarshal([]byte(lines[2]), &e), "the new entry should be on a line of its own")
+	assert.Equal(t, journalSourceRemoved, e.State)
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// layoutPresets are named -layout templates.
+var layoutPresets = map[string]string{
+	// flat copies every file directly into the destination directory.
+	layoutFlat: "{name}{ext}",
+	// date copies every file into a YYYY/YYYY-MM-DD subfolder of the
+	// destination directory, by the date the shot was taken.
+	layoutDate: "{year}/{date}/{name}{ext}",
+}
+
+const (
+	layoutFlat = "flat"
+	layoutDate = "date"
+)
+
+// layoutTokens lists the tokens a -layout template may use, and whether
+// rendering them needs the shot's EXIF metadata.
+var layoutTokens = map[string]bool{
+	"year":   true,  // capture year, YYYY
+	"month":  true,  // capture month, MM
+	"day":    true,  // capture day, DD
+	"date":   true,  // capture date, YYYY-MM-DD
+	"time":   true,  // capture time, HHMMSS
+	"make":   true,  // camera make
+	"camera": true,  // camera model
+	"seq":    true,  // per-capture-day sequence number; {seq:04} zero-pads to 4 digits
+	"name":   false, // original file name without extension
+	"ext":    false, // original extension, including the dot
+	"folder": false, // original source (DCIM) folder name
+	"label":  false, // card label (-card-label)
+	"event":  false, // event name (-event)
+}
+
+// layoutTemplate is a parsed -layout template.
+type layoutTemplate struct {
+	segments []layoutSegment
+}
+
+// layoutSegment is either a literal (token == "") or a token with an
+// optional zero-padding width.
+type layoutSegment struct {
+	literal string
+	token   string
+	width   int
+}
+
+// layoutValues are the values a layoutTemplate renders a shot with.
+type layoutValues struct {
+	shotMetadata
+	Name, Folder, Label, Event string
+	Seq                        int
+}
+
+// parseLayout parses a -layout template, or the name of one of
+// layoutPresets. Templates use "/" as the path separator regardless of OS.
+// {ext} may only appear at the very end, and is appended if the template
+// doesn't end with it, so that the members of a shot (a RAW, its JPG, ...)
+// always resolve to the same path but for their extension.
+func parseLayout(s string) (*layoutTemplate, error) {
+	if s == "" {
+		s = layoutFlat
+	}
+	if preset, ok := layoutPresets[s]; ok {
+		s = preset
+	}
+
+	var l layoutTemplate
+	rest := s
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			l.segments = append(l.segments, layoutSegment{literal: rest})
+			break
+		}
+		if open > 0 {
+			l.segments = append(l.segments, layoutSegment{literal: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("layout %q: unterminated token", s)
+		}
+		seg, err := parseLayoutToken(rest[open+1 : open+end])
+		if err != nil {
+			return nil, fmt.Errorf("layout %q: %w", s, err)
+		}
+		l.segments = append(l.segments, seg)
+		rest = rest[open+end+1:]
+	}
+
+	for i, seg := range l.segments {
+		if seg.token == "ext" && i != len(l.segments)-1 {
+			return nil, fmt.Errorf("layout %q: {ext} may only appear at the end", s)
+		}
+	}
+	if n := len(l.segments); n == 0 || l.segments[n-1].token != "ext" {
+		l.segments = append(l.segments, layoutSegment{token: "ext"})
+	}
+
+	return &l, nil
+}
+
+func parseLayoutToken(s string) (layoutSegment, error) {
+	name, widthStr, hasWidth := strings.Cut(s, ":")
+	if _, ok := layoutTokens[name]; !ok {
+		return layoutSegment{}, fmt.Errorf("unknown token {%s}", s)
+	}
+	seg := layoutSegment{token: name}
+	if hasWidth {
+		if name != "seq" {
+			return layoutSegment{}, fmt.Errorf("token {%s} doesn't take a width", name)
+		}
+		width, err := strconv.Atoi(widthStr)
+		if err != nil || width <= 0 {
+			return layoutSegment{}, fmt.Errorf("invalid width in {%s}", s)
+		}
+		seg.width = width
+	}
+	return seg, nil
+}
+
+// needsMetadata reports whether rendering l needs the shot's EXIF metadata,
+// which means reading from every shot on the card.
+func (l *layoutTemplate) needsMetadata() bool {
+	for _, seg := range l.segments {
+		if layoutTokens[seg.token] {
+			return true
+		}
+	}
+	return false
+}
+
+// render returns the path, relative to the destination directory, that a
+// file in the shot described by v is copied to, given the part of its name
+// following the shot's base name (usually just its extension).
+func (l *layoutTemplate) render(v layoutValues, ext string) string {
+	var b strings.Builder
+	for _, seg := range l.segments {
+		if seg.token == "" {
+			b.WriteString(seg.literal)
+			continue
+		}
+		if seg.token == "ext" {
+			b.WriteString(ext)
+			continue
+		}
+		b.WriteString(sanitizePathElement(layoutTokenValue(seg, v)))
+	}
+	return filepath.FromSlash(b.String())
+}
+
+func layoutTokenValue(seg layoutSegment, v layoutValues) string {
+	t := v.CaptureTime
+	switch seg.token {
+	case "year":
+		return t.Format("2006")
+	case "month":
+		return t.Format("01")
+	case "day":
+		return t.Format("02")
+	case "date":
+		return t.Format("2006-01-02")
+	case "time":
+		return t.Format("150405")
+	case "make":
+		return orUnknown(v.Make)
+	case "camera":
+		return orUnknown(v.Model)
+	case "seq":
+		return fmt.Sprintf("%0*d", seg.width, v.Seq)
+	case "name":
+		return v.Name
+	case "folder":
+		return orUnknown(v.Folder)
+	case "label":
+		return orUnknown(v.Label)
+	case "event":
+		return orUnknown(v.Event)
+	default:
+		return ""
+	}
+}
+
+// seqPattern returns where the first path element l numbers with {seq} goes
+// for the shot described by v: the directory holding it, relative to the
+// destination directory, and a pattern matching the names that element takes
+// for any shot of the same capture day, capturing the sequence number. It
+// returns false if l has no {seq}.
+func (l *layoutTemplate) seqPattern(v layoutValues) (string, string, bool) {
+	i := slices.IndexFunc(l.segments, func(seg layoutSegment) bool { return seg.token == "seq" })
+	if i < 0 {
+		return "", "", false
+	}
+
+	var dir, value, pattern strings.Builder
+	for _, seg := range l.segments[:i] {
+		if j := strings.LastIndexByte(seg.literal, '/'); j >= 0 {
+			dir.WriteString(value.String())
+			dir.WriteString(seg.literal[:j+1])
+			value.Reset()
+			pattern.Reset()
+			value.WriteString(seg.literal[j+1:])
+			pattern.WriteString(regexp.QuoteMeta(seg.literal[j+1:]))
+			continue
+		}
+		if seg.token == "" {
+			value.WriteString(seg.literal)
+		} else {
+			value.WriteString(sanitizePathElement(layoutTokenValue(seg, v)))
+		}
+		pattern.WriteString(seqSegmentPattern(seg, v))
+	}
+	pattern.WriteString(`(\d+)`)
+	for _, seg := range l.segments[i+1:] {
+		if j := strings.IndexByte(seg.literal, '/'); j >= 0 {
+			pattern.WriteString(regexp.QuoteMeta(seg.literal[:j]))
+			break
+		}
+		pattern.WriteString(seqSegmentPattern(seg, v))
+	}
+	return filepath.FromSlash(dir.String()), "^" + pattern.String() + "$", true
+}
+
+// seqSegmentPattern returns the pattern seg matches in seqPattern: the value
+// of a literal or date token, and anything for tokens that vary between the
+// shots of a day.
+func seqSegmentPattern(seg layoutSegment, v layoutValues) string {
+	switch seg.token {
+	case "":
+		return regexp.QuoteMeta(seg.literal)
+	case "year", "month", "day", "date":
+		return regexp.QuoteMeta(sanitizePathElement(layoutTokenValue(seg, v)))
+	case "seq":
+		return `\d+`
+	default:
+		return ".*"
+	}
+}
+
+// highestSeq returns the highest sequence number pattern (see seqPattern)
+// captures from the names in dir, or 0 if none match or dir doesn't exist.
+func highestSeq(fsys FileSystem, dir, pattern string) (int, error) {
+	entries, err := fsys.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+	re := regexp.MustCompile(pattern)
+	highest := 0
+	for _, entry := range entries {
+		m := re.FindStringSubmatch(entry.Name())
+		if m == nil {
+			continue
+		}
+		if n, err := strconv.Atoi(m[1]); err == nil {
+			highest = max(highest, n)
+		}
+	}
+	return highest, nil
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// sanitizePathElement makes a token value safe to use inside a single path
+// element: EXIF strings and user-supplied labels can contain separators or
+// characters Windows doesn't allow in file names.
+func sanitizePathElement(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			return '_'
+		}
+		if r < 0x20 {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(s))
+}
+
+// planDestinations returns, for each file in dirs whose extension is in
+// exts, its path relative to the destination directory under layout, keyed
+// by the file's source path. Files belonging to the same shot (see shotKey)
+// always resolve to the same path but for their extension, so a RAW and its
+// JPG get the same folder and base name even if only one of them carries EXIF
+// data. exts is in order of preference for reading a shot's metadata, so pass
+// RAW extensions before JPG ones. base supplies the values that don't vary
+// per shot (Label, Event).
+//
+// Sequence numbers count shots per capture day in capture-time order across
+// all of dirs, carrying on from the highest number already in any of dstDirs,
+// the directories the files are copied to, for that day.
+func planDestinations(ctx context.Context, fsys FileSystem, dirs []sourceDir, layout *layoutTemplate, base layoutValues, exts []string, dstDirs []string, maxConcurrency int) (map[string]string, error) {
+	type shot struct {
+		dir     string
+		members []string
+		values  layoutValues
+	}
+
+	shotsByKey := make(map[string]*shot)
+	var shots []*shot
+	for _, dir := range dirs {
+		for _, entry := range dir.Entries {
+			if entry.IsDir() || !matchesAnyExtension(entry.Name(), exts) {
+				continue
+			}
+			key := filepath.Join(dir.Path, shotKey(entry.Name()))
+			s, ok := shotsByKey[key]
+			if !ok {
+				s = &shot{dir: dir.Path}
+				shotsByKey[key] = s
+				shots = append(shots, s)
+			}
+			s.members = append(s.members, entry.Name())
+		}
+	}
+
+	for _, s := range shots {
+		sort.Slice(s.members, func(i, j int) bool {
+			return extensionRank(s.members[i], exts) < extensionRank(s.members[j], exts)
+		})
+		s.values = base
+		s.values.Name = shotBase(s.members[0])
+		s.values.Folder = filepath.Base(s.dir)
+	}
+
+	if layout.needsMetadata() {
+		_, err := forEachEntryConcurrently(ctx, shots, maxConcurrency, func(s *shot) (int, error) {
+			md, err := readShotMetadata(fsys, s.dir, s.members)
+			if err != nil {
+				return 0, fmt.Errorf("failed to read metadata of %s: %w", s.members[0], err)
+			}
+			s.values.shotMetadata = md
+			return 1, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		sort.SliceStable(shots, func(i, j int) bool {
+			return shots[i].values.CaptureTime.Before(shots[j].values.CaptureTime)
+		})
+		// A second card imported the same day carries on where the first
+		// left off, instead of colliding with it.
+		seqByDay := make(map[string]int)
+		highest := make(map[string]int)
+		for _, s := range shots {
+			dir, pattern, ok := layout.seqPattern(s.values)
+			if !ok {
+				break
+			}
+			day := s.values.CaptureTime.Format("2006-01-02")
+			for _, dstDir := range dstDirs {
+				seqDir := filepath.Join(dstDir, dir)
+				key := seqDir + "\x00" + pattern
+				n, ok := highest[key]
+				if !ok {
+					if n, err = highestSeq(fsys, seqDir, pattern); err != nil {
+						return nil, err
+					}
+					highest[key] = n
+				}
+				seqByDay[day] = max(seqByDay[day], n)
+			}
+		}
+		for _, s := range shots {
+			day := s.values.CaptureTime.Format("2006-01-02")
+			seqByDay[day]++
+			s.values.Seq = seqByDay[day]
+		}
+	}
+
+	relPaths := make(map[string]string)
+	for _, s := range shots {
+		for _, name := range s.members {
+			// Each member keeps whatever follows the shared base name: its
+			// extension, plus e.g. the M01 of a clip's XML sidecar.
+			relPaths[filepath.Join(s.dir, name)] = layout.render(s.values, name[len(shotBase(name)):])
+		}
+	}
+	return relPaths, nil
+}
+
+// extensionRank returns the index in exts of name's extension, or len(exts)
+// if it has none of them.
+func extensionRank(name string, exts []string) int {
+	for i, ext := range exts {
+		if matchesAnyExtension(name, []string{ext}) {
+			return i
+		}
+	}
+	return len(exts)
+}
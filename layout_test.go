@@ -0,0 +1,146 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanSDCardDateLayout(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	dirSrc := "src"
+	dirDst := "dst"
+	dirDstJPG := "dst-jpg"
+
+	// The RAW carries EXIF, its JPG doesn't: both follow the RAW.
+	fsys.addFileWithModTime(filepath.Join(dirSrc, "DSC00001.ARW"), fakeRAWShotAt(time.Date(2024, 5, 17, 23, 59, 0, 0, time.Local)), time.Date(2024, 5, 18, 0, 1, 0, 0, time.Local))
+	fsys.addFileWithModTime(filepath.Join(dirSrc, "DSC00001.JPG"), "no exif", time.Date(2024, 5, 18, 0, 1, 0, 0, time.Local))
+	// The JPG carries EXIF, its RAW doesn't: both follow the JPG.
+	fsys.addFile(filepath.Join(dirSrc, "DSC00002.ARW"), "no exif")
+	fsys.addFile(filepath.Join(dirSrc, "DSC00002.JPG"), fakeJPEG(fakeRAWShotAt(time.Date(2023, 12, 31, 12, 0, 0, 0, time.Local))))
+	// Neither carries EXIF: fall back to mtime.
+	fsys.addFileWithModTime(filepath.Join(dirSrc, "DSC00003.ARW"), "no exif", time.Date(2022, 1, 2, 3, 4, 5, 0, time.Local))
+
+	report, err := cleanSDCard(
+		ctx,
+		fsys,
+		[]string{"xmp"},
+		testProfile,
+		dirSrc,
+		dirDst,
+		dirDstJPG,
+		"dst-video",
+		Options{KeepJPG: true, KeepSrc: true, Layout: layoutDate, Concurrency: testConcurrency},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 5, report.Copied)
+
+	for _, path := range []string{
+		filepath.Join(dirDst, "2024", "2024-05-17", "DSC00001.ARW"),
+		filepath.Join(dirDstJPG, "2024", "2024-05-17", "DSC00001.JPG"),
+		filepath.Join(dirDst, "2023", "2023-12-31", "DSC00002.ARW"),
+		filepath.Join(dirDstJPG, "2023", "2023-12-31", "DSC00002.JPG"),
+		filepath.Join(dirDst, "2022", "2022-01-02", "DSC00003.ARW"),
+	} {
+		_, ok := fsys.readFile(path)
+		assert.True(t, ok, "expected %s to exist", path)
+	}
+}
+
+func TestParseLayout(t *testing.T) {
+	for _, layout := range []string{
+		"{year}/{date}_{event}/{camera}/{name}{ext}",
+		"{date}_{time}_{seq:04}{ext}",
+		"{label}/{folder}/{name}",
+		layoutFlat,
+		layoutDate,
+		"",
+	} {
+		_, err := parseLayout(layout)
+		assert.NoError(t, err, layout)
+	}
+
+	for _, layout := range []string{
+		"{moon-phase}/{name}{ext}",
+		"{name}{ext}.bak",
+		"{date:04}/{name}{ext}",
+		"{seq:x}{ext}",
+		"{year/{name}{ext}",
+	} {
+		_, err := parseLayout(layout)
+		assert.Error(t, err, layout)
+	}
+}
+
+func TestPlanDestinations(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	dirSrc := filepath.Join("DCIM", "100MSDCF")
+	model := []fakeEXIFTag{{tagModel, "ILCE-7M3"}}
+	shot := func(t time.Time) string {
+		return fakeTIFF(model, []fakeEXIFTag{{tagDateTimeOriginal, t.Format("2006:01:02 15:04:05")}})
+	}
+
+	fsys.addFile(filepath.Join(dirSrc, "DSC00009.ARW"), shot(time.Date(2024, 5, 17, 8, 0, 0, 0, time.Local)))
+	fsys.addFile(filepath.Join(dirSrc, "DSC00009.JPG"), "no exif")
+	fsys.addFile(filepath.Join(dirSrc, "DSC00003.ARW"), shot(time.Date(2024, 5, 17, 9, 0, 0, 0, time.Local)))
+	fsys.addFile(filepath.Join(dirSrc, "DSC00001.ARW"), shot(time.Date(2024, 5, 18, 7, 0, 0, 0, time.Local)))
+	fsys.addFile(filepath.Join("DCIM", "101MSDCF", "DSC00001.ARW"), shot(time.Date(2024, 5, 17, 10, 0, 0, 0, time.Local)))
+	srcDirs, err := discoverSourceDirs(fsys, "DCIM", nil)
+	require.NoError(t, err)
+
+	layout, err := parseLayout("{year}/{date}_{event}/{camera}/{date}_{seq:03}_{folder}")
+	require.NoError(t, err)
+
+	relPaths, err := planDestinations(ctx, fsys, srcDirs, layout, layoutValues{Event: "wedding"}, []string{"arw", "jpg"}, []string{"dst"}, testConcurrency)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		filepath.Join(dirSrc, "DSC00009.ARW"):             filepath.FromSlash("2024/2024-05-17_wedding/ILCE-7M3/2024-05-17_001_100MSDCF.ARW"),
+		filepath.Join(dirSrc, "DSC00009.JPG"):             filepath.FromSlash("2024/2024-05-17_wedding/ILCE-7M3/2024-05-17_001_100MSDCF.JPG"),
+		filepath.Join(dirSrc, "DSC00003.ARW"):             filepath.FromSlash("2024/2024-05-17_wedding/ILCE-7M3/2024-05-17_002_100MSDCF.ARW"),
+		filepath.Join(dirSrc, "DSC00001.ARW"):             filepath.FromSlash("2024/2024-05-18_wedding/ILCE-7M3/2024-05-18_001_100MSDCF.ARW"),
+		filepath.Join("DCIM", "101MSDCF", "DSC00001.ARW"): filepath.FromSlash("2024/2024-05-17_wedding/ILCE-7M3/2024-05-17_003_101MSDCF.ARW"),
+	}, relPaths)
+}
+
+func TestPlanDestinationsContinuesSequence(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	dirSrc := filepath.Join("DCIM", "100MSDCF")
+	shot := func(t time.Time) string {
+		return fakeTIFF([]fakeEXIFTag{{tagModel, "ILCE-7M3"}}, []fakeEXIFTag{{tagDateTimeOriginal, t.Format("2006:01:02 15:04:05")}})
+	}
+	fsys.addFile(filepath.Join(dirSrc, "DSC00001.ARW"), shot(time.Date(2024, 5, 17, 8, 0, 0, 0, time.Local)))
+	fsys.addFile(filepath.Join(dirSrc, "DSC00002.ARW"), shot(time.Date(2024, 5, 17, 9, 0, 0, 0, time.Local)))
+	fsys.addFile(filepath.Join(dirSrc, "DSC00003.ARW"), shot(time.Date(2024, 5, 18, 7, 0, 0, 0, time.Local)))
+	// an earlier card imported on the same day
+	fsys.addFile(filepath.Join("dst", "2024-05-17_0007.ARW"), "raw")
+	fsys.addFile(filepath.Join("dst-jpg", "2024-05-17_0009.JPG"), "jpg")
+	fsys.addFile(filepath.Join("dst", "2024-05-16_0042.ARW"), "another day")
+	fsys.addFile(filepath.Join("dst", "notes.txt"), "not numbered")
+	srcDirs, err := discoverSourceDirs(fsys, "DCIM", nil)
+	require.NoError(t, err)
+
+	layout, err := parseLayout("{date}_{seq:04}{ext}")
+	require.NoError(t, err)
+	relPaths, err := planDestinations(ctx, fsys, srcDirs, layout, layoutValues{}, []string{"arw", "jpg"}, []string{"dst", "dst-jpg"}, testConcurrency)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		filepath.Join(dirSrc, "DSC00001.ARW"): "2024-05-17_0010.ARW",
+		filepath.Join(dirSrc, "DSC00002.ARW"): "2024-05-17_0011.ARW",
+		filepath.Join(dirSrc, "DSC00003.ARW"): "2024-05-18_0001.ARW",
+	}, relPaths)
+
+	// {seq} numbering a folder
+	fsys.addDir(filepath.Join("dst", "2024-05-17", "03"))
+	layout, err = parseLayout("{date}/{seq:02}/{name}{ext}")
+	require.NoError(t, err)
+	relPaths, err = planDestinations(ctx, fsys, srcDirs, layout, layoutValues{}, []string{"arw", "jpg"}, []string{"dst"}, testConcurrency)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("2024-05-17", "04", "DSC00001.ARW"), relPaths[filepath.Join(dirSrc, "DSC00001.ARW")])
+}
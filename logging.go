@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Log formats, for -log-format.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logFlagNames are the job flags that set up the log, which every command
+// takes.
+var logFlagNames = []string{"log-level", "log-format", "log-file"}
+
+// logOutput is where the log is written unless -log-file says otherwise:
+// stderr, or while a progress line is shown on the terminal, the progress,
+// which writes log lines above its line (see progress.start).
+var logOutput = &swapWriter{w: os.Stderr}
+
+// swapWriter writes to a writer that can be swapped for another while in
+// use.
+type swapWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *swapWriter) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	w := s.w
+	s.mu.Unlock()
+	return w.Write(b)
+}
+
+// swap makes s write to w, and returns the writer it wrote to before.
+func (s *swapWriter) swap(w io.Writer) io.Writer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.w
+	s.w = w
+	return old
+}
+
+// newLogger returns a logger writing records of level and above to w, in
+// format: logFormatText or logFormatJSON. level is a slog level name such as
+// "debug" or "warn".
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %q (valid: debug, info, warn, error)", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch strings.ToLower(format) {
+	case logFormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case logFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q (valid: %s, %s)", format, logFormatText, logFormatJSON)
+	}
+}
+
+// setUpLogging makes the log of a merged job the default logger, which the
+// log package writes through too, and returns it. The log goes to the job's
+// log file, appended to, if it has one. Invalid log settings are fatal.
+func setUpLogging(job jobConfig) *slog.Logger {
+	var w io.Writer = logOutput
+	if job.LogFile != "" {
+		f, err := os.OpenFile(job.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			fatal(slog.Default(), "invalid -log-file", errAttr(err))
+		}
+		// The file is left for the process's exit to close: the log is
+		// written to until then.
+		w = f
+	}
+	logger, err := newLogger(w, job.LogLevel, job.LogFormat)
+	if err != nil {
+		fatal(slog.Default(), "invalid log settings", errAttr(err))
+	}
+	slog.SetDefault(logger)
+	return logger
+}
+
+// fatal logs msg with args as an error and exits with status 1.
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// errAttr returns err as a log attribute.
+func errAttr(err error) slog.Attr {
+	return slog.Any("err", err)
+}
+
+// logger returns opts.Logger, or the default logger if it is nil.
+func (opts Options) logger() *slog.Logger {
+	if opts.Logger != nil {
+		return opts.Logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingHandler is a slog.Handler that keeps every record, so tests can
+// assert on what was logged.
+type recordingHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r.Clone())
+	return nil
+}
+
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+
+func (h *recordingHandler) WithGroup(string) slog.Handler { return h }
+
+// find returns the attributes of the records logged with msg, in the order
+// they were logged.
+func (h *recordingHandler) find(msg string) []map[string]any {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var found []map[string]any
+	for _, r := range h.records {
+		if r.Message != msg {
+			continue
+		}
+		attrs := map[string]any{"level": r.Level}
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value.Any()
+			return true
+		})
+		found = append(found, attrs)
+	}
+	return found
+}
+
+func TestCleanSDCardLogsRecords(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	fsys.addFile(filepath.Join("src", "DSC00001.ARW"), "raw 1")
+	fsys.addFile(filepath.Join("src", "DSC00002.ARW"), "raw 2")
+	fsys.addFile(filepath.Join("dst", "DSC00002.ARW"), "raw 2")
+	fsys.addFile(filepath.Join("src", "DSC00003.ARW"), "raw 3")
+	fsys.addFile(filepath.Join("dst", "DSC00003.ARW"), "other")
+
+	h := &recordingHandler{}
+	_, err := cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "src", "dst", "dst-jpg", "dst-video",
+		Options{KeepSrc: false, Logger: slog.New(h), Concurrency: testConcurrency})
+	require.NoError(t, err)
+
+	copied := h.find("copied")
+	require.Len(t, copied, 1)
+	assert.Equal(t, slog.LevelInfo, copied[0]["level"])
+	assert.Equal(t, filepath.Join("src", "DSC00001.ARW"), copied[0]["file"])
+	assert.Equal(t, filepath.Join("dst", "DSC00001.ARW"), copied[0]["dst"])
+	assert.Equal(t, int64(len("raw 1")), copied[0]["bytes"])
+
+	skipped := h.find("skipped")
+	require.Len(t, skipped, 2)
+	assert.Equal(t, slog.LevelDebug, skipped[0]["level"], "skipped files are per-file noise")
+	assert.Equal(t, actionSkip, skipped[0]["action"])
+
+	collisions := h.find("name collision: a different file is already in the library; leaving it on the card")
+	require.Len(t, collisions, 1)
+	assert.Equal(t, slog.LevelWarn, collisions[0]["level"])
+	assert.Equal(t, filepath.Join("src", "DSC00003.ARW"), collisions[0]["file"])
+
+	assert.Len(t, h.find("removed source file"), 2, "the copied file and the identical one")
+}
+
+func TestCopyAndVerifyLogsFailedTempRemoval(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeFileSystem()
+	fake.addFile(filepath.Join("src", "a.arw"), "raw")
+	fsys := &flakyFileSystem{
+		fakeFileSystem: fake,
+		failCopy:       map[string]bool{"a.arw": true},
+		failRemove:     map[string]bool{"." + "a.arw" + tempFileSuffix: true},
+	}
+
+	h := &recordingHandler{}
+	_, err := copyAndVerify(ctx, fsys, nil, filepath.Join("src", "a.arw"), filepath.Join("dst", "a.arw"), nil, slog.New(h))
+	require.ErrorIs(t, err, errFlaky)
+
+	failed := h.find("failed to remove temp file")
+	require.Len(t, failed, 1)
+	assert.Equal(t, slog.LevelWarn, failed[0]["level"])
+	assert.ErrorIs(t, failed[0]["err"].(error), errFlaky)
+}
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "warn", logFormatJSON)
+	require.NoError(t, err)
+	logger.Info("copied", "file", "a.arw")
+	logger.Warn("keeping source file: its copy is no longer at the destination", "file", "b.arw")
+
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record), "only the warning is written, as one JSON object")
+	assert.Equal(t, "WARN", record["level"])
+	assert.Equal(t, "b.arw", record["file"])
+
+	buf.Reset()
+	logger, err = newLogger(&buf, "DEBUG", logFormatText)
+	require.NoError(t, err)
+	logger.Debug("skipped", "file", "a.arw")
+	assert.Contains(t, buf.String(), "level=DEBUG msg=skipped file=a.arw")
+
+	_, err = newLogger(&buf, "loud", logFormatText)
+	assert.ErrorContains(t, err, "unknown log level")
+	_, err = newLogger(&buf, "info", "xml")
+	assert.ErrorContains(t, err, "unknown log format")
+}
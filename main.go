@@ -3,21 +3,32 @@ package main
 // Sample usage:
 //
 //	go run . -dry-run
-//	go run . -overwrite
-//	go run . -dry-run -overwrite
+//	go run . import -on-conflict=rename
+//	go run . import -dry-run -overwrite
+//	go run . clean-zombies -dst D:\raw
+//	go run . undo -dst D:\raw
 
 import (
-	"flag"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const (
-	defaultDirSrc = "E:\\DCIM\\100MSDCF"
+	defaultDirSrc = "E:\\DCIM"
 	defaultDirDst = "D:\\raw"
 
 	defaultDirDstJPG = "D:\\jpeg"
 
+	defaultDirDstVideo = "D:\\video"
+
 	// defaultConcurrency caps how many files are copied/removed at once.
 	// dirSrc is typically an SD card behind a single physical read channel,
 	// so unbounded per-file concurrency doesn't help throughput and can hurt
@@ -28,128 +39,243 @@ const (
 
 // Options holds the flags that control cleanSDCard's behavior.
 type Options struct {
-	DryRun                bool
-	KeepJPG               bool
-	KeepSrc               bool
-	Overwrite             bool
+	DryRun    bool
+	KeepJPG   bool
+	CopyVideo bool
+	KeepSrc   bool
+	// OnConflict is what is done with a file whose destination is taken.
+	OnConflict            conflictPolicy
 	DeleteZombieEditFiles bool
 	Concurrency           int
+	// Layout is how copied files are arranged under the destination
+	// directories: a template (see parseLayout) or the name of a preset
+	// in layoutPresets.
+	Layout string
+	// CardLabel and Event fill the {label} and {event} layout tokens.
+	CardLabel string
+	Event     string
+	// Resume picks up from the journal an interrupted run left in the
+	// destination directory instead of starting a new one (see
+	// loadJournal).
+	Resume bool
+	// Trash moves zombie edit files into the trash in dirDst instead of
+	// deleting them, and TrashSources does the same with source files
+	// removed after copying (see trashPath).
+	Trash        bool
+	TrashSources bool
+	// TrashRetention is how many days trashed files are kept before being
+	// purged; 0 keeps them until they are deleted by hand.
+	TrashRetention int
+	// KeepGoing goes on with the rest of the run when files fail to copy
+	// or remove, instead of stopping (see executePlan).
+	KeepGoing bool
+	// FreeSpaceMargin is how many bytes must be left free on each
+	// destination disk once everything is copied (see checkFreeSpace).
+	FreeSpaceMargin int64
+	// PlanOut is where cleanSDCard saves its plan (see savePlan), if set.
+	PlanOut string
+	// Progress is where the progress of the copies is shown while they run
+	// (see progress), if set.
+	Progress io.Writer
+	// Logger is what the run logs to; the default logger if nil.
+	Logger *slog.Logger
 }
 
 func main() {
-	var (
-		editFileExtensions        = []string{"xmp"} // lightroom's default edit file extension when edited in local machine
-		extensionsToCopy          = []string{"arw", "raw"}
-		extensionsJPG             = []string{"jpg", "jpeg"}
-		opts                      Options
-		dirSrc, dirDst, dirDstJPG string
-	)
-
-	flag.BoolVar(&opts.DryRun, "dry-run", false, "Simulate operations without modifying files (default: false)")
-	flag.BoolVar(&opts.Overwrite, "overwrite", false, "Overwrite existing files in destination (default: false)")
-	flag.BoolVar(&opts.KeepJPG, "keep-jpg", true, "Keep JPG files in destination (default: true)")
-	flag.BoolVar(&opts.KeepSrc, "keep-src", true, "Keep files in the source (SD card) directory after copying instead of removing them (default: true)")
-	flag.BoolVar(&opts.DeleteZombieEditFiles, "delete-zombie-edit-files", true, "Delete zombie edit files (default: true)")
-	flag.IntVar(&opts.Concurrency, "concurrency", defaultConcurrency, "Maximum number of files to copy/remove concurrently (default: 4). Tune based on your card reader's actual throughput.")
-	flag.StringVar(&dirSrc, "src", defaultDirSrc, "Source directory")
-	flag.StringVar(&dirDst, "dst", defaultDirDst, "Destination directory")
-	flag.StringVar(&dirDstJPG, "dst-jpg", defaultDirDstJPG, "Destination directory for JPG files")
-	flag.Parse()
-
-	log.Printf("Starting copying files from %s to %s with extensions %v\n", dirSrc, dirDst, extensionsToCopy)
-	if opts.DryRun {
-		log.Println("Running in Dry-Run mode. No files will be modified.")
-	}
-	if opts.Overwrite {
-		log.Println("Running in Overwrite mode. Existing files in destination will be overwritten.")
-	} else {
-		log.Println("Running in Skip-Existing mode. Existing files in destination will be skipped.")
+	// Ctrl-C or a service stop lets the work in flight finish, or removes
+	// its partial output, and starts nothing more (see executePlan); a second
+	// one kills the process as usual.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+		slog.Warn("interrupted: finishing the files in progress and stopping; interrupt again to quit at once")
+	}()
+
+	args := os.Args[1:]
+	// Without a command, import, as before there were commands.
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		importMain(ctx, args)
+		return
 	}
-	if opts.KeepSrc {
-		log.Println("Running in Keep-Src mode. Files in the source directory will not be removed.")
-	} else {
-		log.Println("Keep-Src mode disabled. Files in the source directory will be removed after copying.")
+	if args[0] == "help" {
+		printUsage(os.Stdout)
+		return
 	}
-
-	totalCopied, removedCount, err := cleanSDCard(
-		osFileSystem{},
-		editFileExtensions,
-		extensionsToCopy,
-		extensionsJPG,
-		dirSrc,
-		dirDst,
-		dirDstJPG,
-		opts,
-	)
-	if err != nil {
-		log.Fatalf("failed cleaning SD card: %s", err.Error())
+	for _, c := range commands {
+		if c.name == args[0] {
+			c.run(ctx, args[1:])
+			return
+		}
 	}
-
-	log.Printf("\nSummary:\nFiles Copied: %d\nFiles Removed: %d\n", totalCopied, removedCount)
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+	printUsage(os.Stderr)
+	os.Exit(2)
 }
 
-// cleanSDCard copies files from dirSrc to dirDst and removes files from dirSrc.
-// It returns the number of files copied, the number of files removed, and any error.
-func cleanSDCard(
-	fsys FileSystem,
-	editFileExtensions, extensionsToCopy, extensionsJPG []string,
-	dirSrc, dirDst, dirDstJPG string,
-	opts Options,
-) (int, int, error) {
-	if !opts.DryRun {
-		if err := fsys.MkdirAll(dirDst, 0755); err != nil {
-			return 0, 0, fmt.Errorf("failed to create destination directory: %w", err)
-		}
-	}
+// importMain runs the import command with args: copy files from the card
+// (see cleanSDCard), or carry out a saved plan.
+func importMain(ctx context.Context, args []string) {
+	f := newJobFlags("import")
+	planOut := f.String("plan-out", "", "Save the import plan to this file (JSON), for review and later use with -apply; combine with -dry-run to only save it")
+	applyPlan := f.String("apply", "", "Carry out the import plan saved with -plan-out, exactly as reviewed, instead of planning from the card; only -dry-run, -concurrency and -keep-going are honored. The destination is re-checked as the plan is carried out, and a plan reaching outside its card folders and destination directories is refused")
+	reportPath := f.String("report", "", "Save a report of what the run did to this file (JSON), even if the run fails: counts, any error, and each file's source, destination, size, verified SHA-256, duration and error")
+	resume := f.Bool("resume", false, "Pick up where an interrupted run left off, from the journal it kept in -dst ("+journalFileName+"), redoing only the steps it didn't finish and keeping the destinations it chose")
+	job := f.parse(args)
+	logger := setUpLogging(job)
 
-	// List dirSrc once and reuse it for the raw copy, JPG copy, and removal
-	// steps below, instead of re-reading it once per extension group. dirSrc
-	// is typically a slow SD card, so this avoids redundant directory reads
-	// against it.
-	entries, err := fsys.ReadDir(dirSrc)
+	profile, err := job.cameraProfile()
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to read source directory: %w", err)
+		fatal(logger, "invalid -profile", errAttr(err))
 	}
-
-	// copy raw files
-	totalCopied, err := copyFiles(fsys, entries, dirSrc, dirDst, extensionsToCopy, opts.DryRun, opts.Overwrite, opts.Concurrency)
-	if err != nil {
-		return totalCopied, 0, fmt.Errorf("failed to copy files with extensions %v (copied %d): %w", extensionsToCopy, totalCopied, err)
+	opts := job.options()
+	if err := opts.OnConflict.validate(); err != nil {
+		fatal(logger, "invalid -on-conflict", errAttr(err))
 	}
+	opts.Resume = *resume
+	opts.PlanOut = *planOut
+	opts.Progress = os.Stdout
+	opts.Logger = logger
+	dirSrc, dirDst, dirDstJPG, dirDstVideo := job.Src, job.Dst, job.DstJPG, job.DstVideo
 
-	// copy jpg
-	if opts.KeepJPG {
-		countJPGToCopy, err := copyFiles(fsys, entries, dirSrc, dirDstJPG, extensionsJPG, opts.DryRun, opts.Overwrite, opts.Concurrency)
+	var report *Report
+	if *applyPlan != "" {
+		plan, err := loadPlan(*applyPlan)
 		if err != nil {
-			return totalCopied, 0, fmt.Errorf("failed to copy JPG files to %s (copied %d): %w", dirDstJPG, countJPGToCopy, err)
+			fatal(logger, "invalid -apply", errAttr(err))
 		}
+		logger.Info("applying plan", "plan", *applyPlan, "created", plan.Created.Format(time.DateTime), "profile", plan.Profile, "actions", plan.describe())
+		report, err = runPlan(ctx, osFileSystem{}, plan, opts)
+		saveRunReport(logger, report, *reportPath)
+		if err != nil {
+			exitRunError(logger, "failed applying plan", report, err)
+		}
+	} else {
+		logger.Info("starting copying files", "src", dirSrc, "dst", dirDst, "profile", profile.Name)
 		if opts.DryRun {
-			log.Printf("[dry-run] would copy %d JPG files\n", countJPGToCopy)
+			logger.Info("running in dry-run mode: no files will be modified")
+		}
+		switch opts.OnConflict {
+		case conflictOverwrite:
+			logger.Info("running in overwrite mode: existing files in destination will be overwritten")
+		case conflictRename:
+			logger.Info("running in rename mode: files whose name is taken by a different file in destination will be copied under a new name")
+		case conflictFail:
+			logger.Info("running in fail-on-conflict mode: nothing will be copied if a different file has the name of a file to copy in destination")
+		default:
+			logger.Info("running in skip-existing mode: existing files in destination will be skipped")
+		}
+		if opts.KeepSrc {
+			logger.Info("running in keep-src mode: files in the source directory will not be removed")
 		} else {
-			log.Printf("copied %d JPG files to %s\n", countJPGToCopy, dirDstJPG)
+			logger.Info("keep-src mode disabled: files in the source directory will be removed after copying")
 		}
-		totalCopied += countJPGToCopy
-	}
 
-	// remove source files
-	removedCount := 0
-	if !opts.DryRun && !opts.KeepSrc {
-		removedCount, err = removeFiles(fsys, entries, dirSrc, opts.Concurrency)
+		report, err = cleanSDCard(
+			ctx,
+			osFileSystem{},
+			job.Extensions.Edit,
+			profile,
+			dirSrc,
+			dirDst,
+			dirDstJPG,
+			dirDstVideo,
+			opts,
+		)
+		saveRunReport(logger, report, *reportPath)
 		if err != nil {
-			return totalCopied, removedCount, fmt.Errorf("failed to remove source files: %w", err)
+			exitRunError(logger, "failed cleaning SD card", report, err)
 		}
 	}
 
-	// delete zombie edit files
-	if !opts.DryRun && opts.DeleteZombieEditFiles {
-		for _, editFileExtension := range editFileExtensions {
-			count, err := deleteZombieEditFiles(fsys, editFileExtension, dirDst, extensionsToCopy, true, opts.Concurrency)
-			if err != nil {
-				return totalCopied, removedCount, fmt.Errorf("failed to delete zombie edit files with extension %s: %w", editFileExtension, err)
-			}
-			removedCount += count
+	logSummary(logger, report)
+}
+
+// saveRunReport saves report to path (see saveReport), if path is set. The
+// run is done by then, so failing to save the report is only logged.
+func saveRunReport(logger *slog.Logger, report *Report, path string) {
+	if path == "" {
+		return
+	}
+	if err := saveReport(report, path); err != nil {
+		logger.Error("failed to save report", "file", path, errAttr(err))
+		return
+	}
+	logger.Info("saved report", "file", path)
+}
+
+const (
+	// exitFilesFailed is the exit status of a run in -keep-going mode that
+	// did everything but the files that failed.
+	exitFilesFailed = 3
+	// exitInterrupted is the exit status of a run stopped by a signal, as a
+	// shell reports a process killed by SIGINT.
+	exitInterrupted = 130
+)
+
+// exitRunError exits after a run failed with err, having done what report
+// says. A run that was interrupted (see main) logs what it got done first,
+// and exits with exitInterrupted; one that went on after files failed (see
+// Options.KeepGoing) prints them and exits with exitFilesFailed.
+func exitRunError(logger *slog.Logger, msg string, report *Report, err error) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		logger.Warn("stopped before finishing", errAttr(err))
+		logSummary(logger, report)
+		logger.Info("run again with -resume to finish what was left")
+		os.Exit(exitInterrupted)
+	case errors.Is(err, errFilesFailed):
+		logger.Error("finished, but some files failed", "failed", len(report.failed()))
+		logSummary(logger, report)
+		if err := printFailedFiles(os.Stdout, report); err != nil {
+			logger.Error("failed to print the failed files", errAttr(err))
 		}
+		os.Exit(exitFilesFailed)
+	default:
+		fatal(logger, msg, errAttr(err))
+	}
+}
+
+// logSummary logs how many files the run of report copied and removed, or
+// would have in dry-run mode.
+func logSummary(logger *slog.Logger, report *Report) {
+	if report.DryRun {
+		logger.Info("summary (dry run, nothing was modified)", "to-copy", report.Copied, "to-remove", report.Removed)
+	} else {
+		logger.Info("summary", "copied", report.Copied, "removed", report.Removed)
 	}
+}
 
-	return totalCopied, removedCount, nil
+// cleanSDCard copies files from dirSrc to dirDst and removes files from dirSrc.
+// dirSrc may be the card root, its DCIM directory, or a single folder (see
+// discoverSourceDirs). profile decides which files are copied where; a
+// profile named profileAuto is narrowed down to the camera detected on the
+// card (see detectProfile).
+// Only source files with a known-good copy at the destination (a copy verified
+// against a checksum, or an identical file already there) are removed.
+// It works out everything it will do up front (see planImport), saves the
+// plan to opts.PlanOut if set, and then carries it out (see runPlan); in
+// dry-run mode, it only logs the plan. Each file's progress is recorded in a
+// journal in dirDst, which opts.Resume picks up from.
+// It returns the report of what it did (see Report), and any error.
+func cleanSDCard(
+	ctx context.Context,
+	fsys FileSystem,
+	editFileExtensions []string,
+	profile cameraProfile,
+	dirSrc, dirDst, dirDstJPG, dirDstVideo string,
+	opts Options,
+) (*Report, error) {
+	plan, err := planImport(ctx, fsys, editFileExtensions, profile, dirSrc, dirDst, dirDstJPG, dirDstVideo, opts)
+	if err != nil {
+		return newReport(opts.DryRun).finish(err)
+	}
+	if opts.PlanOut != "" {
+		if err := savePlan(plan, opts.PlanOut); err != nil {
+			return newReport(opts.DryRun).finish(err)
+		}
+		opts.logger().Info("saved plan", "file", opts.PlanOut, "actions", plan.describe())
+	}
+	return runPlan(ctx, fsys, plan, opts)
 }
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -12,7 +16,12 @@ import (
 
 const testConcurrency = 4
 
+// testProfile is the camera profile tests import with unless they need
+// something more specific.
+var testProfile = cameraProfile{Name: "test", RawExtensions: []string{"arw"}, ImageExtensions: []string{"jpg"}}
+
 func TestCleanSDCard(t *testing.T) {
+	ctx := t.Context()
 	fsys := newFakeFileSystem()
 	dirSrc := "src"
 	dirDst := "dst"
@@ -22,7 +31,6 @@ func TestCleanSDCard(t *testing.T) {
 	extensionsJPG := []string{"jpg"}
 	opts := Options{
 		DryRun:                false,
-		Overwrite:             false,
 		DeleteZombieEditFiles: false,
 		KeepJPG:               false,
 		KeepSrc:               false,
@@ -37,30 +45,31 @@ func TestCleanSDCard(t *testing.T) {
 		expectedFiles[i] = name
 	}
 
-	totalCopied, removedCount, err := cleanSDCard(
+	report, err := cleanSDCard(
+		ctx,
 		fsys,
 		editFileExtensions,
-		extensionsToCopy,
-		extensionsJPG,
+		cameraProfile{RawExtensions: extensionsToCopy, ImageExtensions: extensionsJPG},
 		dirSrc,
 		dirDst,
 		dirDstJPG,
+		"dst-video",
 		opts,
 	)
 
 	assert.NoError(t, err)
-	assert.Equal(t, fileCount, totalCopied)
-	assert.Equal(t, fileCount, removedCount)
+	assert.Equal(t, fileCount, report.Copied)
+	assert.Equal(t, fileCount, report.Removed)
 
 	entries, err := fsys.ReadDir(dirDst)
 	assert.NoError(t, err)
-	assert.Equal(t, fileCount, len(entries))
+	assert.Equal(t, fileCount+2, len(entries))
 
 	copiedFiles := make([]string, len(entries))
 	for i, entry := range entries {
 		copiedFiles[i] = entry.Name()
 	}
-	assert.ElementsMatch(t, copiedFiles, expectedFiles)
+	assert.ElementsMatch(t, copiedFiles, append(expectedFiles, journalFileName, runsDirName))
 
 	entries, err = fsys.ReadDir(dirSrc)
 	assert.NoError(t, err)
@@ -68,6 +77,7 @@ func TestCleanSDCard(t *testing.T) {
 }
 
 func TestCleanSDCardReadsSourceDirOnce(t *testing.T) {
+	ctx := t.Context()
 	fake := newFakeFileSystem()
 	dirSrc := "src"
 	dirDst := "dst"
@@ -79,14 +89,15 @@ func TestCleanSDCardReadsSourceDirOnce(t *testing.T) {
 
 	counting := newReadDirCountingFileSystem(fake)
 
-	_, _, err := cleanSDCard(
+	_, err := cleanSDCard(
+		ctx,
 		counting,
 		[]string{"xmp"},
-		[]string{"raw", "arw"},
-		[]string{"jpg", "jpeg"},
+		cameraProfile{RawExtensions: []string{"raw", "arw"}, ImageExtensions: []string{"jpg", "jpeg"}},
 		dirSrc,
 		dirDst,
 		dirDstJPG,
+		"dst-video",
 		Options{KeepJPG: true, DeleteZombieEditFiles: false, Concurrency: testConcurrency},
 	)
 
@@ -94,8 +105,269 @@ func TestCleanSDCardReadsSourceDirOnce(t *testing.T) {
 	assert.Equal(t, 1, counting.callsFor(dirSrc), "dirSrc should only be listed once, shared across the raw copy, JPG copy, and removal steps")
 }
 
-func TestDeleteZombieEditFiles(t *testing.T) {
-	t.Run("deletes zombie edit files when no corresponding raw file exists", func(t *testing.T) {
+func TestCleanSDCardKeepsSourceOfUnverifiedCopy(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeFileSystem()
+	dirSrc := "src"
+	dirDst := "dst"
+
+	fake.addFile(filepath.Join(dirSrc, "good.arw"), "good")
+	fake.addFile(filepath.Join(dirSrc, "bad.arw"), "bad")
+	fsys := &corruptingFileSystem{fakeFileSystem: fake, corrupt: map[string]bool{"bad.arw": true}}
+
+	report, err := cleanSDCard(
+		ctx,
+		fsys,
+		[]string{"xmp"},
+		testProfile,
+		dirSrc,
+		dirDst,
+		"dst-jpg",
+		"dst-video",
+		Options{KeepSrc: false, Concurrency: testConcurrency},
+	)
+
+	assert.ErrorIs(t, err, errChecksumMismatch)
+	assert.Equal(t, 0, report.Removed)
+
+	_, ok := fake.readFile(filepath.Join(dirSrc, "bad.arw"))
+	assert.True(t, ok, "source of a copy that failed verification must not be removed")
+	_, ok = fake.readFile(filepath.Join(dirDst, "bad.arw"))
+	assert.False(t, ok, "a copy that failed verification must not be moved into place")
+	_, ok = fake.readFile(tempPathFor(filepath.Join(dirDst, "bad.arw")))
+	assert.False(t, ok, "the temp file of a copy that failed verification should be removed")
+}
+
+func TestCleanSDCardStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	fake := newFakeFileSystem()
+	for i := range 5 {
+		fake.addFile(filepath.Join("src", fmt.Sprintf("DSC%05d.arw", i+1)), fmt.Sprintf("raw %d", i+1))
+	}
+	fsys := &cancellingFileSystem{fakeFileSystem: fake, cancel: cancel, after: 2}
+
+	report, err := cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "src", "dst", "dst-jpg", "dst-video",
+		Options{KeepSrc: false, Concurrency: 1})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, report.Copied)
+	assert.Zero(t, report.Removed, "nothing is removed once cancelled")
+	for i := range 5 {
+		_, ok := fake.readFile(filepath.Join("src", fmt.Sprintf("DSC%05d.arw", i+1)))
+		assert.True(t, ok, "source files stay on the card")
+	}
+	// the copy in progress is stopped before it is verified
+	_, ok := fake.readFile(filepath.Join("dst", "DSC00002.arw"))
+	assert.False(t, ok, "an unverified copy isn't moved into place")
+	_, ok = fake.readFile(tempPathFor(filepath.Join("dst", "DSC00002.arw")))
+	assert.False(t, ok, "the temp file of a stopped copy is removed")
+	_, ok = fake.readFile(filepath.Join("dst", "DSC00003.arw"))
+	assert.False(t, ok, "no copy is started once cancelled")
+
+	// the journal has what is left
+	report, err = cleanSDCard(t.Context(), fake, []string{"xmp"}, testProfile, "src", "dst", "dst-jpg", "dst-video",
+		Options{KeepSrc: false, Resume: true, Concurrency: testConcurrency})
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.Copied)
+	assert.Equal(t, 5, report.Removed)
+}
+
+func TestCleanSDCardKeepGoing(t *testing.T) {
+	newCard := func() (*fakeFileSystem, *flakyFileSystem) {
+		fake := newFakeFileSystem()
+		fake.addFile(filepath.Join("src", "DSC00001.ARW"), "raw 1")
+		fake.addFile(filepath.Join("src", "DSC00002.ARW"), "raw 2")
+		fake.addFile(filepath.Join("src", "DSC00002.JPG"), "jpg 2")
+		fake.addFile(filepath.Join("src", "DSC00003.ARW"), "raw 3")
+		fake.addFile(filepath.Join("dst", "DSC00009.xmp"), "zombie")
+		return fake, &flakyFileSystem{
+			fakeFileSystem: fake,
+			failCopy:       map[string]bool{"DSC00002.ARW": true},
+			failRemove:     map[string]bool{"DSC00003.ARW": true},
+		}
+	}
+	run := func(fsys FileSystem, keepGoing bool) (*Report, error) {
+		return cleanSDCard(t.Context(), fsys, []string{"xmp"}, testProfile, "src", "dst", "dst-jpg", "dst-video",
+			Options{KeepSrc: false, KeepJPG: true, DeleteZombieEditFiles: true, KeepGoing: keepGoing, Concurrency: testConcurrency})
+	}
+
+	t.Run("stops after a failed copy without it", func(t *testing.T) {
+		fake, fsys := newCard()
+		report, err := run(fsys, false)
+		require.ErrorIs(t, err, errFlaky)
+		assert.NotErrorIs(t, err, errFilesFailed)
+		assert.Equal(t, 3, report.Copied)
+		assert.Zero(t, report.Removed)
+		_, ok := fake.readFile(filepath.Join("dst", "DSC00009.xmp"))
+		assert.True(t, ok, "zombie edit files are left alone")
+	})
+
+	t.Run("does the rest with it", func(t *testing.T) {
+		fake, fsys := newCard()
+		report, err := run(fsys, true)
+		require.ErrorIs(t, err, errFilesFailed)
+		assert.ErrorIs(t, err, errFlaky)
+		assert.Equal(t, 3, report.Copied)
+		assert.Equal(t, 3, report.Removed, "two source files and the zombie edit file")
+
+		for name, kept := range map[string]bool{
+			"DSC00001.ARW": false,
+			"DSC00002.ARW": true, // failed to copy
+			"DSC00002.JPG": false,
+			"DSC00003.ARW": true, // failed to remove
+		} {
+			_, ok := fake.readFile(filepath.Join("src", name))
+			assert.Equal(t, kept, ok, name)
+		}
+		_, ok := fake.readFile(filepath.Join("dst", "DSC00009.xmp"))
+		assert.False(t, ok, "zombie edit files are still cleaned up")
+
+		failed := report.failed()
+		require.Len(t, failed, 2)
+		sort.Slice(failed, func(i, j int) bool { return failed[i].Src < failed[j].Src })
+		assert.Equal(t, actionCopy, failed[0].Action)
+		assert.Equal(t, filepath.Join("src", "DSC00002.ARW"), failed[0].Src)
+		assert.Equal(t, actionRemove, failed[1].Action)
+		assert.Equal(t, filepath.Join("src", "DSC00003.ARW"), failed[1].Src)
+	})
+
+	t.Run("leaves files it can't plan on the card", func(t *testing.T) {
+		fake, fsys := newCard()
+		fsys.failCopy, fsys.failRemove = nil, nil
+		// DSC00003.ARW's name is taken, and it can't be read to compare it
+		fake.addFile(filepath.Join("dst", "DSC00003.ARW"), "another raw 3")
+		fsys.failRead = map[string]bool{"DSC00003.ARW": true}
+
+		_, err := run(fsys, false)
+		require.ErrorIs(t, err, errFlaky)
+		_, ok := fake.readFile(filepath.Join("dst", "DSC00001.ARW"))
+		assert.False(t, ok, "nothing is copied without it")
+
+		report, err := run(fsys, true)
+		require.ErrorIs(t, err, errFilesFailed)
+		assert.Equal(t, 3, report.Copied)
+		assert.Equal(t, 4, report.Removed, "three source files and the zombie edit file")
+		_, ok = fake.readFile(filepath.Join("src", "DSC00003.ARW"))
+		assert.True(t, ok, "the file it failed on stays on the card")
+
+		failed := report.failed()
+		require.Len(t, failed, 1)
+		assert.Equal(t, actionSkip, failed[0].Action)
+		assert.Equal(t, filepath.Join("src", "DSC00003.ARW"), failed[0].Src)
+		assert.Equal(t, reasonFailed, failed[0].Reason)
+		assert.Contains(t, failed[0].Error, errFlaky.Error())
+	})
+}
+
+func TestCleanSDCardRemovesStaleTempFiles(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	dirSrc := "src"
+	dirDst := "dst"
+
+	fsys.addFile(filepath.Join(dirSrc, "photo1.arw"), "complete")
+	// left behind by a run that was interrupted mid-copy
+	fsys.addFile(tempPathFor(filepath.Join(dirDst, "photo1.arw")), "compl")
+	fsys.addFile(tempPathFor(filepath.Join(dirDst, "photo2.arw")), "trunc")
+
+	report, err := cleanSDCard(
+		ctx,
+		fsys,
+		[]string{"xmp"},
+		testProfile,
+		dirSrc,
+		dirDst,
+		"dst-jpg",
+		"dst-video",
+		Options{KeepSrc: true, Concurrency: testConcurrency},
+	)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Copied)
+
+	entries, err := fsys.ReadDir(dirDst)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, journalFileName, entries[0].Name())
+	assert.Equal(t, runsDirName, entries[1].Name())
+	assert.Equal(t, "photo1.arw", entries[2].Name())
+
+	content, _ := fsys.readFile(filepath.Join(dirDst, "photo1.arw"))
+	assert.Equal(t, "complete", content)
+}
+
+func TestCleanSDCardOnlyRemovesSafeSourceFiles(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	dirSrc := "src"
+	dirDst := "dst"
+
+	fsys.addFile(filepath.Join(dirSrc, "new.arw"), "new")
+	fsys.addFile(filepath.Join(dirSrc, "same.arw"), "same")
+	fsys.addFile(filepath.Join(dirDst, "same.arw"), "same")
+	fsys.addFile(filepath.Join(dirSrc, "collision.arw"), "card version")
+	fsys.addFile(filepath.Join(dirDst, "collision.arw"), "library version")
+	fsys.addFile(filepath.Join(dirSrc, "new.jpg"), "jpg")
+	fsys.addFile(filepath.Join(dirSrc, "clip.mp4"), "video")
+	fsys.addFile(filepath.Join(dirSrc, "new.thm"), "thumbnail")
+
+	report, err := cleanSDCard(
+		ctx,
+		fsys,
+		[]string{"xmp"},
+		testProfile,
+		dirSrc,
+		dirDst,
+		"dst-jpg",
+		"dst-video",
+		Options{KeepJPG: false, KeepSrc: false, Concurrency: testConcurrency},
+	)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Copied)
+	assert.Equal(t, 2, report.Removed)
+
+	entries, err := fsys.ReadDir(dirSrc)
+	require.NoError(t, err)
+	remaining := make([]string, len(entries))
+	for i, entry := range entries {
+		remaining[i] = entry.Name()
+	}
+	assert.ElementsMatch(t, []string{"collision.arw", "new.jpg", "clip.mp4", "new.thm"}, remaining)
+
+	content, _ := fsys.readFile(filepath.Join(dirDst, "collision.arw"))
+	assert.Equal(t, "library version", content)
+}
+
+func TestCleanSDCardPreservesModificationTimes(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	dirSrc := "src"
+	dirDst := "dst"
+	shotAt := time.Date(2024, 5, 17, 9, 30, 0, 0, time.UTC)
+
+	fsys.addFileWithModTime(filepath.Join(dirSrc, "photo1.arw"), "content", shotAt)
+
+	_, err := cleanSDCard(
+		ctx,
+		fsys,
+		[]string{"xmp"},
+		testProfile,
+		dirSrc,
+		dirDst,
+		"dst-jpg",
+		"dst-video",
+		Options{KeepSrc: true, Concurrency: testConcurrency},
+	)
+	require.NoError(t, err)
+
+	info, err := fsys.Stat(filepath.Join(dirDst, "photo1.arw"))
+	require.NoError(t, err)
+	assert.True(t, shotAt.Equal(info.ModTime()), "expected copy to carry the source mtime %s, got %s", shotAt, info.ModTime())
+}
+
+func TestFindZombieEditFiles(t *testing.T) {
+	ctx := t.Context()
+	t.Run("finds zombie edit files when no corresponding raw file exists", func(t *testing.T) {
 		fsys := newFakeFileSystem()
 
 		// Create zombie edit files (no corresponding raw files)
@@ -103,15 +375,15 @@ func TestDeleteZombieEditFiles(t *testing.T) {
 			fsys.addFile(fmt.Sprintf("photo%d.xmp", i+1), "")
 		}
 
-		count, err := deleteZombieEditFiles(fsys, "xmp", ".", []string{"arw", "raw"}, false, testConcurrency)
+		zombies, err := findZombieEditFiles(ctx, fsys, "xmp", ".", []string{"arw", "raw"}, nil, false, testConcurrency)
 
 		assert.NoError(t, err)
-		assert.Equal(t, 3, count)
+		assert.Equal(t, []string{"photo1.xmp", "photo2.xmp", "photo3.xmp"}, zombies)
 
-		// Verify all zombie files are deleted
+		// Finding zombies doesn't delete them
 		entries, err := fsys.ReadDir(".")
 		require.NoError(t, err)
-		assert.Equal(t, 0, len(entries))
+		assert.Equal(t, 3, len(entries))
 	})
 
 	t.Run("keeps edit files when corresponding raw file exists", func(t *testing.T) {
@@ -125,15 +397,21 @@ func TestDeleteZombieEditFiles(t *testing.T) {
 		fsys.addFile("photo2.xmp", "")
 		fsys.addFile("photo2.raw", "")
 
-		count, err := deleteZombieEditFiles(fsys, "xmp", ".", []string{"arw", "raw"}, false, testConcurrency)
+		zombies, err := findZombieEditFiles(ctx, fsys, "xmp", ".", []string{"arw", "raw"}, nil, false, testConcurrency)
 
 		assert.NoError(t, err)
-		assert.Equal(t, 0, count)
+		assert.Empty(t, zombies)
+	})
 
-		// Verify all files still exist
-		entries, err := fsys.ReadDir(".")
-		require.NoError(t, err)
-		assert.Equal(t, 4, len(entries))
+	t.Run("keeps edit files whose raw file is about to be copied", func(t *testing.T) {
+		fsys := newFakeFileSystem()
+		fsys.addFile("photo1.xmp", "")
+		fsys.addFile("photo2.xmp", "")
+
+		zombies, err := findZombieEditFiles(ctx, fsys, "xmp", ".", []string{"arw", "raw"}, map[string]bool{"photo1.arw": true}, false, testConcurrency)
+
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"photo2.xmp"}, zombies)
 	})
 
 	t.Run("mixed scenario with some zombie and some valid edit files", func(t *testing.T) {
@@ -147,59 +425,44 @@ func TestDeleteZombieEditFiles(t *testing.T) {
 		fsys.addFile("zombie1.xmp", "")
 		fsys.addFile("zombie2.xmp", "")
 
-		count, err := deleteZombieEditFiles(fsys, "xmp", ".", []string{"arw", "raw"}, false, testConcurrency)
+		zombies, err := findZombieEditFiles(ctx, fsys, "xmp", ".", []string{"arw", "raw"}, nil, false, testConcurrency)
 
 		assert.NoError(t, err)
-		assert.Equal(t, 2, count)
-
-		// Verify valid files still exist and zombies are deleted
-		entries, err := fsys.ReadDir(".")
-		require.NoError(t, err)
-
-		fileNames := make([]string, len(entries))
-		for i, entry := range entries {
-			fileNames[i] = entry.Name()
-		}
-		assert.ElementsMatch(t, []string{"valid.xmp", "valid.arw"}, fileNames)
+		assert.Equal(t, []string{"zombie1.xmp", "zombie2.xmp"}, zombies)
 	})
 
-	t.Run("does not delete non-edit files", func(t *testing.T) {
+	t.Run("ignores non-edit files", func(t *testing.T) {
 		fsys := newFakeFileSystem()
 
 		// Create non-edit files
 		fsys.addFile("photo.jpg", "")
 		fsys.addFile("photo.png", "")
 
-		count, err := deleteZombieEditFiles(fsys, "xmp", ".", []string{"arw", "raw"}, false, testConcurrency)
+		zombies, err := findZombieEditFiles(ctx, fsys, "xmp", ".", []string{"arw", "raw"}, nil, false, testConcurrency)
 
 		assert.NoError(t, err)
-		assert.Equal(t, 0, count)
-
-		// Verify files still exist
-		entries, err := fsys.ReadDir(".")
-		require.NoError(t, err)
-		assert.Equal(t, 2, len(entries))
+		assert.Empty(t, zombies)
 	})
 
 	t.Run("handles empty directory", func(t *testing.T) {
 		fsys := newFakeFileSystem()
 
-		count, err := deleteZombieEditFiles(fsys, "xmp", ".", []string{"arw", "raw"}, false, testConcurrency)
+		zombies, err := findZombieEditFiles(ctx, fsys, "xmp", ".", []string{"arw", "raw"}, nil, false, testConcurrency)
 
 		assert.NoError(t, err)
-		assert.Equal(t, 0, count)
+		assert.Empty(t, zombies)
 	})
 
 	t.Run("returns error for non-existent directory", func(t *testing.T) {
 		fsys := newFakeFileSystem()
 
-		count, err := deleteZombieEditFiles(fsys, "xmp", "/non/existent/path", []string{"arw", "raw"}, false, testConcurrency)
+		zombies, err := findZombieEditFiles(ctx, fsys, "xmp", "/non/existent/path", []string{"arw", "raw"}, nil, false, testConcurrency)
 
 		assert.Error(t, err)
-		assert.Equal(t, 0, count)
+		assert.Empty(t, zombies)
 	})
 
-	t.Run("recursive mode deletes zombie files in subdirectories", func(t *testing.T) {
+	t.Run("recursive mode finds zombie files in subdirectories", func(t *testing.T) {
 		fsys := newFakeFileSystem()
 		subDir := "subdir"
 		fsys.addDir(subDir)
@@ -214,19 +477,10 @@ func TestDeleteZombieEditFiles(t *testing.T) {
 		fsys.addFile(filepath.Join(subDir, "valid.xmp"), "")
 		fsys.addFile(filepath.Join(subDir, "valid.arw"), "")
 
-		count, err := deleteZombieEditFiles(fsys, "xmp", ".", []string{"arw", "raw"}, true, testConcurrency)
+		zombies, err := findZombieEditFiles(ctx, fsys, "xmp", ".", []string{"arw", "raw"}, nil, true, testConcurrency)
 
 		assert.NoError(t, err)
-		assert.Equal(t, 2, count) // root_zombie.xmp + sub_zombie.xmp
-
-		// Verify valid files in subdirectory still exist
-		entries, err := fsys.ReadDir(subDir)
-		require.NoError(t, err)
-		fileNames := make([]string, len(entries))
-		for i, entry := range entries {
-			fileNames[i] = entry.Name()
-		}
-		assert.ElementsMatch(t, []string{"valid.xmp", "valid.arw"}, fileNames)
+		assert.Equal(t, []string{"root_zombie.xmp", filepath.Join(subDir, "sub_zombie.xmp")}, zombies)
 	})
 
 	t.Run("non-recursive mode skips subdirectories", func(t *testing.T) {
@@ -240,20 +494,15 @@ func TestDeleteZombieEditFiles(t *testing.T) {
 		// Create zombie edit file in subdirectory
 		fsys.addFile(filepath.Join(subDir, "sub_zombie.xmp"), "")
 
-		count, err := deleteZombieEditFiles(fsys, "xmp", ".", []string{"arw", "raw"}, false, testConcurrency)
+		zombies, err := findZombieEditFiles(ctx, fsys, "xmp", ".", []string{"arw", "raw"}, nil, false, testConcurrency)
 
 		assert.NoError(t, err)
-		assert.Equal(t, 1, count) // only root_zombie.xmp
-
-		// Verify subdirectory file still exists
-		entries, err := fsys.ReadDir(subDir)
-		require.NoError(t, err)
-		assert.Equal(t, 1, len(entries))
-		assert.Equal(t, "sub_zombie.xmp", entries[0].Name())
+		assert.Equal(t, []string{"root_zombie.xmp"}, zombies) // only root_zombie.xmp
 	})
 }
 
-func TestCopyFilesDeadlock(t *testing.T) {
+func TestExecutePlanCopyErrorDoesNotDeadlock(t *testing.T) {
+	ctx := t.Context()
 	t.Run("does not deadlock when a copy error occurs", func(t *testing.T) {
 		dirSrc := t.TempDir()
 		dirDst := t.TempDir()
@@ -268,15 +517,24 @@ func TestCopyFilesDeadlock(t *testing.T) {
 		err = os.Mkdir(filepath.Join(dirDst, "file1.txt"), 0755)
 		require.NoError(t, err)
 
-		fsys := osFileSystem{}
-		entries, err := fsys.ReadDir(dirSrc)
-		require.NoError(t, err)
+		plan := &Plan{
+			Version:    planVersion,
+			DstDirs:    []string{dirDst},
+			JournalDir: dirDst,
+			Actions: []Action{
+				{Kind: actionCopy, Src: srcFilePath, Dst: filepath.Join(dirDst, "file1.txt"), Overwrite: true, Reason: reasonOverwrite},
+				{Kind: actionRemove, Src: srcFilePath, Reason: reasonSafe},
+			},
+		}
 
 		// This call would hang if the deadlock is present.
 		// We expect it to complete with an error.
-		count, err := copyFiles(fsys, entries, dirSrc, dirDst, []string{"txt"}, false, true, testConcurrency)
+		totalCopied, removedCount, err := executePlan(ctx, osFileSystem{}, plan, testConcurrency, false, nil, nil, slog.Default())
 
 		assert.Error(t, err)
-		assert.Equal(t, 0, count)
+		assert.Zero(t, totalCopied)
+		assert.Zero(t, removedCount)
+		_, err = os.Stat(srcFilePath)
+		assert.NoError(t, err, "the source of a failed copy must be kept")
 	})
 }
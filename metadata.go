@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// exifReadLimit caps how much of a file readEXIF reads looking for EXIF
+// data. JPEGs keep EXIF in an APP1 segment near the start, and TIFF-based
+// RAWs (ARW, NEF, ...) keep their IFDs near the start too, while the image
+// data that follows can be tens of megabytes -- which goexif would otherwise
+// read into memory in full, from a slow card, just to get a timestamp.
+const exifReadLimit = 512 << 10
+
+// shotMetadata is what the destination layout needs to know about a shot.
+type shotMetadata struct {
+	// CaptureTime is the EXIF DateTimeOriginal, or a file's modification
+	// time if no member of the shot has EXIF data.
+	CaptureTime time.Time
+	// Make and Model identify the camera; empty if unknown.
+	Make, Model string
+}
+
+// readEXIF returns the capture time and camera recorded in the EXIF data of
+// the file at path, which may be a JPEG or a TIFF-based RAW. It returns an
+// error if the file has no readable capture time.
+func readEXIF(fsys FileSystem, path string) (md shotMetadata, err error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return shotMetadata{}, err
+	}
+	defer f.Close()
+
+	// goexif trusts the offsets it finds in the file; don't let a corrupt
+	// file on a failing card take the whole run down with it.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("decoding EXIF data: %v", r)
+		}
+	}()
+
+	x, err := exif.Decode(io.LimitReader(f, exifReadLimit))
+	if x == nil {
+		return shotMetadata{}, fmt.Errorf("decoding EXIF data: %w", err)
+	}
+	// A non-nil x with an error means some non-critical part (GPS, maker
+	// notes, ...) failed to parse; what we need may still be there.
+	md.CaptureTime, err = x.DateTime()
+	if err != nil {
+		return shotMetadata{}, err
+	}
+	md.Make = exifString(x, exif.Make)
+	md.Model = exifString(x, exif.Model)
+	return md, nil
+}
+
+// exifString returns the string value of the named tag in x, or "" if it is
+// missing or not a string.
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+// clipXML is the part of a Sony video clip's XML metadata sidecar
+// (NonRealTimeMeta) that the destination layout needs.
+type clipXML struct {
+	CreationDate struct {
+		Value string `xml:"value,attr"`
+	} `xml:"CreationDate"`
+	Device struct {
+		Manufacturer string `xml:"manufacturer,attr"`
+		ModelName    string `xml:"modelName,attr"`
+	} `xml:"Device"`
+}
+
+// readClipXML returns the capture time and camera recorded in the Sony video
+// clip XML metadata sidecar at path. It returns an error if the file has no
+// readable capture time.
+func readClipXML(fsys FileSystem, path string) (shotMetadata, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return shotMetadata{}, err
+	}
+	defer f.Close()
+
+	var meta clipXML
+	if err := xml.NewDecoder(f).Decode(&meta); err != nil {
+		return shotMetadata{}, fmt.Errorf("decoding clip metadata: %w", err)
+	}
+	t, err := time.Parse(time.RFC3339, meta.CreationDate.Value)
+	if err != nil {
+		return shotMetadata{}, fmt.Errorf("decoding clip creation date: %w", err)
+	}
+	return shotMetadata{CaptureTime: t, Make: meta.Device.Manufacturer, Model: meta.Device.ModelName}, nil
+}
+
+// readFileMetadata returns the metadata recorded in the file at path, from
+// its EXIF data or, for a video clip's XML sidecar, from the XML.
+func readFileMetadata(fsys FileSystem, path string) (shotMetadata, error) {
+	if strings.EqualFold(filepath.Ext(path), ".xml") {
+		return readClipXML(fsys, path)
+	}
+	return readEXIF(fsys, path)
+}
+
+// readShotMetadata returns the metadata of the shot made up of the files
+// named by members in dir, taking it from the first member with readable
+// metadata and falling back to the first member's modification time if
+// none has any.
+func readShotMetadata(fsys FileSystem, dir string, members []string) (shotMetadata, error) {
+	for _, name := range members {
+		if md, err := readFileMetadata(fsys, filepath.Join(dir, name)); err == nil {
+			return md, nil
+		}
+	}
+
+	info, err := fsys.Stat(filepath.Join(dir, members[0]))
+	if err != nil {
+		return shotMetadata{}, err
+	}
+	return shotMetadata{CaptureTime: info.ModTime()}, nil
+}
+
+// clipSidecarPattern matches the name of a Sony video clip's XML metadata
+// sidecar, which is the clip's base name with an M01-style suffix, e.g.
+// C0001M01.XML for C0001.MP4.
+var clipSidecarPattern = regexp.MustCompile(`(?i)^(.+)M[0-9]{2}\.xml$`)
+
+// shotBase returns the base name a file shares with the other members of its
+// shot: a RAW and the JPG the camera wrote alongside it share a base name, as
+// do a video clip and its XML sidecar once the sidecar's suffix is dropped.
+func shotBase(name string) string {
+	if m := clipSidecarPattern.FindStringSubmatch(name); m != nil {
+		return m[1]
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// shotKey returns the name that groups a file with the other members of its
+// shot (see shotBase).
+func shotKey(name string) string {
+	return strings.ToUpper(shotBase(name))
+}
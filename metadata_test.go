@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEXIFTag is an ASCII EXIF tag for fakeTIFF.
+type fakeEXIFTag struct {
+	id    uint16
+	value string
+}
+
+const (
+	tagModel            = 0x0110
+	tagExifIFDPointer   = 0x8769
+	tagDateTimeOriginal = 0x9003
+)
+
+// fakeTIFF returns a minimal little-endian TIFF -- the container RAW formats
+// like ARW and NEF are built on -- with ifd0Tags in IFD0 and exifTags in the
+// EXIF sub-IFD. Tags must be sorted by id and hold values longer than 3
+// bytes, so that every value is stored out of line.
+func fakeTIFF(ifd0Tags, exifTags []fakeEXIFTag) string {
+	const headerSize = 8
+	ifdSize := func(n int) int { return 2 + 12*n + 4 }
+	ifd0Offset := headerSize
+	exifOffset := ifd0Offset + ifdSize(len(ifd0Tags)+1)
+	dataOffset := exifOffset + ifdSize(len(exifTags))
+
+	var ifds, data bytes.Buffer
+	le := binary.LittleEndian
+	writeEntry := func(id, typ uint16, count, value uint32) {
+		binary.Write(&ifds, le, id)
+		binary.Write(&ifds, le, typ)
+		binary.Write(&ifds, le, count)
+		binary.Write(&ifds, le, value)
+	}
+	writeASCII := func(tag fakeEXIFTag) {
+		writeEntry(tag.id, 2, uint32(len(tag.value)+1), uint32(dataOffset+data.Len()))
+		data.WriteString(tag.value)
+		data.WriteByte(0)
+	}
+
+	binary.Write(&ifds, le, uint16(len(ifd0Tags)+1))
+	for _, tag := range ifd0Tags {
+		writeASCII(tag)
+	}
+	writeEntry(tagExifIFDPointer, 4, 1, uint32(exifOffset))
+	binary.Write(&ifds, le, uint32(0))
+
+	binary.Write(&ifds, le, uint16(len(exifTags)))
+	for _, tag := range exifTags {
+		writeASCII(tag)
+	}
+	binary.Write(&ifds, le, uint32(0))
+
+	var out bytes.Buffer
+	out.WriteString("II*\x00")
+	binary.Write(&out, le, uint32(ifd0Offset))
+	out.Write(ifds.Bytes())
+	out.Write(data.Bytes())
+	return out.String()
+}
+
+// fakeJPEG returns a JPEG header whose APP1 segment holds tiff as its EXIF
+// data.
+func fakeJPEG(tiff string) string {
+	var out bytes.Buffer
+	out.WriteString("\xFF\xD8\xFF\xE1")
+	binary.Write(&out, binary.BigEndian, uint16(2+6+len(tiff)))
+	out.WriteString("Exif\x00\x00")
+	out.WriteString(tiff)
+	return out.String()
+}
+
+// fakeRAWShotAt returns a fake TIFF-based RAW taken at t.
+func fakeRAWShotAt(t time.Time) string {
+	return fakeTIFF(nil, []fakeEXIFTag{{tagDateTimeOriginal, t.Format("2006:01:02 15:04:05")}})
+}
+
+func TestReadEXIF(t *testing.T) {
+	shotAt := time.Date(2024, 5, 17, 9, 30, 12, 0, time.Local)
+
+	t.Run("reads DateTimeOriginal from a TIFF-based RAW", func(t *testing.T) {
+		fsys := newFakeFileSystem()
+		fsys.addFile("photo.arw", fakeTIFF(
+			[]fakeEXIFTag{{tagModel, "ILCE-7M3"}},
+			[]fakeEXIFTag{{tagDateTimeOriginal, shotAt.Format("2006:01:02 15:04:05")}},
+		))
+
+		md, err := readEXIF(fsys, "photo.arw")
+		require.NoError(t, err)
+		assert.True(t, shotAt.Equal(md.CaptureTime), "expected %s, got %s", shotAt, md.CaptureTime)
+		assert.Equal(t, "ILCE-7M3", md.Model)
+	})
+
+	t.Run("reads DateTimeOriginal from a JPEG", func(t *testing.T) {
+		fsys := newFakeFileSystem()
+		fsys.addFile("photo.jpg", fakeJPEG(fakeRAWShotAt(shotAt)))
+
+		md, err := readEXIF(fsys, "photo.jpg")
+		require.NoError(t, err)
+		assert.True(t, shotAt.Equal(md.CaptureTime), "expected %s, got %s", shotAt, md.CaptureTime)
+	})
+
+	t.Run("returns an error for a file without EXIF data", func(t *testing.T) {
+		fsys := newFakeFileSystem()
+		fsys.addFile("photo.arw", "not an image")
+
+		_, err := readEXIF(fsys, "photo.arw")
+		assert.Error(t, err)
+	})
+}
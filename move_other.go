@@ -0,0 +1,16 @@
+//go:build !unix && !windows
+
+package main
+
+import "errors"
+
+// errCrossDevice stands for a rename failing because it would cross
+// filesystems, which this platform doesn't tell apart from other failures.
+var errCrossDevice = errors.New("cross-device rename")
+
+// isCrossDevice can't tell why a rename failed on this platform, so it
+// reports any failure: moveFile's fallback of copying, verifying and removing
+// the file is safe whatever the reason.
+func isCrossDevice(err error) bool {
+	return err != nil
+}
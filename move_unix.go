@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// errCrossDevice is what a rename fails with when it would cross from one
+// filesystem to another.
+var errCrossDevice error = syscall.EXDEV
+
+// isCrossDevice reports whether a rename failed with err because it would
+// cross filesystems.
+func isCrossDevice(err error) bool {
+	return errors.Is(err, errCrossDevice)
+}
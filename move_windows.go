@@ -0,0 +1,19 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// errCrossDevice is what a rename fails with when it would cross from one
+// volume to another: ERROR_NOT_SAME_DEVICE. syscall.EXDEV is never returned
+// on Windows.
+var errCrossDevice error = syscall.Errno(17)
+
+// isCrossDevice reports whether a rename failed with err because it would
+// cross volumes.
+func isCrossDevice(err error) bool {
+	return errors.Is(err, errCrossDevice)
+}
@@ -0,0 +1,782 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// planVersion is the version of the saved plan format (see savePlan). A plan
+// saved in a different format is refused rather than half-understood.
+const planVersion = 3
+
+// Plan is everything an import will do, worked out up front by planImport
+// without modifying anything, so that it can be logged for review (dry-run),
+// saved, and later carried out exactly as reviewed by executePlan.
+type Plan struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	// Profile is the name of the camera profile the plan was made with.
+	Profile string `json:"profile"`
+	// SrcDirs are the directories on the card the plan copies and removes
+	// files from.
+	SrcDirs []string `json:"src-dirs,omitempty"`
+	// DstDirs are the destination directories, created and cleaned of stale
+	// temp files before anything is copied.
+	DstDirs []string `json:"dst-dirs"`
+	// JournalDir is where the import's journal is kept (see openJournal).
+	// Plans that copy nothing keep no journal, leaving the last import's
+	// alone.
+	JournalDir string `json:"journal-dir,omitempty"`
+	// RecordDir is where the run's record is kept (see runRecord).
+	RecordDir string `json:"record-dir,omitempty"`
+	// Resume is set if the plan picks up from the journal of an interrupted
+	// run, which is then appended to rather than replaced.
+	Resume bool `json:"resume,omitempty"`
+	// RawExtensions are what an edit file's RAW may be named with, whatever
+	// camera it is from (see libraryRawExtensions); they are checked again
+	// before a zombie edit file is deleted.
+	RawExtensions []string `json:"raw-extensions"`
+	// EditExtensions are what the edit files the plan deletes as zombies
+	// may be named with.
+	EditExtensions []string `json:"edit-extensions"`
+	Actions        []Action `json:"actions"`
+
+	// indexes are the library indexes the plan was made with, saved when it
+	// is executed. A plan loaded with loadPlan has none.
+	indexes []*libraryIndex
+}
+
+// ActionKind is what an Action does.
+type ActionKind string
+
+const (
+	// actionCopy copies Src to Dst.
+	actionCopy ActionKind = "copy"
+	// actionSkip leaves Src uncopied because of what is at Dst.
+	actionSkip ActionKind = "skip"
+	// actionRemove removes Src from the source once every copy of it is
+	// done.
+	actionRemove ActionKind = "remove"
+	// actionDeleteZombie deletes the edit file Dst, whose RAW is gone.
+	actionDeleteZombie ActionKind = "delete-zombie"
+	// actionPurgeTrash deletes the trash day folder Dst and everything in
+	// it.
+	actionPurgeTrash ActionKind = "purge-trash"
+)
+
+// Reasons given for planned actions.
+const (
+	reasonNew       = "not at the destination yet"
+	reasonOverwrite = "replaces the file at the destination (-on-conflict=overwrite)"
+	reasonExists    = "a file with the same name is already at the destination (-on-conflict=skip)"
+	reasonRenamed   = "renamed with its shot: a different file has its name at the destination (-on-conflict=rename)"
+	reasonIdentical = "an identical file is already at the destination"
+	reasonDuplicate = "an identical file is already in the library under another name"
+	reasonDifferent = "a different file with the same name is already at the destination"
+	reasonSameCopy  = "an identical file on the card is copied to the same destination"
+	reasonClash     = "a different file on the card is copied to the same destination"
+	reasonFailed    = "failed to look at it while planning (-keep-going)"
+	reasonResumed   = "copied and verified by the run being resumed"
+	reasonSafe      = "has a known-good copy at the destination"
+	reasonZombie    = "no RAW file with the same name next to it"
+	reasonExpired   = "trashed longer ago than -trash-retention"
+)
+
+// Action is one step of a Plan.
+type Action struct {
+	Kind ActionKind `json:"kind"`
+	// Src is the source file copied, skipped or removed.
+	Src string `json:"src,omitempty"`
+	// Dst is where Src is copied to, or the file already there, or elsewhere
+	// in the library, that it is skipped for; for actionDeleteZombie, the edit file deleted; for
+	// actionPurgeTrash, the trash day folder purged.
+	Dst string `json:"dst,omitempty"`
+	// Size is Src's size when the plan was made.
+	Size int64 `json:"size,omitempty"`
+	// Overwrite is set on copies that replace a file at Dst. Any other copy
+	// fails if a file has appeared at Dst since the plan was made.
+	Overwrite bool `json:"overwrite,omitempty"`
+	// Trash is set on removals and zombie deletions that move the file to
+	// this path in the trash instead of deleting it (see trashPath).
+	Trash  string `json:"trash,omitempty"`
+	Reason string `json:"reason"`
+	// Error is set on skips of files planning failed on, in keep-going mode
+	// (see planFailure): what it failed with.
+	Error string `json:"error,omitempty"`
+}
+
+// preview says what a does, as it is about to be done; logAttrs has what
+// it does it to.
+func (a Action) preview() string {
+	switch a.Kind {
+	case actionCopy:
+		return "would copy"
+	case actionSkip:
+		return "would skip"
+	case actionRemove:
+		if a.Trash != "" {
+			return "would move source file to the trash"
+		}
+		return "would remove source file"
+	case actionDeleteZombie:
+		if a.Trash != "" {
+			return "would move zombie edit file to the trash"
+		}
+		return "would delete zombie edit file"
+	default:
+		return "would purge trash folder"
+	}
+}
+
+// logAttrs returns what a does, the file it does it to, and where to, as log
+// attributes.
+func (a Action) logAttrs() []any {
+	attrs := []any{"action", a.Kind}
+	switch a.Kind {
+	case actionCopy, actionSkip:
+		attrs = append(attrs, "file", a.Src, "dst", a.Dst, "bytes", a.Size)
+	case actionRemove:
+		attrs = append(attrs, "file", a.Src)
+	default:
+		attrs = append(attrs, "file", a.Dst)
+	}
+	if a.Trash != "" {
+		attrs = append(attrs, "trash", a.Trash)
+	}
+	attrs = append(attrs, "reason", a.Reason)
+	if a.Error != "" {
+		attrs = append(attrs, "err", a.Error)
+	}
+	return attrs
+}
+
+// planErr returns what planning a failed on, if it did (see planFailure).
+func (a Action) planErr() error {
+	if a.Error == "" {
+		return nil
+	}
+	return errors.New(a.Error)
+}
+
+// count returns how many of p's actions are of kind.
+func (p *Plan) count(kind ActionKind) int {
+	n := 0
+	for _, a := range p.Actions {
+		if a.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// planImport works out what cleanSDCard does to copy files from dirSrc to the
+// destination directories, without modifying anything. See cleanSDCard for
+// what is copied where and what is removed.
+func planImport(
+	ctx context.Context,
+	fsys FileSystem,
+	editFileExtensions []string,
+	profile cameraProfile,
+	dirSrc, dirDst, dirDstJPG, dirDstVideo string,
+	opts Options,
+) (*Plan, error) {
+	if err := opts.OnConflict.validate(); err != nil {
+		return nil, err
+	}
+
+	// A card file may be compared with its destination, looked up in the
+	// library and compared with another file on the card: it is read once.
+	fsys = newHashCachingFileSystem(fsys)
+
+	var (
+		history journalHistory
+		err     error
+	)
+	if opts.Resume {
+		if history, err = loadJournal(fsys, dirDst, opts.logger()); err != nil {
+			return nil, err
+		}
+		if len(history) == 0 {
+			opts.logger().Warn("no journal to resume from; starting a new one", "dir", dirDst)
+		}
+	}
+
+	imp, err := discoverImport(ctx, fsys, history, profile, dirSrc, dirDst, dirDstJPG, dirDstVideo, opts)
+	if err != nil {
+		return nil, err
+	}
+	profile = imp.profile
+
+	plan := &Plan{
+		Version:        planVersion,
+		Created:        time.Now(),
+		Profile:        profile.Name,
+		JournalDir:     dirDst,
+		RecordDir:      dirDst,
+		Resume:         opts.Resume,
+		RawExtensions:  libraryRawExtensions(profile),
+		EditExtensions: editFileExtensions,
+	}
+	indexes := make(map[string]*libraryIndex)
+	for _, g := range imp.groups {
+		if _, ok := indexes[g.dstDir]; ok {
+			continue
+		}
+		if indexes[g.dstDir], err = loadLibraryIndex(fsys, g.dstDir, opts.logger()); err != nil {
+			return nil, err
+		}
+		plan.indexes = append(plan.indexes, indexes[g.dstDir])
+	}
+	for _, dir := range imp.srcDirs {
+		plan.SrcDirs = append(plan.SrcDirs, dir.Path)
+	}
+	for _, g := range imp.groups {
+		plan.DstDirs = append(plan.DstDirs, g.dstDir)
+		for _, dir := range imp.srcDirs {
+			actions, err := planCopies(ctx, fsys, history, indexes[g.dstDir], dir, g.dstDir, imp.dstRelPaths, g.exts, opts)
+			if err != nil {
+				return nil, err
+			}
+			plan.Actions = append(plan.Actions, actions...)
+		}
+	}
+	if err := planCollisions(ctx, fsys, plan.Actions, opts); err != nil {
+		return nil, err
+	}
+	if err := renameConflicts(ctx, fsys, plan.Actions, opts); err != nil {
+		return nil, err
+	}
+
+	// remove source files, but only those with a known-good copy at the
+	// destination: verified copies and identical files that were already
+	// there. Anything else -- unmatched extensions, name collisions with
+	// different content -- stays on the card.
+	if !opts.KeepSrc {
+		for _, a := range plan.Actions {
+			if a.Reason == reasonExists {
+				opts.logger().Warn("keeping source file: -on-conflict=skip doesn't check it against the file at its destination", "file", a.Src, "dst", a.Dst)
+			}
+		}
+		for _, src := range removableSources(plan.Actions) {
+			a := Action{Kind: actionRemove, Src: src, Reason: reasonSafe}
+			if opts.TrashSources {
+				if a.Trash, err = trashPath(dirDst, dirSrc, src, plan.Created); err != nil {
+					return nil, err
+				}
+			}
+			plan.Actions = append(plan.Actions, a)
+		}
+	}
+
+	// delete zombie edit files, minding the RAWs this plan copies
+	if opts.DeleteZombieEditFiles {
+		incoming := make(map[string]bool)
+		for _, a := range plan.Actions {
+			if a.Kind == actionCopy {
+				incoming[filepath.Clean(a.Dst)] = true
+			}
+		}
+		zombies, err := planZombieDeletions(ctx, fsys, editFileExtensions, plan.RawExtensions, dirDst, incoming, plan.Created, opts)
+		if err != nil {
+			return nil, err
+		}
+		plan.Actions = append(plan.Actions, zombies...)
+	}
+
+	purges, err := planTrashPurge(fsys, dirDst, plan.Created, opts)
+	if err != nil {
+		return nil, err
+	}
+	plan.Actions = append(plan.Actions, purges...)
+
+	return plan, nil
+}
+
+// copyGroup is a group of source files, by extension, copied to one
+// destination directory.
+type copyGroup struct {
+	dstDir string
+	exts   []string
+}
+
+// importSources is what an import of a card works from: the source
+// directories found on it, the camera profile, the groups of files copied and
+// where each file goes under its group's destination directory (see
+// destinationPath).
+type importSources struct {
+	profile     cameraProfile
+	srcDirs     []sourceDir
+	groups      []copyGroup
+	dstRelPaths map[string]string
+}
+
+// discoverImport finds the files to import from dirSrc and works out where
+// they go, keeping the destinations history recorded (see
+// restoreDestinations). A profile named profileAuto is narrowed down to the
+// camera detected on the card.
+func discoverImport(
+	ctx context.Context,
+	fsys FileSystem,
+	history journalHistory,
+	profile cameraProfile,
+	dirSrc, dirDst, dirDstJPG, dirDstVideo string,
+	opts Options,
+) (importSources, error) {
+	layout, err := parseLayout(opts.Layout)
+	if err != nil {
+		return importSources{}, err
+	}
+
+	// List each source directory once and reuse the listings for every
+	// extension group below, instead of re-reading them once per group.
+	// dirSrc is typically a slow SD card, so this avoids redundant
+	// directory reads against it.
+	srcDirs, err := discoverSourceDirs(fsys, dirSrc, profile.VideoDirs)
+	if err != nil {
+		return importSources{}, err
+	}
+
+	if profile.Name == profileAuto {
+		if detected, ok := detectProfile(srcDirs); ok {
+			opts.logger().Info("detected camera profile", "profile", detected.Name)
+			profile = detected
+		} else {
+			opts.logger().Warn("could not detect the camera profile; importing every known file type")
+		}
+	}
+
+	// Video metadata sidecars go first: they're where a clip's capture date
+	// is read from.
+	extensionsVideo := slices.Concat(profile.SidecarExtensions, profile.VideoExtensions)
+
+	// Work out where each file goes once, per shot, so that a RAW and its JPG
+	// get matching paths even though they are copied separately.
+	base := layoutValues{Label: opts.CardLabel, Event: opts.Event}
+	photoDstDirs := []string{dirDst}
+	if opts.KeepJPG {
+		photoDstDirs = append(photoDstDirs, dirDstJPG)
+	}
+	dstRelPaths, err := planDestinations(ctx, fsys, srcDirs, layout, base, slices.Concat(profile.RawExtensions, profile.ImageExtensions), photoDstDirs, opts.Concurrency)
+	if err != nil {
+		return importSources{}, fmt.Errorf("failed to plan destination paths: %w", err)
+	}
+	if opts.CopyVideo {
+		videoRelPaths, err := planDestinations(ctx, fsys, srcDirs, layout, base, extensionsVideo, []string{dirDstVideo}, opts.Concurrency)
+		if err != nil {
+			return importSources{}, fmt.Errorf("failed to plan destination paths for video clips: %w", err)
+		}
+		maps.Copy(dstRelPaths, videoRelPaths)
+	}
+
+	// copy raw files, jpg if kept, and video clips together with their
+	// metadata sidecars
+	groups := []copyGroup{{dirDst, profile.RawExtensions}}
+	if opts.KeepJPG {
+		groups = append(groups, copyGroup{dirDstJPG, profile.ImageExtensions})
+	}
+	if opts.CopyVideo {
+		groups = append(groups, copyGroup{dirDstVideo, extensionsVideo})
+	}
+	for _, g := range groups {
+		// Files keep the destinations an earlier run recorded, even if the
+		// layout would now put them elsewhere (a {seq} renumbered because
+		// files before it are gone from the card, say).
+		history.restoreDestinations(dstRelPaths, g.dstDir, g.exts)
+	}
+
+	return importSources{profile: profile, srcDirs: srcDirs, groups: groups, dstRelPaths: dstRelPaths}, nil
+}
+
+// planCleanZombies works out what the clean-zombies command does: delete the
+// zombie edit files in dirDst (see planZombieDeletions) and purge expired
+// trash, without looking at a card.
+func planCleanZombies(ctx context.Context, fsys FileSystem, editFileExtensions []string, profile cameraProfile, dirDst string, opts Options) (*Plan, error) {
+	plan := &Plan{
+		Version:        planVersion,
+		Created:        time.Now(),
+		Profile:        profile.Name,
+		RecordDir:      dirDst,
+		RawExtensions:  libraryRawExtensions(profile),
+		EditExtensions: editFileExtensions,
+	}
+	zombies, err := planZombieDeletions(ctx, fsys, editFileExtensions, plan.RawExtensions, dirDst, nil, plan.Created, opts)
+	if err != nil {
+		return nil, err
+	}
+	purges, err := planTrashPurge(fsys, dirDst, plan.Created, opts)
+	if err != nil {
+		return nil, err
+	}
+	plan.Actions = slices.Concat(zombies, purges)
+	return plan, nil
+}
+
+// planZombieDeletions plans deleting the edit files in dirDst, or moving them
+// to the trash if opts.Trash is set, that have no RAW with one of
+// rawExtensions next to them and none about to be copied there (see
+// findZombieEditFiles). A missing dirDst has no zombies.
+func planZombieDeletions(ctx context.Context, fsys FileSystem, editFileExtensions, rawExtensions []string, dirDst string, incoming map[string]bool, created time.Time, opts Options) ([]Action, error) {
+	if _, err := fsys.Stat(dirDst); err != nil {
+		return nil, nil
+	}
+	var actions []Action
+	for _, editFileExtension := range editFileExtensions {
+		zombies, err := findZombieEditFiles(ctx, fsys, editFileExtension, dirDst, rawExtensions, incoming, true, opts.Concurrency)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find zombie edit files with extension %s: %w", editFileExtension, err)
+		}
+		for _, path := range zombies {
+			a := Action{Kind: actionDeleteZombie, Dst: path, Reason: reasonZombie}
+			if opts.Trash {
+				if a.Trash, err = trashPath(dirDst, dirDst, path, created); err != nil {
+					return nil, err
+				}
+			}
+			actions = append(actions, a)
+		}
+	}
+	return actions, nil
+}
+
+// planTrashPurge plans purging what has been in the trash of dirDst for
+// longer than opts.TrashRetention days, if set.
+func planTrashPurge(fsys FileSystem, dirDst string, created time.Time, opts Options) ([]Action, error) {
+	if opts.TrashRetention <= 0 {
+		return nil, nil
+	}
+	expired, err := expiredTrashDirs(fsys, dirDst, opts.TrashRetention, created)
+	if err != nil {
+		return nil, err
+	}
+	var actions []Action
+	for _, dir := range expired {
+		actions = append(actions, Action{Kind: actionPurgeTrash, Dst: dir, Reason: reasonExpired})
+	}
+	return actions, nil
+}
+
+// planWipeSource works out what the wipe-source command does: remove from
+// dirSrc the files that already have a known-good copy in the destination
+// directories, copying nothing. It is the import plan (see planImport) with
+// the copies left out, and with no source file removed that still needed
+// one; those are logged, to be imported first.
+func planWipeSource(ctx context.Context, fsys FileSystem, profile cameraProfile, dirSrc, dirDst, dirDstJPG, dirDstVideo string, opts Options) (*Plan, error) {
+	opts.KeepSrc = false
+	opts.DeleteZombieEditFiles = false
+	opts.TrashRetention = 0
+	opts.Resume = false
+	plan, err := planImport(ctx, fsys, nil, profile, dirSrc, dirDst, dirDstJPG, dirDstVideo, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	notImported := make(map[string]bool)
+	for _, a := range plan.Actions {
+		if a.Kind == actionCopy {
+			notImported[a.Src] = true
+		}
+	}
+	actions := plan.Actions[:0]
+	for _, a := range plan.Actions {
+		if a.Kind == actionCopy || a.Kind == actionRemove && notImported[a.Src] {
+			continue
+		}
+		actions = append(actions, a)
+	}
+	plan.Actions = actions
+	if len(notImported) > 0 {
+		opts.logger().Warn("keeping files that aren't in the library yet; import them first", "files", len(notImported))
+	}
+
+	// Copying nothing, it has no destination directories to prepare and
+	// leaves the last import's journal alone.
+	plan.DstDirs = nil
+	plan.JournalDir = ""
+	return plan, nil
+}
+
+// planCopies plans copying the files in dir whose extension is in exts to
+// dstDir, at their paths in dstRelPaths (see destinationPath). A file whose
+// destination is taken is planned by opts.OnConflict (see planConflict);
+// copies it renames are given their new destination by renameConflicts.
+// Files the resumed journal in history has copied already are skipped, and
+// so are files index finds identical copies of elsewhere in the library,
+// whatever their name. At most opts.Concurrency files are looked at once.
+func planCopies(ctx context.Context, fsys FileSystem, history journalHistory, index *libraryIndex, dir sourceDir, dstDir string, dstRelPaths map[string]string, exts []string, opts Options) ([]Action, error) {
+	var (
+		mu      sync.Mutex
+		actions []Action
+	)
+	_, err := forEachEntryConcurrently(ctx, dir.Entries, opts.Concurrency, func(entry os.DirEntry) (int, error) {
+		if entry.IsDir() || !matchesAnyExtension(entry.Name(), exts) {
+			return 0, nil
+		}
+
+		srcPath := filepath.Join(dir.Path, entry.Name())
+		a := Action{Kind: actionCopy, Src: srcPath, Dst: destinationPath(dstDir, srcPath, dstRelPaths), Reason: reasonNew}
+		if info, err := entry.Info(); err == nil {
+			a.Size = info.Size()
+		}
+
+		if history.completed(fsys, srcPath, a.Dst) {
+			a.Kind, a.Reason = actionSkip, reasonResumed
+		} else if _, statErr := fsys.Stat(a.Dst); statErr == nil {
+			if err := planConflict(ctx, fsys, index, &a, opts.OnConflict, opts.logger()); err != nil {
+				if err := planFailure(ctx, &a, err, opts); err != nil {
+					return 0, fileCopyError{fileName: entry.Name(), err: err}
+				}
+			}
+		} else if dup, found, err := findDuplicate(ctx, fsys, index, srcPath, a.Size); err != nil {
+			if err := planFailure(ctx, &a, err, opts); err != nil {
+				return 0, fileCopyError{fileName: entry.Name(), err: err}
+			}
+		} else if found {
+			a.Kind, a.Dst, a.Reason = actionSkip, dup, reasonDuplicate
+		}
+
+		mu.Lock()
+		actions = append(actions, a)
+		mu.Unlock()
+		return 1, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(actions, func(i, j int) bool { return actions[i].Src < actions[j].Src })
+	return actions, nil
+}
+
+// planConflict plans the copy a, whose destination is taken, by policy (see
+// conflictPolicy). Unless the policy is conflictSkip or conflictOverwrite, a
+// file identical to the one at its destination, or to one elsewhere in index,
+// is skipped whatever the policy. A file left on the card as a name collision
+// is logged to logger.
+func planConflict(ctx context.Context, fsys FileSystem, index *libraryIndex, a *Action, policy conflictPolicy, logger *slog.Logger) error {
+	switch policy {
+	case conflictOverwrite:
+		a.Overwrite, a.Reason = true, reasonOverwrite
+		return nil
+	case conflictSkip:
+		a.Kind, a.Reason = actionSkip, reasonExists
+		return nil
+	}
+
+	identical, err := sameContent(ctx, fsys, a.Src, a.Dst)
+	if err != nil {
+		return err
+	}
+	if identical {
+		a.Kind, a.Reason = actionSkip, reasonIdentical
+		return nil
+	}
+	dup, found, err := findDuplicate(ctx, fsys, index, a.Src, a.Size)
+	if err != nil {
+		return err
+	}
+	if found {
+		a.Kind, a.Dst, a.Reason = actionSkip, dup, reasonDuplicate
+		return nil
+	}
+
+	switch policy {
+	case conflictRename:
+		// renameConflicts picks the new name, once every copy is planned.
+		a.Reason = reasonRenamed
+	case conflictFail:
+		return fmt.Errorf("%w: %s", errNameConflict, a.Dst)
+	default:
+		logger.Warn("name collision: a different file is already in the library; leaving it on the card", "file", a.Src, "dst", a.Dst)
+		a.Kind, a.Reason = actionSkip, reasonDifferent
+	}
+	return nil
+}
+
+// planFailure handles err, what planning the copy a failed on, such as a
+// source file on a dying card that can't be read to compare it. In keep-going
+// mode, unless err is a refusal by conflictFail or ctx is done, a is planned
+// as a skip that failed with err, which leaves it on the card and is reported
+// as a failure when the plan is carried out, and nil is returned so that the
+// rest of the card is still imported. Otherwise err is returned, to stop
+// planning.
+func planFailure(ctx context.Context, a *Action, err error, opts Options) error {
+	if !opts.KeepGoing || errors.Is(err, errNameConflict) || ctx.Err() != nil {
+		return err
+	}
+	opts.logger().Warn("failed to plan file; leaving it on the card", "file", a.Src, errAttr(err))
+	a.Kind, a.Reason, a.Overwrite, a.Error = actionSkip, reasonFailed, false, err.Error()
+	return nil
+}
+
+// findDuplicate returns the path of a file in index identical to the source
+// file srcPath of the given size, if there is one. The source is only hashed
+// if the library has files of its size.
+func findDuplicate(ctx context.Context, fsys FileSystem, index *libraryIndex, srcPath string, size int64) (string, bool, error) {
+	if !index.hasSize(size) {
+		return "", false, nil
+	}
+	hash, err := fsys.HashFile(ctx, srcPath)
+	if err != nil {
+		return "", false, err
+	}
+	return index.find(ctx, fsys, size, hash)
+}
+
+// leavesKnownGoodCopy reports whether a copy or skip leaves a known-good copy
+// of Src at Dst: a verified copy, or an identical file that was already there.
+func (a Action) leavesKnownGoodCopy() bool {
+	if a.Kind != actionSkip {
+		return a.Kind == actionCopy
+	}
+	switch a.Reason {
+	case reasonDifferent, reasonExists, reasonClash, reasonFailed:
+		return false
+	}
+	return true
+}
+
+// removableSources returns the source files that may be removed given the
+// copies and skips planned in actions: those every copy or skip of which
+// leaves a known-good copy at the destination. Files no extension group
+// matched -- thumbnails, unknown sidecars -- have no such actions and are
+// never removed.
+func removableSources(actions []Action) []string {
+	removable := make(map[string]bool)
+	var srcs []string
+	for _, a := range actions {
+		if a.Kind != actionCopy && a.Kind != actionSkip {
+			continue
+		}
+		ok, seen := removable[a.Src]
+		if !seen {
+			srcs = append(srcs, a.Src)
+			ok = true
+		}
+		removable[a.Src] = ok && a.leavesKnownGoodCopy()
+	}
+
+	result := srcs[:0]
+	for _, src := range srcs {
+		if removable[src] {
+			result = append(result, src)
+		}
+	}
+	return result
+}
+
+// savePlan writes p to path as JSON, for executing later with -apply.
+func savePlan(p *Plan, path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to save plan: %w", err)
+	}
+	return nil
+}
+
+// loadPlan reads a plan saved by savePlan.
+func loadPlan(path string) (*Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plan: %w", err)
+	}
+	var p Plan
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse plan %s: %w", path, err)
+	}
+	if p.Version != planVersion {
+		return nil, fmt.Errorf("plan %s has version %d, expected %d", path, p.Version, planVersion)
+	}
+	for i, a := range p.Actions {
+		if err := a.validate(&p); err != nil {
+			return nil, fmt.Errorf("plan %s: action %d: %w", path, i+1, err)
+		}
+	}
+	return &p, nil
+}
+
+// errInvalidAction is returned for a saved plan action that is missing what
+// its kind needs, or that would delete or move what no plan would.
+var errInvalidAction = errors.New("invalid action")
+
+// validate checks that a, loaded from the saved plan p, has what its kind
+// needs, and that what it touches is what a plan made by planImport could:
+// files in p's source directories, copied into its destination directories,
+// zombie edit files named with one of its edit extensions, trash day folders,
+// and files moved into them, all in its library. A stale or hand-edited plan
+// can't copy over, delete or move anything else.
+func (a Action) validate(p *Plan) error {
+	switch a.Kind {
+	case actionCopy, actionSkip:
+		if a.Src == "" || a.Dst == "" {
+			return fmt.Errorf("%w: %s needs src and dst", errInvalidAction, a.Kind)
+		}
+		if !slices.ContainsFunc(p.DstDirs, func(dir string) bool { return isWithin(dir, a.Dst) }) {
+			return fmt.Errorf("%w: %s to %s, which isn't in a destination directory", errInvalidAction, a.Kind, a.Dst)
+		}
+	case actionRemove:
+		if a.Src == "" {
+			return fmt.Errorf("%w: %s needs src", errInvalidAction, a.Kind)
+		}
+	case actionDeleteZombie:
+		if a.Dst == "" {
+			return fmt.Errorf("%w: %s needs dst", errInvalidAction, a.Kind)
+		}
+		if !isWithin(p.RecordDir, a.Dst) {
+			return fmt.Errorf("%w: %s of %s, which isn't in the library", errInvalidAction, a.Kind, a.Dst)
+		}
+		if !matchesAnyExtension(a.Dst, p.EditExtensions) {
+			return fmt.Errorf("%w: %s of %s, which isn't an edit file", errInvalidAction, a.Kind, a.Dst)
+		}
+	case actionPurgeTrash:
+		if !isTrashDay(a.Dst) || !isWithin(p.RecordDir, a.Dst) {
+			return fmt.Errorf("%w: %s of %q, which isn't a trash day folder of the library", errInvalidAction, a.Kind, a.Dst)
+		}
+	default:
+		return fmt.Errorf("%w: unknown kind %q", errInvalidAction, a.Kind)
+	}
+	if a.Src != "" && !slices.Contains(p.SrcDirs, filepath.Dir(a.Src)) {
+		return fmt.Errorf("%w: %s of %s, which isn't in a source directory", errInvalidAction, a.Kind, a.Src)
+	}
+	if a.Trash != "" && (!isInTrash(a.Trash) || !isWithin(p.RecordDir, a.Trash)) {
+		return fmt.Errorf("%w: %s to %s, which isn't in a trash day folder of the library", errInvalidAction, a.Kind, a.Trash)
+	}
+	return nil
+}
+
+// isWithin reports whether path is root or inside it. An empty root has
+// nothing in it.
+func isWithin(root, path string) bool {
+	if root == "" {
+		return false
+	}
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// describe returns a one-line summary of the actions in p.
+func (p *Plan) describe() string {
+	parts := []string{
+		fmt.Sprintf("%d to copy", p.count(actionCopy)),
+		fmt.Sprintf("%d to skip", p.count(actionSkip)),
+		fmt.Sprintf("%d to remove from the source", p.count(actionRemove)),
+		fmt.Sprintf("%d zombie edit files to delete", p.count(actionDeleteZombie)),
+	}
+	if n := p.count(actionPurgeTrash); n > 0 {
+		parts = append(parts, fmt.Sprintf("%d trash folders to purge", n))
+	}
+	return strings.Join(parts, ", ")
+}
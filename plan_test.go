@@ -0,0 +1,288 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemovableSources(t *testing.T) {
+	actions := []Action{
+		{Kind: actionCopy, Src: "a.arw", Dst: "dst/a.arw", Reason: reasonNew},
+		{Kind: actionSkip, Src: "b.arw", Dst: "dst/b.arw", Reason: reasonIdentical},
+		{Kind: actionSkip, Src: "c.arw", Dst: "dst/c.arw", Reason: reasonDifferent},
+		{Kind: actionSkip, Src: "d.arw", Dst: "dst/d.arw", Reason: reasonResumed},
+		{Kind: actionCopy, Src: "a.jpg", Dst: "dst-jpg/a.jpg", Reason: reasonNew},
+		// the same file copied to two places, one of which is taken
+		{Kind: actionCopy, Src: "e.jpg", Dst: "dst-jpg/e.jpg", Reason: reasonNew},
+		{Kind: actionSkip, Src: "e.jpg", Dst: "backup/e.jpg", Reason: reasonDifferent},
+		{Kind: actionDeleteZombie, Dst: "dst/z.xmp", Reason: reasonZombie},
+	}
+
+	assert.Equal(t, []string{"a.arw", "b.arw", "d.arw", "a.jpg"}, removableSources(actions))
+}
+
+// planTestFiles are a card and library covering every kind of action.
+var planTestFiles = map[string]string{
+	"src/new.arw":       "new",
+	"src/same.arw":      "same",
+	"dst/same.arw":      "same",
+	"src/collision.arw": "card version",
+	"dst/collision.arw": "library version",
+	"dst/new.xmp":       "edit of a RAW about to be copied",
+	"dst/zombie.xmp":    "edit of a deleted RAW",
+}
+
+func TestCleanSDCardDryRunPlansEverything(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystemWith(planTestFiles)
+	planPath := filepath.Join(t.TempDir(), "plan.json")
+
+	report, err := cleanSDCard(
+		ctx,
+		fsys,
+		[]string{"xmp"},
+		testProfile,
+		"src",
+		"dst",
+		"dst-jpg",
+		"dst-video",
+		Options{DryRun: true, KeepSrc: false, DeleteZombieEditFiles: true, Concurrency: testConcurrency, PlanOut: planPath},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Copied)
+	assert.Equal(t, 3, report.Removed, "two source files and a zombie edit file")
+
+	_, ok := fsys.readFile(filepath.Join("dst", "new.arw"))
+	assert.False(t, ok, "a dry run must not copy")
+	_, ok = fsys.readFile(filepath.Join("dst", "zombie.xmp"))
+	assert.True(t, ok, "a dry run must not delete")
+
+	plan, err := loadPlan(planPath)
+	require.NoError(t, err)
+	assert.Equal(t, "test", plan.Profile)
+	assert.Equal(t, []Action{
+		{Kind: actionSkip, Src: filepath.Join("src", "collision.arw"), Dst: filepath.Join("dst", "collision.arw"), Size: int64(len("card version")), Reason: reasonDifferent},
+		{Kind: actionCopy, Src: filepath.Join("src", "new.arw"), Dst: filepath.Join("dst", "new.arw"), Size: int64(len("new")), Reason: reasonNew},
+		{Kind: actionSkip, Src: filepath.Join("src", "same.arw"), Dst: filepath.Join("dst", "same.arw"), Size: int64(len("same")), Reason: reasonIdentical},
+		{Kind: actionRemove, Src: filepath.Join("src", "new.arw"), Reason: reasonSafe},
+		{Kind: actionRemove, Src: filepath.Join("src", "same.arw"), Reason: reasonSafe},
+		{Kind: actionDeleteZombie, Dst: filepath.Join("dst", "zombie.xmp"), Reason: reasonZombie},
+	}, plan.Actions)
+}
+
+func TestCleanSDCardDryRunCountsMatchRealRun(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystemWith(planTestFiles)
+	run := func(dryRun bool) (int, int) {
+		report, err := cleanSDCard(
+			ctx,
+			fsys,
+			[]string{"xmp"},
+			testProfile,
+			"src",
+			"dst",
+			"dst-jpg",
+			"dst-video",
+			Options{DryRun: dryRun, KeepSrc: false, DeleteZombieEditFiles: true, Concurrency: testConcurrency},
+		)
+		require.NoError(t, err)
+		return report.Copied, report.Removed
+	}
+
+	wouldCopy, wouldRemove := run(true)
+	copied, removed := run(false)
+	assert.Equal(t, copied, wouldCopy)
+	assert.Equal(t, removed, wouldRemove)
+}
+
+func TestPlanCleanZombies(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystemWith(planTestFiles)
+
+	plan, err := planCleanZombies(ctx, fsys, []string{"xmp"}, testProfile, "dst", Options{Trash: true, Concurrency: testConcurrency})
+	require.NoError(t, err)
+	assert.Empty(t, plan.JournalDir, "zombie cleanup must leave the import journal alone")
+	// Without a card, there are no incoming RAWs: new.xmp is a zombie too.
+	assert.Equal(t, []string{filepath.Join("dst", "new.xmp"), filepath.Join("dst", "zombie.xmp")}, actionPaths(plan.Actions))
+	for _, a := range plan.Actions {
+		assert.Equal(t, actionDeleteZombie, a.Kind)
+		assert.NotEmpty(t, a.Trash)
+	}
+}
+
+func TestPlanImportKeepsEditsOfOtherCamerasRAWs(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystemWith(map[string]string{
+		"card/DCIM/100MSDCF/DSC00001.ARW": "sony raw",
+		"dst/IMG_0001.cr3":                "canon raw",
+		"dst/IMG_0001.xmp":                "edit of the canon raw",
+		"dst/DSC_0001.nef":                "nikon raw",
+		"dst/DSC_0001.xmp":                "edit of the nikon raw",
+		"dst/zombie.xmp":                  "edit of a deleted RAW",
+	})
+	auto, err := lookupProfile(profileAuto)
+	require.NoError(t, err)
+
+	plan, err := planImport(ctx, fsys, []string{"xmp"}, auto, "card", "dst", "dst-jpg", "dst-video",
+		Options{KeepSrc: true, DeleteZombieEditFiles: true, Concurrency: testConcurrency})
+	require.NoError(t, err)
+	assert.Equal(t, "sony", plan.Profile)
+	var zombies []string
+	for _, a := range plan.Actions {
+		if a.Kind == actionDeleteZombie {
+			zombies = append(zombies, a.Dst)
+		}
+	}
+	assert.Equal(t, []string{filepath.Join("dst", "zombie.xmp")}, zombies, "edits of other cameras' RAWs are not zombies")
+	assert.Contains(t, plan.RawExtensions, "cr3", "the execute-time check looks for them too")
+}
+
+func TestPlanWipeSource(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystemWith(planTestFiles)
+
+	plan, err := planWipeSource(ctx, fsys, testProfile, "src", "dst", "dst-jpg", "dst-video", Options{KeepSrc: true, Concurrency: testConcurrency})
+	require.NoError(t, err)
+	assert.Equal(t, 0, plan.count(actionCopy))
+	assert.Empty(t, plan.JournalDir)
+	assert.Empty(t, plan.DstDirs)
+
+	var removed []string
+	for _, a := range plan.Actions {
+		if a.Kind == actionRemove {
+			removed = append(removed, a.Src)
+		}
+	}
+	assert.Equal(t, []string{filepath.Join("src", "same.arw")}, removed, "only files already in the library")
+
+	report, err := runPlan(ctx, fsys, plan, Options{Concurrency: testConcurrency})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Removed)
+	_, ok := fsys.readFile(filepath.Join("dst", "new.arw"))
+	assert.False(t, ok, "wipe-source copies nothing")
+	_, ok = fsys.readFile(filepath.Join("src", "new.arw"))
+	assert.True(t, ok)
+}
+
+// actionPaths returns the path each of actions acts on: Dst for zombie
+// deletions and trash purges, Src otherwise.
+func actionPaths(actions []Action) []string {
+	paths := make([]string, len(actions))
+	for i, a := range actions {
+		if a.Kind == actionDeleteZombie || a.Kind == actionPurgeTrash {
+			paths[i] = a.Dst
+		} else {
+			paths[i] = a.Src
+		}
+	}
+	return paths
+}
+
+func TestApplyPlan(t *testing.T) {
+	ctx := t.Context()
+	planned := func(t *testing.T, fsys *fakeFileSystem) *Plan {
+		t.Helper()
+		planPath := filepath.Join(t.TempDir(), "plan.json")
+		_, err := cleanSDCard(
+			ctx,
+			fsys,
+			[]string{"xmp"},
+			testProfile,
+			"src",
+			"dst",
+			"dst-jpg",
+			"dst-video",
+			Options{DryRun: true, KeepSrc: false, DeleteZombieEditFiles: true, Concurrency: testConcurrency, PlanOut: planPath},
+		)
+		require.NoError(t, err)
+		plan, err := loadPlan(planPath)
+		require.NoError(t, err)
+		return plan
+	}
+
+	t.Run("carries out the plan", func(t *testing.T) {
+		fsys := newFakeFileSystemWith(planTestFiles)
+		plan := planned(t, fsys)
+
+		report, err := runPlan(ctx, fsys, plan, Options{Concurrency: testConcurrency})
+		require.NoError(t, err)
+		assert.Equal(t, 1, report.Copied)
+		assert.Equal(t, 3, report.Removed)
+
+		content, _ := fsys.readFile(filepath.Join("dst", "new.arw"))
+		assert.Equal(t, "new", content)
+		for path, want := range map[string]bool{
+			filepath.Join("src", "new.arw"):       false,
+			filepath.Join("src", "same.arw"):      false,
+			filepath.Join("src", "collision.arw"): true,
+			filepath.Join("dst", "new.xmp"):       true,
+			filepath.Join("dst", "zombie.xmp"):    false,
+		} {
+			_, ok := fsys.readFile(path)
+			assert.Equal(t, want, ok, "%s should exist: %t", path, want)
+		}
+	})
+
+	t.Run("does not overwrite a file that appeared since planning", func(t *testing.T) {
+		fsys := newFakeFileSystemWith(planTestFiles)
+		plan := planned(t, fsys)
+		fsys.addFile(filepath.Join("dst", "new.arw"), "imported some other way")
+
+		report, err := runPlan(ctx, fsys, plan, Options{Concurrency: testConcurrency})
+		assert.ErrorIs(t, err, errDestinationExists)
+		assert.Equal(t, 0, report.Removed)
+
+		content, _ := fsys.readFile(filepath.Join("dst", "new.arw"))
+		assert.Equal(t, "imported some other way", content)
+		_, ok := fsys.readFile(filepath.Join("src", "new.arw"))
+		assert.True(t, ok)
+	})
+
+	t.Run("keeps sources whose copy has gone and zombies whose RAW has appeared", func(t *testing.T) {
+		fsys := newFakeFileSystemWith(planTestFiles)
+		plan := planned(t, fsys)
+		require.NoError(t, fsys.Remove(filepath.Join("dst", "same.arw")))
+		fsys.addFile(filepath.Join("dst", "zombie.arw"), "raw")
+
+		report, err := runPlan(ctx, fsys, plan, Options{Concurrency: testConcurrency})
+		require.NoError(t, err)
+		assert.Equal(t, 1, report.Removed)
+
+		_, ok := fsys.readFile(filepath.Join("src", "same.arw"))
+		assert.True(t, ok)
+		_, ok = fsys.readFile(filepath.Join("dst", "zombie.xmp"))
+		assert.True(t, ok)
+	})
+}
+
+func TestLoadPlanRejectsInvalidPlans(t *testing.T) {
+	// dirs are the directories of a plan made for importing from src to dst
+	const dirs = `"version": 3, "src-dirs": ["src"], "dst-dirs": ["dst"], "record-dir": "dst", "edit-extensions": ["xmp"]`
+	for name, content := range map[string]string{
+		"other version":          `{"version": 2, "actions": []}`,
+		"unknown action":         `{` + dirs + `, "actions": [{"kind": "format-card", "reason": "why not"}]}`,
+		"missing path":           `{` + dirs + `, "actions": [{"kind": "copy", "src": "src/a.arw", "reason": "new"}]}`,
+		"purge outside trash":    `{` + dirs + `, "actions": [{"kind": "purge-trash", "dst": "dst/2026", "reason": "expired"}]}`,
+		"purge of trash":         `{` + dirs + `, "actions": [{"kind": "purge-trash", "dst": "dst/.clean-sd-card-trash", "reason": "expired"}]}`,
+		"purge of other trash":   `{` + dirs + `, "actions": [{"kind": "purge-trash", "dst": "other/.clean-sd-card-trash/2026-01-02", "reason": "expired"}]}`,
+		"zombie not an edit":     `{` + dirs + `, "actions": [{"kind": "delete-zombie", "dst": "dst/a.arw", "reason": "zombie"}]}`,
+		"zombie outside library": `{` + dirs + `, "actions": [{"kind": "delete-zombie", "dst": "other/a.xmp", "reason": "zombie"}]}`,
+		"trash outside trash":    `{` + dirs + `, "actions": [{"kind": "remove", "src": "src/a.arw", "trash": "dst/a.arw", "reason": "safe"}]}`,
+		"remove outside source":  `{` + dirs + `, "actions": [{"kind": "remove", "src": "home/notes.txt", "reason": "safe"}]}`,
+		"skip outside source":    `{` + dirs + `, "actions": [{"kind": "skip", "src": "src/../home/notes.txt", "dst": "dst/notes.txt", "reason": "identical"}]}`,
+		"copy outside dst":       `{` + dirs + `, "actions": [{"kind": "copy", "src": "src/a.arw", "dst": "dst/../home/a.arw", "reason": "new"}]}`,
+		"skip outside dst":       `{` + dirs + `, "actions": [{"kind": "skip", "src": "src/a.arw", "dst": "home/a.arw", "reason": "identical"}]}`,
+		"not JSON":               `copy everything`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "plan.json")
+			require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+			_, err := loadPlan(path)
+			assert.Error(t, err)
+		})
+	}
+}
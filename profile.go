@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// profileAuto is the -profile value that infers the camera profile from what
+// is on the card (see detectProfile).
+const profileAuto = "auto"
+
+// cameraProfile describes the files a camera vendor writes to a card and
+// where it puts them.
+type cameraProfile struct {
+	Name string
+	// RawExtensions are copied to the RAW destination.
+	RawExtensions []string
+	// ImageExtensions (JPEG, HEIF) are copied to the JPG destination.
+	ImageExtensions []string
+	// VideoExtensions are copied to the video destination.
+	VideoExtensions []string
+	// SidecarExtensions are metadata files the camera writes next to a
+	// video clip, e.g. Sony's C0001M01.XML, copied along with the clip.
+	SidecarExtensions []string
+	// VideoDirs are where the camera keeps video clips outside DCIM,
+	// slash-separated and relative to the card root.
+	VideoDirs []string
+	// FolderPattern matches the DCF folder names the vendor's cameras use.
+	// It is only used to recognize the camera in auto mode: every DCF folder
+	// is imported regardless (see dcfFolderPattern).
+	FolderPattern *regexp.Regexp
+}
+
+// builtinProfiles are the camera profiles -profile can select by name.
+var builtinProfiles = []cameraProfile{
+	{
+		Name:              "sony",
+		RawExtensions:     []string{"arw", "raw", "srf", "sr2"},
+		ImageExtensions:   []string{"jpg", "jpeg", "hif", "heif"},
+		VideoExtensions:   []string{"mp4"},
+		SidecarExtensions: []string{"xml"},
+		VideoDirs:         []string{"PRIVATE/M4ROOT/CLIP"},
+		FolderPattern:     regexp.MustCompile(`^[1-9][0-9]{2}MSDCF$`),
+	},
+	{
+		Name:            "canon",
+		RawExtensions:   []string{"cr3", "cr2"},
+		ImageExtensions: []string{"jpg", "jpeg", "hif", "heif"},
+		VideoExtensions: []string{"mp4", "mov"},
+		FolderPattern:   regexp.MustCompile(`^[1-9][0-9]{2}(CANON|EOS.{2})$`),
+	},
+	{
+		Name:            "nikon",
+		RawExtensions:   []string{"nef", "nrw"},
+		ImageExtensions: []string{"jpg", "jpeg", "hif", "heif"},
+		VideoExtensions: []string{"mov", "mp4"},
+		FolderPattern:   regexp.MustCompile(`^[1-9][0-9]{2}(NIKON|NZ_.{2}|NCZ_.|ND.{3})$`),
+	},
+	{
+		Name:            "fujifilm",
+		RawExtensions:   []string{"raf"},
+		ImageExtensions: []string{"jpg", "jpeg", "hif", "heif"},
+		VideoExtensions: []string{"mov", "mp4"},
+		FolderPattern:   regexp.MustCompile(`^[1-9][0-9]{2}_FUJI$`),
+	},
+	{
+		Name:            "panasonic",
+		RawExtensions:   []string{"rw2", "raw"},
+		ImageExtensions: []string{"jpg", "jpeg", "hsp"},
+		VideoExtensions: []string{"mp4", "mov", "mts"},
+		VideoDirs:       []string{"PRIVATE/AVCHD/BDMV/STREAM"},
+		FolderPattern:   regexp.MustCompile(`^[1-9][0-9]{2}_PANA$`),
+	},
+	{
+		Name:            "olympus",
+		RawExtensions:   []string{"orf", "ori"},
+		ImageExtensions: []string{"jpg", "jpeg"},
+		VideoExtensions: []string{"mov", "mp4"},
+		FolderPattern:   regexp.MustCompile(`^[1-9][0-9]{2}(OLYMP|OMSYS)$`),
+	},
+	{
+		// Leica, Pentax, Ricoh, Hasselblad, phones, ...: anything that
+		// writes Adobe DNG as its RAW format.
+		Name:            "dng",
+		RawExtensions:   []string{"dng"},
+		ImageExtensions: []string{"jpg", "jpeg", "heic", "heif"},
+		VideoExtensions: []string{"mov", "mp4"},
+	},
+}
+
+// lookupProfile returns the built-in profile called name. For profileAuto it
+// returns a profile covering every built-in one, to discover the card with
+// before detectProfile narrows it down.
+func lookupProfile(name string) (cameraProfile, error) {
+	if name == profileAuto {
+		return mergeProfiles(profileAuto, builtinProfiles), nil
+	}
+	for _, p := range builtinProfiles {
+		if strings.EqualFold(p.Name, name) {
+			return p, nil
+		}
+	}
+	return cameraProfile{}, fmt.Errorf("unknown camera profile %q (known: %s, %s)", name, profileAuto, strings.Join(profileNames(), ", "))
+}
+
+// profileNames returns the names of the built-in profiles.
+func profileNames() []string {
+	names := make([]string, len(builtinProfiles))
+	for i, p := range builtinProfiles {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// libraryRawExtensions returns what the RAW of an edit file in the library may
+// be named with: the RAW extensions of profile, which may be configured, and
+// of every built-in profile, since the library holds RAWs from every camera,
+// not just the one whose card is imported.
+func libraryRawExtensions(profile cameraProfile) []string {
+	return mergeProfiles(profile.Name, append([]cameraProfile{profile}, builtinProfiles...)).RawExtensions
+}
+
+// mergeProfiles returns a profile named name that covers every extension and
+// video directory of profiles.
+func mergeProfiles(name string, profiles []cameraProfile) cameraProfile {
+	merged := cameraProfile{Name: name}
+	union := func(dst []string, src []string) []string {
+		for _, s := range src {
+			if !slices.Contains(dst, s) {
+				dst = append(dst, s)
+			}
+		}
+		return dst
+	}
+	for _, p := range profiles {
+		merged.RawExtensions = union(merged.RawExtensions, p.RawExtensions)
+		merged.ImageExtensions = union(merged.ImageExtensions, p.ImageExtensions)
+		merged.VideoExtensions = union(merged.VideoExtensions, p.VideoExtensions)
+		merged.SidecarExtensions = union(merged.SidecarExtensions, p.SidecarExtensions)
+		merged.VideoDirs = union(merged.VideoDirs, p.VideoDirs)
+	}
+	return merged
+}
+
+// detectProfile infers which built-in profile's camera wrote dirs, from the
+// DCF folder names, video directories and RAW extensions found there. It
+// returns false if no profile matches or the evidence is tied between
+// several.
+func detectProfile(dirs []sourceDir) (cameraProfile, bool) {
+	// A vendor's folder naming or video directory is much stronger evidence
+	// than any number of files with a given extension.
+	const structureWeight = 1000
+
+	scores := make([]int, len(builtinProfiles))
+	for _, dir := range dirs {
+		for i, p := range builtinProfiles {
+			if p.FolderPattern != nil && p.FolderPattern.MatchString(filepath.Base(dir.Path)) {
+				scores[i] += structureWeight
+			}
+			for _, videoDir := range p.VideoDirs {
+				if strings.HasSuffix(strings.ToUpper("/"+filepath.ToSlash(dir.Path)), "/"+strings.ToUpper(videoDir)) {
+					scores[i] += structureWeight
+				}
+			}
+			for _, entry := range dir.Entries {
+				if !entry.IsDir() && matchesAnyExtension(entry.Name(), p.RawExtensions) {
+					scores[i]++
+				}
+			}
+		}
+	}
+
+	order := make([]int, len(builtinProfiles))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return scores[order[a]] > scores[order[b]] })
+	best := order[0]
+	if scores[best] == 0 || scores[order[1]] == scores[best] {
+		return cameraProfile{}, false
+	}
+	return builtinProfiles[best], true
+}
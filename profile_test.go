@@ -0,0 +1,102 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupProfile(t *testing.T) {
+	for _, name := range profileNames() {
+		p, err := lookupProfile(name)
+		require.NoError(t, err)
+		assert.Equal(t, name, p.Name)
+		assert.NotEmpty(t, p.RawExtensions)
+	}
+
+	auto, err := lookupProfile(profileAuto)
+	require.NoError(t, err)
+	assert.Subset(t, auto.RawExtensions, []string{"arw", "cr3", "cr2", "nef", "nrw", "raf", "rw2", "orf", "dng"})
+	assert.Subset(t, auto.ImageExtensions, []string{"jpg", "hif", "heic"})
+
+	_, err = lookupProfile("polaroid")
+	assert.Error(t, err)
+}
+
+func TestDetectProfile(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  string
+	}{
+		{"sony by folder name", []string{"DCIM/100MSDCF/DSC00001.JPG"}, "sony"},
+		{"sony by video directory", []string{"PRIVATE/M4ROOT/CLIP/C0001.MP4"}, "sony"},
+		{"canon by folder name", []string{"DCIM/100CANON/IMG_0001.CR3"}, "canon"},
+		{"nikon Z by folder name", []string{"DCIM/100NZ_50/DSC_0001.NEF"}, "nikon"},
+		{"fujifilm by folder name", []string{"DCIM/100_FUJI/DSCF0001.RAF"}, "fujifilm"},
+		{"dng by extension", []string{"DCIM/100LEICA/L1000001.DNG"}, "dng"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := newFakeFileSystem()
+			for _, f := range tt.files {
+				fsys.addFile(filepath.Join("card", filepath.FromSlash(f)), "content")
+			}
+			auto, err := lookupProfile(profileAuto)
+			require.NoError(t, err)
+			dirs, err := discoverSourceDirs(fsys, "card", auto.VideoDirs)
+			require.NoError(t, err)
+
+			p, ok := detectProfile(dirs)
+			require.True(t, ok)
+			assert.Equal(t, tt.want, p.Name)
+		})
+	}
+
+	t.Run("nothing recognizable", func(t *testing.T) {
+		fsys := newFakeFileSystem()
+		fsys.addFile(filepath.Join("card", "DCIM", "100PHOTO", "IMG_0001.JPG"), "content")
+		dirs, err := discoverSourceDirs(fsys, "card", nil)
+		require.NoError(t, err)
+
+		_, ok := detectProfile(dirs)
+		assert.False(t, ok)
+	})
+}
+
+func TestCleanSDCardAutoProfile(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	dcf := filepath.Join("card", "DCIM", "100NIKON")
+	fsys.addFile(filepath.Join(dcf, "DSC_0001.NEF"), "raw")
+	fsys.addFile(filepath.Join(dcf, "DSC_0001.JPG"), "jpg")
+	// not something a Nikon writes, so not imported once the card is
+	// recognized as a Nikon's
+	fsys.addFile(filepath.Join(dcf, "DSC_0002.ARW"), "raw")
+
+	auto, err := lookupProfile(profileAuto)
+	require.NoError(t, err)
+
+	report, err := cleanSDCard(
+		ctx,
+		fsys,
+		[]string{"xmp"},
+		auto,
+		"card",
+		"dst",
+		"dst-jpg",
+		"dst-video",
+		Options{KeepJPG: true, KeepSrc: true, Concurrency: testConcurrency},
+	)
+
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Copied)
+	_, ok := fsys.readFile(filepath.Join("dst", "DSC_0001.NEF"))
+	assert.True(t, ok)
+	_, ok = fsys.readFile(filepath.Join("dst-jpg", "DSC_0001.JPG"))
+	assert.True(t, ok)
+	_, ok = fsys.readFile(filepath.Join("dst", "DSC_0002.ARW"))
+	assert.False(t, ok)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// progressRedrawInterval is how often the progress line is redrawn on a
+	// terminal.
+	progressRedrawInterval = 250 * time.Millisecond
+	// progressLogInterval is how often progress is logged when the output
+	// isn't a terminal, where a redrawn line would pile up in the log.
+	progressLogInterval = 10 * time.Second
+	// progressRateSmoothing is the weight of the latest throughput sample
+	// against the earlier ones, so that the ETA doesn't jump with every
+	// slow read from the card.
+	progressRateSmoothing = 0.3
+)
+
+// progress shows how far the copies of a run have got while they run: files
+// and bytes done out of the total, the current throughput, the time left at
+// that rate, and the file each worker is copying. On a terminal it is one
+// line redrawn in place; otherwise it is logged every so often.
+// A nil *progress shows nothing, so callers needn't check.
+type progress struct {
+	out      io.Writer
+	tty      bool
+	interval time.Duration
+	// logOut is where log lines went before the progress line took over
+	// logOutput (see start), on a terminal.
+	logOut io.Writer
+
+	mu         sync.Mutex
+	filesTotal int
+	filesDone  int
+	bytesTotal int64
+	bytesDone  int64
+	// copying are the files being copied, in the order they were started.
+	copying []*fileProgress
+	// lastTime and lastBytes are when the throughput was last sampled and
+	// bytesDone then; rate is the smoothed throughput in bytes per second.
+	lastTime  time.Time
+	lastBytes int64
+	rate      float64
+	// shown is whether the progress line is on the terminal.
+	shown bool
+
+	stopped chan struct{}
+	done    sync.WaitGroup
+}
+
+// fileProgress is one file being copied.
+type fileProgress struct {
+	p    *progress
+	name string
+	size int64
+	read int64
+}
+
+// newProgress returns a progress for copying files files of bytes bytes in
+// total, shown on out, or nil if out is nil. A progress on a terminal (see
+// isTerminal) redraws its line; one on anything else logs a line now and
+// then.
+func newProgress(out io.Writer, files int, bytes int64) *progress {
+	if out == nil {
+		return nil
+	}
+	p := &progress{out: out, tty: isTerminal(out), filesTotal: files, bytesTotal: bytes}
+	p.interval = progressLogInterval
+	if p.tty {
+		p.interval = progressRedrawInterval
+	}
+	return p
+}
+
+// isTerminal reports whether w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// start starts showing the progress until stop is called. On a terminal, log
+// lines are written above the progress line from then on rather than over
+// it.
+func (p *progress) start() {
+	if p == nil {
+		return
+	}
+	p.lastTime = time.Now()
+	if p.tty {
+		p.logOut = logOutput.swap(p)
+	}
+	p.stopped = make(chan struct{})
+	p.done.Go(func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stopped:
+				return
+			case now := <-ticker.C:
+				p.show(now)
+			}
+		}
+	})
+}
+
+// stop stops showing the progress, showing it one last time, and gives
+// logOutput back.
+func (p *progress) stop() {
+	if p == nil {
+		return
+	}
+	close(p.stopped)
+	p.done.Wait()
+	p.show(time.Now())
+	if p.tty {
+		p.mu.Lock()
+		fmt.Fprintln(p.out)
+		p.shown = false
+		p.mu.Unlock()
+		logOutput.swap(p.logOut)
+	}
+}
+
+// startFile records that a copy of the file at path, of size bytes, has
+// started. The bytes read from it are to be reported to the returned
+// fileProgress's add, and the copy's end to finishFile.
+func (p *progress) startFile(path string, size int64) *fileProgress {
+	if p == nil {
+		return nil
+	}
+	f := &fileProgress{p: p, name: filepath.Base(path), size: size}
+	p.mu.Lock()
+	p.copying = append(p.copying, f)
+	p.mu.Unlock()
+	return f
+}
+
+// add records that n more bytes of f have been read.
+func (f *fileProgress) add(n int64) {
+	if f == nil {
+		return
+	}
+	f.p.mu.Lock()
+	f.read += n
+	f.p.bytesDone += n
+	f.p.mu.Unlock()
+}
+
+// onRead returns f's add as a FileSystem.CopyFile callback, or nil if f is
+// nil.
+func (f *fileProgress) onRead() func(n int64) {
+	if f == nil {
+		return nil
+	}
+	return f.add
+}
+
+// finishFile records the end of f's copy. A copy that failed is taken out of
+// the totals, as it won't be done in this run.
+func (p *progress) finishFile(f *fileProgress, ok bool) {
+	if p == nil || f == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, c := range p.copying {
+		if c == f {
+			p.copying = append(p.copying[:i], p.copying[i+1:]...)
+			break
+		}
+	}
+	if ok {
+		p.filesDone++
+		// the file may have changed size since it was planned
+		p.bytesDone += f.size - f.read
+		return
+	}
+	p.filesTotal--
+	p.bytesTotal -= f.size
+	p.bytesDone -= f.read
+}
+
+// Write writes a log line above the progress line, on a terminal, where it
+// is what logOutput writes to while the progress is shown (see start).
+func (p *progress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.shown {
+		fmt.Fprint(p.out, "\r\033[K")
+	}
+	n, err := p.logOut.Write(b)
+	if p.shown {
+		fmt.Fprint(p.out, p.line())
+	}
+	return n, err
+}
+
+// show samples the throughput at now and shows the progress: redraws the
+// line on a terminal, or logs it.
+func (p *progress) show(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sample(now)
+	if p.tty {
+		fmt.Fprint(p.out, "\r\033[K"+p.line())
+		p.shown = true
+		return
+	}
+	fmt.Fprintf(p.out, "%s progress: %s\n", now.Format("2006/01/02 15:04:05"), p.line())
+}
+
+// sample updates the smoothed throughput with the bytes read since the last
+// sample.
+func (p *progress) sample(now time.Time) {
+	elapsed := now.Sub(p.lastTime).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	current := max(float64(p.bytesDone-p.lastBytes)/elapsed, 0)
+	if p.rate == 0 {
+		p.rate = current
+	} else {
+		p.rate = progressRateSmoothing*current + (1-progressRateSmoothing)*p.rate
+	}
+	p.lastTime, p.lastBytes = now, p.bytesDone
+}
+
+// line returns the progress as a line of text, e.g.
+// "12/340 files, 720.0 MB/20.4 GB, 85.3 MB/s, ETA 3m57s: DSC00013.ARW 40%".
+func (p *progress) line() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d/%d files, %s/%s, %s/s", p.filesDone, p.filesTotal,
+		formatBytes(p.bytesDone), formatBytes(p.bytesTotal), formatBytes(int64(p.rate)))
+	if p.rate > 0 {
+		left := time.Duration(float64(p.bytesTotal-p.bytesDone) / p.rate * float64(time.Second))
+		fmt.Fprintf(&b, ", ETA %s", max(left, 0).Round(time.Second))
+	} else {
+		b.WriteString(", ETA unknown")
+	}
+	for i, f := range p.copying {
+		if i == 0 {
+			b.WriteString(": ")
+		} else {
+			b.WriteString(", ")
+		}
+		percent := int64(100)
+		if f.size > 0 {
+			percent = min(f.read*100/f.size, 100)
+		}
+		fmt.Fprintf(&b, "%s %d%%", f.name, percent)
+	}
+	return b.String()
+}
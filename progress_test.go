@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgressLine(t *testing.T) {
+	p := newProgress(&bytes.Buffer{}, 3, 300<<20)
+	start := time.Now()
+	p.lastTime = start
+
+	a := p.startFile(filepath.Join("src", "DSC00001.ARW"), 100<<20)
+	b := p.startFile(filepath.Join("src", "DSC00002.ARW"), 100<<20)
+	a.add(100 << 20)
+	b.add(50 << 20)
+	p.finishFile(a, true)
+	p.sample(start.Add(3 * time.Second))
+
+	assert.Equal(t, "1/3 files, 150.0 MB/300.0 MB, 50.0 MB/s, ETA 3s: DSC00002.ARW 50%", p.line())
+}
+
+func TestProgressFailedCopyLeavesTotals(t *testing.T) {
+	p := newProgress(&bytes.Buffer{}, 2, 200)
+	p.lastTime = time.Now()
+
+	a := p.startFile("a.arw", 100)
+	a.add(40)
+	p.finishFile(a, false)
+	b := p.startFile("b.arw", 100)
+	b.add(100)
+	p.finishFile(b, true)
+
+	assert.Equal(t, 1, p.filesDone)
+	assert.Equal(t, 1, p.filesTotal, "a failed copy isn't waited for")
+	assert.Equal(t, int64(100), p.bytesDone)
+	assert.Equal(t, int64(100), p.bytesTotal)
+	assert.Empty(t, p.copying)
+}
+
+func TestProgressWritesLogLinesAboveTheLine(t *testing.T) {
+	var out, logOut bytes.Buffer
+	p := &progress{out: &out, tty: true, logOut: &logOut, filesTotal: 1, bytesTotal: 10}
+	p.show(time.Now())
+	out.Reset()
+
+	_, err := p.Write([]byte("copied a.arw\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "copied a.arw\n", logOut.String())
+	assert.Equal(t, "\r\033[K0/1 files, 0 B/10 B, 0 B/s, ETA unknown", out.String(), "the line is cleared and redrawn")
+}
+
+func TestCleanSDCardLogsProgress(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	fsys.addFile(filepath.Join("src", "a.arw"), "raw a")
+	fsys.addFile(filepath.Join("src", "b.arw"), "raw b")
+
+	var out bytes.Buffer
+	report, err := cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "src", "dst", "dst-jpg", "dst-video",
+		Options{KeepSrc: true, Progress: &out, Concurrency: testConcurrency})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Copied)
+	assert.Contains(t, out.String(), "progress: 2/2 files, 10 B/10 B")
+	assert.Equal(t, 1, bytes.Count(out.Bytes(), []byte("\n")), "a quick run logs its progress once, when done")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// reportVersion is the version of the report format (see saveReport), for
+// scripts to check.
+const reportVersion = 1
+
+// Report is what a run did, file by file, for scripts to consume instead of
+// the log (see -report). A run that fails still returns its report, covering
+// what it did before it stopped.
+type Report struct {
+	Version  int       `json:"version"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// DryRun is set if nothing was done: Files are what a real run would
+	// do, and Copied and Removed how many files it would copy and remove.
+	DryRun bool `json:"dry-run,omitempty"`
+	// Copied is the number of files copied, and Removed the number of files
+	// removed: source files and zombie edit files.
+	Copied  int `json:"copied"`
+	Removed int `json:"removed"`
+	// Error is what the run failed with, if it did.
+	Error string `json:"error,omitempty"`
+	// Files are the actions done or attempted, in the order they ended.
+	// Actions not started because the run stopped before them aren't
+	// listed.
+	Files []FileReport `json:"files"`
+
+	mu sync.Mutex
+}
+
+// FileReport is what was done with one file: one Action of the run's plan.
+type FileReport struct {
+	Action ActionKind `json:"action"`
+	// Src, Dst and Trash are as in Action, with Trash the path the file was
+	// actually moved to.
+	Src   string `json:"src,omitempty"`
+	Dst   string `json:"dst,omitempty"`
+	Trash string `json:"trash,omitempty"`
+	Size  int64  `json:"size,omitempty"`
+	// SHA256 is the hex-encoded SHA-256 a copy was verified against.
+	SHA256 string `json:"sha256,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// DurationMS is how long the action took, in milliseconds.
+	DurationMS int64 `json:"duration-ms"`
+	// Error is what the action failed with, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// newReport returns the report of a run starting now.
+func newReport(dryRun bool) *Report {
+	return &Report{Version: reportVersion, Started: time.Now(), DryRun: dryRun, Files: []FileReport{}}
+}
+
+// record adds a to the report, done in took with the copy verified against
+// hash, or failed with err. A nil *Report records nothing.
+func (r *Report) record(a Action, hash string, took time.Duration, err error) {
+	if r == nil {
+		return
+	}
+	f := FileReport{
+		Action:     a.Kind,
+		Src:        a.Src,
+		Dst:        a.Dst,
+		Trash:      a.Trash,
+		Size:       a.Size,
+		SHA256:     hash,
+		Reason:     a.Reason,
+		DurationMS: took.Milliseconds(),
+	}
+	if err != nil {
+		f.Error = err.Error()
+	}
+	r.mu.Lock()
+	r.Files = append(r.Files, f)
+	r.mu.Unlock()
+}
+
+// finish marks the report finished now by a run that returned err, and
+// returns it with err, for the run to return.
+func (r *Report) finish(err error) (*Report, error) {
+	r.Finished = time.Now()
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r, err
+}
+
+// saveReport writes r to path as JSON.
+func saveReport(r *Report, path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to save report: %w", err)
+	}
+	return nil
+}
+
+// failed returns the actions of r that failed.
+func (r *Report) failed() []FileReport {
+	var failed []FileReport
+	for _, f := range r.Files {
+		if f.Error != "" {
+			failed = append(failed, f)
+		}
+	}
+	return failed
+}
+
+// printFailedFiles writes the actions of r that failed to w as a table, one
+// file per line with what it failed with, followed by their count.
+func printFailedFiles(w io.Writer, r *Report) error {
+	failed := r.failed()
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tFILE\tERROR")
+	for _, f := range failed {
+		// Zombie edit files and trash folders are in Dst; everything else
+		// is a source file.
+		file := f.Src
+		if file == "" {
+			file = f.Dst
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", f.Action, file, f.Error)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\n%d failed\n", len(failed))
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanSDCardReport(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeFileSystem()
+	fake.addFile(filepath.Join("src", "DSC00001.ARW"), "raw 1")
+	fake.addFile(filepath.Join("src", "DSC00002.ARW"), "raw 2")
+	fake.addFile(filepath.Join("src", "DSC00003.ARW"), "raw 3")
+	fake.addFile(filepath.Join("dst", "DSC00003.ARW"), "raw 3")
+	fsys := &corruptingFileSystem{fakeFileSystem: fake, corrupt: map[string]bool{"DSC00002.ARW": true}}
+
+	report, err := cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "src", "dst", "dst-jpg", "dst-video",
+		Options{KeepSrc: false, Concurrency: testConcurrency})
+	require.ErrorIs(t, err, errChecksumMismatch)
+	assert.Equal(t, 1, report.Copied)
+	assert.Contains(t, report.Error, "checksum mismatch")
+	assert.False(t, report.Finished.Before(report.Started))
+
+	files := report.Files
+	sort.Slice(files, func(i, j int) bool { return files[i].Src < files[j].Src })
+	require.Len(t, files, 3, "nothing is removed after a failed copy")
+
+	assert.Equal(t, actionCopy, files[0].Action)
+	assert.Equal(t, filepath.Join("dst", "DSC00001.ARW"), files[0].Dst)
+	assert.Equal(t, int64(len("raw 1")), files[0].Size)
+	assert.Equal(t, fakeHash([]byte("raw 1")), files[0].SHA256)
+	assert.Empty(t, files[0].Error)
+
+	assert.Equal(t, actionCopy, files[1].Action)
+	assert.Empty(t, files[1].SHA256)
+	assert.Contains(t, files[1].Error, "checksum mismatch")
+
+	assert.Equal(t, actionSkip, files[2].Action)
+	assert.Equal(t, reasonIdentical, files[2].Reason)
+}
+
+func TestCleanSDCardDryRunReport(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	fsys.addFile(filepath.Join("src", "DSC00001.ARW"), "raw 1")
+
+	report, err := cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "src", "dst", "dst-jpg", "dst-video",
+		Options{DryRun: true, KeepSrc: false, Concurrency: testConcurrency})
+	require.NoError(t, err)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, 1, report.Copied)
+	assert.Equal(t, 1, report.Removed)
+	require.Len(t, report.Files, 2)
+	assert.Equal(t, actionCopy, report.Files[0].Action)
+	assert.Equal(t, actionRemove, report.Files[1].Action)
+}
+
+func TestSaveReport(t *testing.T) {
+	report := newReport(false)
+	report.record(Action{Kind: actionCopy, Src: "src/a.arw", Dst: "dst/a.arw", Size: 3, Reason: reasonNew}, "abc", 0, nil)
+	report.Copied = 1
+	path := filepath.Join(t.TempDir(), "report.json")
+	require.NoError(t, saveReport(report, path))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var saved map[string]any
+	require.NoError(t, json.Unmarshal(data, &saved))
+	assert.Equal(t, float64(reportVersion), saved["version"])
+	assert.Equal(t, float64(1), saved["copied"])
+	files := saved["files"].([]any)
+	require.Len(t, files, 1)
+	assert.Equal(t, map[string]any{
+		"action":      "copy",
+		"src":         "src/a.arw",
+		"dst":         "dst/a.arw",
+		"size":        float64(3),
+		"sha256":      "abc",
+		"reason":      reasonNew,
+		"duration-ms": float64(0),
+	}, files[0])
+}
+
+func TestPrintFailedFiles(t *testing.T) {
+	report := newReport(false)
+	report.record(Action{Kind: actionCopy, Src: "src/DSC00001.ARW", Dst: "dst/DSC00001.ARW"}, "abc", 0, nil)
+	report.record(Action{Kind: actionCopy, Src: "src/DSC00002.ARW", Dst: "dst/DSC00002.ARW"}, "", 0, errFlaky)
+	report.record(Action{Kind: actionDeleteZombie, Dst: "dst/DSC00009.xmp"}, "", 0, errFlaky)
+
+	var out bytes.Buffer
+	require.NoError(t, printFailedFiles(&out, report))
+	assert.Equal(t, ""+
+		"ACTION         FILE              ERROR\n"+
+		"copy           src/DSC00002.ARW  card reader glitch\n"+
+		"delete-zombie  dst/DSC00009.xmp  card reader glitch\n"+
+		"\n"+
+		"2 failed\n", out.String())
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// runsDirName is the directory under the RAW destination directory that
+	// each run's record is kept in (see runRecord).
+	runsDirName = ".clean-sd-card-runs"
+	// runIDFormat is the layout of the start time a run's ID is made of.
+	runIDFormat = "20060102-150405"
+	// runRecordExt and undoneSuffix make up run record file names:
+	// <id>.jsonl, and <id>.undone.jsonl once undone.
+	runRecordExt = ".jsonl"
+	undoneSuffix = ".undone"
+)
+
+// runRecord is the record of what one run did: a JSON-lines file with one
+// Action per line, appended as each is done, so that the run can be undone
+// (see undoRun). Removals and zombie deletions are recorded with where in the
+// trash the file went, if it was trashed. The file is created on the first
+// action recorded, so a run that does nothing leaves no record. A nil
+// *runRecord records nothing.
+type runRecord struct {
+	fsys FileSystem
+	path string
+
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// newRunRecord returns the record of a run started at started, kept in dir.
+func newRunRecord(fsys FileSystem, dir string, started time.Time) *runRecord {
+	return &runRecord{fsys: fsys, path: filepath.Join(dir, runsDirName, started.Format(runIDFormat)+runRecordExt)}
+}
+
+// record appends a, which has just been done, to the record.
+func (r *runRecord) record(a Action) error {
+	if r == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		if err := r.fsys.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+			return fmt.Errorf("failed to create run record directory: %w", err)
+		}
+		// Another run started within the same second.
+		r.path = freePath(r.fsys, r.path)
+		w, err := r.fsys.AppendFile(r.path)
+		if err != nil {
+			return fmt.Errorf("failed to open run record: %w", err)
+		}
+		r.w = w
+	}
+	if _, err := r.w.Write(line); err != nil {
+		return fmt.Errorf("failed to write run record: %w", err)
+	}
+	if s, ok := r.w.(interface{ Sync() error }); ok {
+		if err := s.Sync(); err != nil {
+			return fmt.Errorf("failed to write run record: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the record file, if one was created.
+func (r *runRecord) Close() error {
+	if r == nil || r.w == nil {
+		return nil
+	}
+	return r.w.Close()
+}
+
+// runInfo is a run recorded in a destination directory.
+type runInfo struct {
+	ID     string
+	Undone bool
+	path   string
+}
+
+// listRuns returns the runs recorded in dir, oldest first. A missing record
+// directory is not an error: no runs are recorded.
+func listRuns(fsys FileSystem, dir string) ([]runInfo, error) {
+	runsDir := filepath.Join(dir, runsDirName)
+	entries, err := fsys.ReadDir(runsDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run records: %w", err)
+	}
+
+	var runs []runInfo
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), runRecordExt)
+		if entry.IsDir() || !ok {
+			continue
+		}
+		id, undone := strings.CutSuffix(id, undoneSuffix)
+		runs = append(runs, runInfo{ID: id, Undone: undone, path: filepath.Join(runsDir, entry.Name())})
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ID < runs[j].ID })
+	return runs, nil
+}
+
+// errNoRun is returned when there is no run to undo.
+var errNoRun = errors.New("no such run")
+
+// findRun returns the run called id among runs, or the most recent run not
+// undone yet if id is empty.
+func findRun(runs []runInfo, id string) (runInfo, error) {
+	for i := len(runs) - 1; i >= 0; i-- {
+		if id == "" && !runs[i].Undone || runs[i].ID == id {
+			return runs[i], nil
+		}
+	}
+	if id == "" {
+		return runInfo{}, fmt.Errorf("%w: every recorded run has been undone", errNoRun)
+	}
+	return runInfo{}, fmt.Errorf("%w: %s", errNoRun, id)
+}
+
+// readRunRecord reads the actions recorded for run. Lines that can't be read,
+// such as a partial last line left by a killed run, are skipped and logged to
+// logger.
+func readRunRecord(fsys FileSystem, run runInfo, logger *slog.Logger) ([]Action, error) {
+	f, err := fsys.Open(run.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run record: %w", err)
+	}
+	defer f.Close()
+
+	var actions []Action
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var a Action
+		if err := json.Unmarshal(scanner.Bytes(), &a); err != nil {
+			logger.Warn("skipping unreadable run record line", "run", run.ID, "line", lineNo, errAttr(err))
+			continue
+		}
+		actions = append(actions, a)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read run record: %w", err)
+	}
+	return actions, nil
+}
+
+// markUndone renames run's record so that it is no longer the most recent
+// run to undo.
+func markUndone(fsys FileSystem, run runInfo) error {
+	undonePath := filepath.Join(filepath.Dir(run.path), run.ID+undoneSuffix+runRecordExt)
+	if err := fsys.Rename(run.path, undonePath); err != nil {
+		return fmt.Errorf("failed to mark run %s undone: %w", run.ID, err)
+	}
+	return nil
+}
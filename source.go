@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// dcfFolderPattern matches DCF (Design rule for Camera File system) folder
+// names: a folder number from 100 to 999 followed by five free characters,
+// e.g. 100MSDCF, 101CANON, 102_FUJI. Cameras start a new folder when the
+// current one fills up (after 9999 shots on Sony bodies), so a card often
+// holds several. Every DCF folder is imported whatever the camera profile;
+// the vendor-specific patterns in cameraProfile are only used to recognize
+// the camera.
+var dcfFolderPattern = regexp.MustCompile(`^[1-9][0-9]{2}[0-9A-Za-z_]{5}$`)
+
+// sourceDir is a directory to import from and its listing. The listing is
+// read once and shared by every step that needs it, since source directories
+// are typically on a slow SD card.
+type sourceDir struct {
+	Path    string
+	Entries []os.DirEntry
+}
+
+// discoverSourceDirs works out which directories to import from given src,
+// which may be the card root, its DCIM directory, or a single folder:
+//   - if src contains a DCIM directory, every DCF folder in it;
+//   - otherwise, if src contains DCF folders, every one of them (src is DCIM);
+//   - otherwise src itself.
+//
+// When src is the card root or its DCIM directory, each of videoDirs
+// (slash-separated paths relative to the card root, e.g. PRIVATE/M4ROOT/CLIP;
+// see cameraProfile) that exists is returned too. Thumbnails and other files
+// elsewhere on the card are left alone.
+//
+// Every directory it looks at is listed exactly once, and the listings of the
+// returned directories are returned with them.
+func discoverSourceDirs(fsys FileSystem, src string, videoDirs []string) ([]sourceDir, error) {
+	entries, err := fsys.ReadDir(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source directory: %w", err)
+	}
+
+	var clipDirs []sourceDir
+	if len(videoDirs) > 0 && strings.EqualFold(filepath.Base(filepath.Clean(src)), "DCIM") {
+		// The video directories are next to DCIM, in the card root.
+		root := filepath.Dir(filepath.Clean(src))
+		rootEntries, err := fsys.ReadDir(root)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read card root: %w", err)
+		}
+		if clipDirs, err = findVideoDirs(fsys, root, rootEntries, videoDirs); err != nil {
+			return nil, err
+		}
+	} else if clipDirs, err = findVideoDirs(fsys, src, entries, videoDirs); err != nil {
+		return nil, err
+	}
+
+	dcimDir := src
+	for _, entry := range entries {
+		if entry.IsDir() && strings.EqualFold(entry.Name(), "DCIM") {
+			dcimDir = filepath.Join(src, entry.Name())
+			entries, err = fsys.ReadDir(dcimDir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read DCIM directory: %w", err)
+			}
+			break
+		}
+	}
+
+	var dirs []sourceDir
+	for _, entry := range entries {
+		if !entry.IsDir() || !dcfFolderPattern.MatchString(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dcimDir, entry.Name())
+		dcfEntries, err := fsys.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read DCF folder %s: %w", entry.Name(), err)
+		}
+		dirs = append(dirs, sourceDir{Path: path, Entries: dcfEntries})
+	}
+
+	if len(dirs) == 0 && dcimDir == src && len(clipDirs) == 0 {
+		return []sourceDir{{Path: src, Entries: entries}}, nil
+	}
+	return append(dirs, clipDirs...), nil
+}
+
+// findVideoDirs returns those of videoDirs (see discoverSourceDirs) that exist
+// under root, the card root, whose listing is entries, with their listings.
+func findVideoDirs(fsys FileSystem, root string, entries []os.DirEntry, videoDirs []string) ([]sourceDir, error) {
+	var clipDirs []sourceDir
+	for _, videoDir := range videoDirs {
+		top, rest, _ := strings.Cut(videoDir, "/")
+		for _, entry := range entries {
+			if !entry.IsDir() || !strings.EqualFold(entry.Name(), top) {
+				continue
+			}
+			clipDir := filepath.Join(root, entry.Name(), filepath.FromSlash(rest))
+			clipEntries, err := fsys.ReadDir(clipDir)
+			if errors.Is(err, os.ErrNotExist) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read video directory: %w", err)
+			}
+			clipDirs = append(clipDirs, sourceDir{Path: clipDir, Entries: clipEntries})
+			break
+		}
+	}
+	return clipDirs, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscoverSourceDirs(t *testing.T) {
+	newCard := func() *fakeFileSystem {
+		fsys := newFakeFileSystem()
+		fsys.addFile(filepath.Join("card", "DCIM", "100MSDCF", "DSC09999.ARW"), "content")
+		fsys.addFile(filepath.Join("card", "DCIM", "101MSDCF", "DSC00001.ARW"), "content")
+		fsys.addDir(filepath.Join("card", "DCIM", "CANONMSC"))
+		fsys.addFile(filepath.Join("card", "PRIVATE", "M4ROOT", "CLIP", "C0001.MP4"), "content")
+		return fsys
+	}
+	dcfFolders := []string{
+		filepath.Join("card", "DCIM", "100MSDCF"),
+		filepath.Join("card", "DCIM", "101MSDCF"),
+	}
+	paths := func(dirs []sourceDir) []string {
+		result := make([]string, len(dirs))
+		for i, dir := range dirs {
+			result[i] = dir.Path
+		}
+		return result
+	}
+
+	t.Run("card root", func(t *testing.T) {
+		dirs, err := discoverSourceDirs(newCard(), "card", []string{"PRIVATE/M4ROOT/CLIP"})
+		require.NoError(t, err)
+		assert.Equal(t, append(dcfFolders, filepath.Join("card", "PRIVATE", "M4ROOT", "CLIP")), paths(dirs))
+	})
+
+	t.Run("DCIM directory", func(t *testing.T) {
+		dirs, err := discoverSourceDirs(newCard(), filepath.Join("card", "DCIM"), []string{"PRIVATE/M4ROOT/CLIP"})
+		require.NoError(t, err)
+		assert.Equal(t, append(dcfFolders, filepath.Join("card", "PRIVATE", "M4ROOT", "CLIP")), paths(dirs), "video clips are next to DCIM")
+	})
+
+	t.Run("single folder", func(t *testing.T) {
+		dirs, err := discoverSourceDirs(newCard(), dcfFolders[1], []string{"PRIVATE/M4ROOT/CLIP"})
+		require.NoError(t, err)
+		require.Len(t, dirs, 1)
+		assert.Equal(t, dcfFolders[1], dirs[0].Path)
+		require.Len(t, dirs[0].Entries, 1)
+		assert.Equal(t, "DSC00001.ARW", dirs[0].Entries[0].Name())
+	})
+
+	t.Run("missing source", func(t *testing.T) {
+		_, err := discoverSourceDirs(newCard(), "elsewhere", nil)
+		assert.Error(t, err)
+	})
+}
+
+func TestCleanSDCardScansEveryDCFFolderOnce(t *testing.T) {
+	ctx := t.Context()
+	fake := newFakeFileSystem()
+	dcim := filepath.Join("card", "DCIM")
+	fake.addFile(filepath.Join(dcim, "100MSDCF", "DSC09999.ARW"), "content")
+	fake.addFile(filepath.Join(dcim, "100MSDCF", "DSC09999.JPG"), "content")
+	fake.addFile(filepath.Join(dcim, "101MSDCF", "DSC00001.ARW"), "content")
+
+	counting := newReadDirCountingFileSystem(fake)
+
+	report, err := cleanSDCard(
+		ctx,
+		counting,
+		[]string{"xmp"},
+		testProfile,
+		"card",
+		"dst",
+		"dst-jpg",
+		"dst-video",
+		Options{KeepJPG: true, KeepSrc: false, Layout: "{folder}/{name}{ext}", Concurrency: testConcurrency},
+	)
+
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Copied)
+	assert.Equal(t, 3, report.Removed)
+
+	for _, dir := range []string{"card", dcim, filepath.Join(dcim, "100MSDCF"), filepath.Join(dcim, "101MSDCF")} {
+		assert.Equal(t, 1, counting.callsFor(dir), "%s should be listed exactly once", dir)
+	}
+	for _, path := range []string{
+		filepath.Join("dst", "100MSDCF", "DSC09999.ARW"),
+		filepath.Join("dst-jpg", "100MSDCF", "DSC09999.JPG"),
+		filepath.Join("dst", "101MSDCF", "DSC00001.ARW"),
+	} {
+		_, ok := fake.readFile(path)
+		assert.True(t, ok, "expected %s to exist", path)
+	}
+}
+
+func TestCleanSDCardSameNameInTwoFolders(t *testing.T) {
+	ctx := t.Context()
+	// the camera's file counter was reset between the two folders
+	fsys := newFakeFileSystem()
+	dcim := filepath.Join("card", "DCIM")
+	fsys.addFile(filepath.Join(dcim, "100MSDCF", "DSC00001.ARW"), "first raw 1")
+	fsys.addFile(filepath.Join(dcim, "100MSDCF", "DSC00002.ARW"), "raw 2")
+	fsys.addFile(filepath.Join(dcim, "101MSDCF", "DSC00001.ARW"), "second raw 1")
+	fsys.addFile(filepath.Join(dcim, "101MSDCF", "DSC00002.ARW"), "raw 2")
+
+	plan, err := planImport(ctx, fsys, []string{"xmp"}, testProfile, "card", "dst", "dst-jpg", "dst-video",
+		Options{KeepSrc: false, Concurrency: testConcurrency})
+	require.NoError(t, err)
+	assert.Equal(t, []Action{
+		{Kind: actionCopy, Src: filepath.Join(dcim, "100MSDCF", "DSC00001.ARW"), Dst: filepath.Join("dst", "DSC00001.ARW"), Size: 11, Reason: reasonNew},
+		{Kind: actionCopy, Src: filepath.Join(dcim, "100MSDCF", "DSC00002.ARW"), Dst: filepath.Join("dst", "DSC00002.ARW"), Size: 5, Reason: reasonNew},
+		{Kind: actionSkip, Src: filepath.Join(dcim, "101MSDCF", "DSC00001.ARW"), Dst: filepath.Join("dst", "DSC00001.ARW"), Size: 12, Reason: reasonClash},
+		{Kind: actionSkip, Src: filepath.Join(dcim, "101MSDCF", "DSC00002.ARW"), Dst: filepath.Join("dst", "DSC00002.ARW"), Size: 5, Reason: reasonSameCopy},
+	}, plan.Actions[:4])
+
+	report, err := cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "card", "dst", "dst-jpg", "dst-video",
+		Options{KeepSrc: false, Concurrency: testConcurrency})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Copied)
+	assert.Equal(t, 3, report.Removed, "both copies of DSC00002 are safely in the library")
+
+	content, _ := fsys.readFile(filepath.Join("dst", "DSC00001.ARW"))
+	assert.Equal(t, "first raw 1", content, "the first file keeps its destination")
+	_, ok := fsys.readFile(filepath.Join(dcim, "101MSDCF", "DSC00001.ARW"))
+	assert.True(t, ok, "the different file stays on the card")
+}
+
+func TestCleanSDCardCopiesVideoClips(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	clipDir := filepath.Join("card", "PRIVATE", "M4ROOT", "CLIP")
+	fsys.addFile(filepath.Join("card", "DCIM", "100MSDCF", "DSC00001.ARW"), "content")
+	fsys.addFile(filepath.Join(clipDir, "C0001.MP4"), "video")
+	fsys.addFile(filepath.Join(clipDir, "C0001M01.XML"), `<?xml version="1.0" encoding="UTF-8"?>
+<NonRealTimeMeta xmlns="urn:schemas-professionalDisc:nonRealTimeMeta:ver.2.00">
+	<CreationDate value="2024-05-17T09:30:00+09:00"/>
+	<Device manufacturer="Sony" modelName="ILCE-7M3" serialNo="1234567"/>
+</NonRealTimeMeta>`)
+	fsys.addFile(filepath.Join("card", "PRIVATE", "M4ROOT", "THMBNL", "C0001T01.JPG"), "thumbnail")
+	sony, err := lookupProfile("sony")
+	require.NoError(t, err)
+
+	report, err := cleanSDCard(
+		ctx,
+		fsys,
+		[]string{"xmp"},
+		sony,
+		"card",
+		"dst",
+		"dst-jpg",
+		"dst-video",
+		Options{CopyVideo: true, KeepSrc: false, Layout: "{date}/{camera}/{name}{ext}", Concurrency: testConcurrency},
+	)
+
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Copied)
+	assert.Equal(t, 3, report.Removed)
+
+	for _, path := range []string{
+		filepath.Join("dst-video", "2024-05-17", "ILCE-7M3", "C0001.MP4"),
+		filepath.Join("dst-video", "2024-05-17", "ILCE-7M3", "C0001M01.XML"),
+	} {
+		_, ok := fsys.readFile(path)
+		assert.True(t, ok, "expected %s to exist", path)
+	}
+
+	_, ok := fsys.readFile(filepath.Join("card", "PRIVATE", "M4ROOT", "THMBNL", "C0001T01.JPG"))
+	assert.True(t, ok, "thumbnails are never copied, so they must not be removed")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// megabyte is the unit of -free-space-margin.
+const megabyte = 1 << 20
+
+// defaultFreeSpaceMargin is how much space, in megabytes, is left free on
+// each destination disk on top of the files copied to it: room for the
+// journal, the library index and whatever the photo editor writes next.
+const defaultFreeSpaceMargin = 1024
+
+// errDiskSpaceUnknown is returned by FileSystem.DiskSpace on platforms where
+// the free space can't be told.
+var errDiskSpaceUnknown = errors.New("free space unknown on this platform")
+
+// errNotEnoughSpace is returned by checkFreeSpace when a destination disk
+// can't hold the files planned to be copied to it.
+var errNotEnoughSpace = errors.New("not enough free space")
+
+// diskSpace is what FileSystem.DiskSpace reports of the disk holding a path.
+type diskSpace struct {
+	// Device tells the disk apart from others, so that destination
+	// directories on the same disk are checked together.
+	Device string
+	// Available is the number of bytes that can still be written to it.
+	Available uint64
+}
+
+// checkFreeSpace checks, before plan copies anything, that every disk its
+// copies go to has room for them plus margin bytes. Copies are counted in
+// full even where they replace a file, since the copy is written next to
+// the file before replacing it. Destination directories that don't exist
+// yet are checked by their nearest existing parent. A disk whose free space
+// can't be told is logged to logger and not checked.
+func checkFreeSpace(fsys FileSystem, plan *Plan, margin int64, logger *slog.Logger) error {
+	type disk struct {
+		dirs   []string
+		space  diskSpace
+		needed int64
+	}
+	disks := make(map[string]*disk)
+	diskOf := make(map[string]*disk)
+	for _, a := range plan.Actions {
+		if a.Kind != actionCopy {
+			continue
+		}
+		dir := copyDestinationDir(plan.DstDirs, a.Dst)
+		d, ok := diskOf[dir]
+		if !ok {
+			space, err := fsys.DiskSpace(nearestExistingDir(fsys, dir))
+			if errors.Is(err, errDiskSpaceUnknown) {
+				logger.Warn("not checking the free space", "dir", dir, errAttr(err))
+				diskOf[dir] = nil
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to check the free space in %s: %w", dir, err)
+			}
+			if d = disks[space.Device]; d == nil {
+				d = &disk{space: space}
+				disks[space.Device] = d
+			}
+			d.dirs = append(d.dirs, dir)
+			diskOf[dir] = d
+		}
+		if d != nil {
+			d.needed += a.Size
+		}
+	}
+
+	var errs []error
+	for _, d := range disks {
+		if uint64(d.needed+margin) <= d.space.Available {
+			continue
+		}
+		errs = append(errs, fmt.Errorf("%w in %s: %s to copy plus a margin of %s, but only %s free",
+			errNotEnoughSpace, strings.Join(d.dirs, " and "), formatBytes(d.needed), formatBytes(margin), formatBytes(int64(d.space.Available))))
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errors.Join(errs...)
+}
+
+// copyDestinationDir returns the directory of dstDirs that dst is in, or
+// dst's own directory if none is.
+func copyDestinationDir(dstDirs []string, dst string) string {
+	best := ""
+	for _, dir := range dstDirs {
+		rel, err := filepath.Rel(dir, dst)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if len(dir) > len(best) {
+			best = dir
+		}
+	}
+	if best == "" {
+		return filepath.Dir(dst)
+	}
+	return best
+}
+
+// nearestExistingDir returns dir, or if it doesn't exist yet, its nearest
+// parent that does.
+func nearestExistingDir(fsys FileSystem, dir string) string {
+	for {
+		if _, err := fsys.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// formatBytes formats n bytes for reading, e.g. "1.5 GB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTP"[exp])
+}
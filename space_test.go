@@ -0,0 +1,82 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanSDCardChecksFreeSpace(t *testing.T) {
+	ctx := t.Context()
+	// a 600-byte RAW and a 400-byte JPG
+	card := map[string]string{
+		"src/a.arw": string(make([]byte, 600)),
+		"src/a.jpg": string(make([]byte, 400)),
+	}
+	tests := []struct {
+		name      string
+		available uint64
+		margin    int64
+		wantErr   bool
+	}{
+		{"room for both", 1000, 0, false},
+		{"room for both and the margin", 1100, 100, false},
+		{"room for either but not both", 900, 0, true},
+		{"no room for the margin", 1000, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := newFakeFileSystemWith(card)
+			fsys.addDir("disk")
+			// both destinations are on the same disk, and don't exist yet
+			fsys.setDiskSpace("disk", tt.available)
+
+			report, err := cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "src",
+				filepath.Join("disk", "raw"), filepath.Join("disk", "jpeg"), filepath.Join("disk", "video"),
+				Options{KeepJPG: true, KeepSrc: true, FreeSpaceMargin: tt.margin, Concurrency: testConcurrency})
+			if !tt.wantErr {
+				require.NoError(t, err)
+				assert.Equal(t, 2, report.Copied)
+				return
+			}
+			assert.ErrorIs(t, err, errNotEnoughSpace)
+			assert.ErrorContains(t, err, filepath.Join("disk", "raw")+" and "+filepath.Join("disk", "jpeg"))
+			assert.Zero(t, report.Copied)
+			_, ok := fsys.readFile(filepath.Join("disk", "raw", "a.arw"))
+			assert.False(t, ok, "nothing is copied")
+		})
+	}
+
+	t.Run("separate disks", func(t *testing.T) {
+		fsys := newFakeFileSystemWith(card)
+		fsys.addDir("disk")
+		fsys.addDir("other-disk")
+		fsys.setDiskSpace("disk", 600)
+		fsys.setDiskSpace("other-disk", 399)
+
+		_, err := cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "src", filepath.Join("disk", "raw"), "other-disk", "video",
+			Options{KeepJPG: true, KeepSrc: true, Concurrency: testConcurrency})
+		assert.ErrorIs(t, err, errNotEnoughSpace)
+		assert.ErrorContains(t, err, "in other-disk: 400 B to copy plus a margin of 0 B, but only 399 B free")
+		assert.NotContains(t, err.Error(), filepath.Join("disk", "raw"))
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		fsys := newFakeFileSystemWith(card)
+		fsys.addDir("disk")
+		fsys.setDiskSpace("disk", 0)
+
+		report, err := cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "src", filepath.Join("disk", "raw"), "dst-jpg", "dst-video",
+			Options{DryRun: true, KeepSrc: true, Concurrency: testConcurrency})
+		require.NoError(t, err, "a dry run reports the lack of space instead of failing")
+		assert.Equal(t, 1, report.Copied)
+	})
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "999 B", formatBytes(999))
+	assert.Equal(t, "1.5 KB", formatBytes(1536))
+	assert.Equal(t, "60.0 GB", formatBytes(60<<30))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// libraryStatus is what the status command reports about a destination
+// directory: the last import, the recorded runs and the trash.
+type libraryStatus struct {
+	Dir string
+	// States counts the files of the last import's journal by state.
+	States map[journalState]int
+	Runs   []runInfo
+	// TrashDays are the trash day folders, oldest first.
+	TrashDays []string
+}
+
+// readLibraryStatus gathers the status of dirDst, logging anything unreadable
+// to logger.
+func readLibraryStatus(fsys FileSystem, dirDst string, logger *slog.Logger) (libraryStatus, error) {
+	st := libraryStatus{Dir: dirDst, States: make(map[journalState]int)}
+
+	history, err := loadJournal(fsys, dirDst, logger)
+	if err != nil {
+		return libraryStatus{}, err
+	}
+	for _, e := range history {
+		st.States[e.State]++
+	}
+
+	if st.Runs, err = listRuns(fsys, dirDst); err != nil {
+		return libraryStatus{}, err
+	}
+
+	entries, err := fsys.ReadDir(filepath.Join(dirDst, trashDirName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return libraryStatus{}, fmt.Errorf("failed to read trash: %w", err)
+	}
+	for _, entry := range entries {
+		if _, err := time.Parse(time.DateOnly, entry.Name()); entry.IsDir() && err == nil {
+			st.TrashDays = append(st.TrashDays, entry.Name())
+		}
+	}
+	sort.Strings(st.TrashDays)
+	return st, nil
+}
+
+// interrupted returns how many files of the last import never finished.
+func (st libraryStatus) interrupted() int {
+	return st.States[journalPlanned] + st.States[journalCopied]
+}
+
+// print writes st to w for reading.
+func (st libraryStatus) print(w io.Writer) error {
+	var b strings.Builder
+	p := func(format string, args ...any) {
+		fmt.Fprintf(&b, format, args...)
+	}
+
+	p("Library: %s\n", st.Dir)
+
+	total := 0
+	for _, n := range st.States {
+		total += n
+	}
+	if total == 0 {
+		p("Last import: none recorded\n")
+	} else {
+		p("Last import: %d files: %d verified, %d removed from the source, %d interrupted\n",
+			total, st.States[journalVerified], st.States[journalSourceRemoved], st.interrupted())
+		if st.interrupted() > 0 {
+			p("  finish it with: import -resume\n")
+		}
+	}
+
+	if len(st.Runs) == 0 {
+		p("Runs: none recorded\n")
+	} else {
+		undone := 0
+		for _, run := range st.Runs {
+			if run.Undone {
+				undone++
+			}
+		}
+		latest := st.Runs[len(st.Runs)-1]
+		p("Runs: %d recorded, %d undone; latest %s", len(st.Runs), undone, latest.ID)
+		if latest.Undone {
+			p(" (undone)")
+		}
+		p("\n")
+	}
+
+	if len(st.TrashDays) == 0 {
+		p("Trash: empty\n")
+	} else {
+		p("Trash: %d day folders, %s to %s\n", len(st.TrashDays), st.TrashDays[0], st.TrashDays[len(st.TrashDays)-1])
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
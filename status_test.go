@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLibraryStatus(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	fsys.addFile(filepath.Join("src", "a.arw"), "a")
+	fsys.addFile(filepath.Join("dst", "zombie.xmp"), "edit")
+	_, err := cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "src", "dst", "dst-jpg", "dst-video",
+		Options{KeepSrc: false, DeleteZombieEditFiles: true, Trash: true, Concurrency: testConcurrency})
+	require.NoError(t, err)
+
+	st, err := readLibraryStatus(fsys, "dst", slog.Default())
+	require.NoError(t, err)
+	assert.Equal(t, map[journalState]int{journalSourceRemoved: 1}, st.States)
+	assert.Len(t, st.Runs, 1)
+	assert.Len(t, st.TrashDays, 1)
+
+	var out bytes.Buffer
+	require.NoError(t, st.print(&out))
+	assert.Contains(t, out.String(), "Last import: 1 files: 0 verified, 1 removed from the source, 0 interrupted")
+	assert.Contains(t, out.String(), "Runs: 1 recorded, 0 undone")
+
+	st, err = readLibraryStatus(fsys, "no-such-dst", slog.Default())
+	require.NoError(t, err)
+	out.Reset()
+	require.NoError(t, st.print(&out))
+	assert.Contains(t, out.String(), "Last import: none recorded")
+}
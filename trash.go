@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// trashDirName is the directory under the RAW destination directory that
+// files are moved to instead of being deleted, in trash mode (-trash).
+const trashDirName = ".clean-sd-card-trash"
+
+// trashPath returns where the file at path, under root, goes in the trash of
+// dstDir when trashed on day: the day's folder, with path's location under
+// root kept, so that it can be put back where it was.
+func trashPath(dstDir, root, path string, day time.Time) (string, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not under %s", path, root)
+	}
+	return filepath.Join(dstDir, trashDirName, day.Format(time.DateOnly), rel), nil
+}
+
+// isTrashDay reports whether dir is a day folder of a trash, as trashPath
+// puts files in.
+func isTrashDay(dir string) bool {
+	dir = filepath.Clean(dir)
+	if filepath.Base(filepath.Dir(dir)) != trashDirName {
+		return false
+	}
+	_, err := time.Parse(time.DateOnly, filepath.Base(dir))
+	return err == nil
+}
+
+// isInTrash reports whether path is in a day folder of a trash.
+func isInTrash(path string) bool {
+	for dir := filepath.Dir(filepath.Clean(path)); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if isTrashDay(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// moveToTrash moves the file at path to dst, its place in the trash (see
+// trashPath). If a file trashed earlier the same day is already at dst, a
+// numbered name is used instead. It returns where the file was moved to.
+func moveToTrash(ctx context.Context, fsys FileSystem, path, dst string, logger *slog.Logger) (string, error) {
+	if err := fsys.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", fmt.Errorf("failed to create trash directory: %w", err)
+	}
+	dst = freePath(fsys, dst)
+	if err := moveFile(ctx, fsys, path, dst, logger); err != nil {
+		return "", fmt.Errorf("failed to move %s to the trash: %w", path, err)
+	}
+	return dst, nil
+}
+
+// moveFile moves the file at from to to, whose directory must exist.
+func moveFile(ctx context.Context, fsys FileSystem, from, to string, logger *slog.Logger) error {
+	err := fsys.Rename(from, to)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+	// The card is another filesystem than the destination, which a rename
+	// can't cross: copy the file over, and remove it only once the copy is
+	// verified.
+	if _, err := copyAndVerify(ctx, fsys, nil, from, to, nil, logger); err != nil {
+		return err
+	}
+	if err := fsys.Remove(from); err != nil {
+		return fmt.Errorf("failed to remove %s after copying it: %w", from, err)
+	}
+	return nil
+}
+
+// freePath returns path if nothing is there, and otherwise the first of path
+// with "-2", "-3", ... before its extension that is free.
+func freePath(fsys FileSystem, path string) string {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	free := path
+	for n := 2; ; n++ {
+		if _, err := fsys.Stat(free); errors.Is(err, os.ErrNotExist) {
+			return free
+		}
+		free = fmt.Sprintf("%s-%d%s", stem, n, ext)
+	}
+}
+
+// expiredTrashDirs returns the day folders in the trash of dstDir that are
+// more than retentionDays days old on now. Anything in the trash not named
+// like a day folder is left alone. A missing trash is not an error.
+func expiredTrashDirs(fsys FileSystem, dstDir string, retentionDays int, now time.Time) ([]string, error) {
+	root := filepath.Join(dstDir, trashDirName)
+	entries, err := fsys.ReadDir(root)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trash: %w", err)
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	var expired []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		day, err := time.ParseInLocation(time.DateOnly, entry.Name(), now.Location())
+		if err != nil {
+			continue
+		}
+		if day.AddDate(0, 0, retentionDays).Before(today) {
+			expired = append(expired, filepath.Join(root, entry.Name()))
+		}
+	}
+	return expired, nil
+}
+
+// removeTree removes dir and everything in it.
+func removeTree(fsys FileSystem, dir string) error {
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("reading directory: %w", err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if err := removeTree(fsys, path); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fsys.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+	if err := fsys.Remove(dir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanSDCardTrash(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	fsys.addFile(filepath.Join("card", "DCIM", "100MSDCF", "a.arw"), "a")
+	fsys.addFile(filepath.Join("dst", "2026", "zombie.xmp"), "edit of a RAW moved elsewhere")
+	// trashed by an earlier run today
+	today := time.Now().Format(time.DateOnly)
+	fsys.addFile(filepath.Join("dst", trashDirName, today, "2026", "zombie.xmp"), "an older edit")
+
+	// The card and the library are separate volumes, so source files are
+	// copied into the trash rather than renamed.
+	report, err := cleanSDCard(
+		ctx,
+		crossDeviceFileSystem{fsys},
+		[]string{"xmp"},
+		testProfile,
+		"card",
+		"dst",
+		"dst-jpg",
+		"dst-video",
+		Options{KeepSrc: false, DeleteZombieEditFiles: true, Trash: true, TrashSources: true, Concurrency: testConcurrency},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Copied)
+	assert.Equal(t, 2, report.Removed)
+
+	for path, want := range map[string]string{
+		filepath.Join("dst", "a.arw"):                                          "a",
+		filepath.Join("dst", trashDirName, today, "DCIM", "100MSDCF", "a.arw"): "a",
+		filepath.Join("dst", trashDirName, today, "2026", "zombie.xmp"):        "an older edit",
+		filepath.Join("dst", trashDirName, today, "2026", "zombie-2.xmp"):      "edit of a RAW moved elsewhere",
+	} {
+		content, ok := fsys.readFile(path)
+		assert.True(t, ok, "%s should exist", path)
+		assert.Equal(t, want, content, path)
+	}
+	for _, path := range []string{
+		filepath.Join("card", "DCIM", "100MSDCF", "a.arw"),
+		filepath.Join("dst", "2026", "zombie.xmp"),
+	} {
+		_, ok := fsys.readFile(path)
+		assert.False(t, ok, "%s should have been moved to the trash", path)
+	}
+}
+
+func TestCleanSDCardPurgesExpiredTrash(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	fsys.addFile(filepath.Join("src", "a.arw"), "a")
+	now := time.Now()
+	old := now.AddDate(0, 0, -31).Format(time.DateOnly)
+	recent := now.AddDate(0, 0, -30).Format(time.DateOnly)
+	fsys.addFile(filepath.Join("dst", trashDirName, old, "2026", "old.xmp"), "old")
+	fsys.addFile(filepath.Join("dst", trashDirName, recent, "recent.xmp"), "recent")
+
+	opts := Options{KeepSrc: true, TrashRetention: 30, Concurrency: testConcurrency}
+	_, err := cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "src", "dst", "dst-jpg", "dst-video", opts)
+	require.NoError(t, err)
+
+	_, err = fsys.Stat(filepath.Join("dst", trashDirName, old))
+	assert.Error(t, err, "trash older than the retention should be purged")
+	_, ok := fsys.readFile(filepath.Join("dst", trashDirName, recent, "recent.xmp"))
+	assert.True(t, ok, "trash within the retention should be kept")
+}
+
+func TestExpiredTrashDirs(t *testing.T) {
+	fsys := newFakeFileSystem()
+	for _, name := range []string{"2026-09-14", "2026-09-15", "2026-09-16", "2026-10-16", "notes"} {
+		fsys.addDir(filepath.Join("dst", trashDirName, name))
+	}
+	fsys.addFile(filepath.Join("dst", trashDirName, "2026-01-01.txt"), "not a day folder")
+	now := time.Date(2026, 10, 16, 9, 30, 0, 0, time.Local)
+
+	expired, err := expiredTrashDirs(fsys, "dst", 30, now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join("dst", trashDirName, "2026-09-14"),
+		filepath.Join("dst", trashDirName, "2026-09-15"),
+	}, expired)
+
+	expired, err = expiredTrashDirs(fsys, "no-such-dst", 30, now)
+	require.NoError(t, err)
+	assert.Empty(t, expired)
+}
+
+func TestFindZombieEditFilesSkipsTrash(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	fsys.addFile(filepath.Join("dst", trashDirName, "2026-10-16", "trashed.xmp"), "")
+	fsys.addFile(filepath.Join("dst", "zombie.xmp"), "")
+
+	zombies, err := findZombieEditFiles(ctx, fsys, "xmp", "dst", []string{"arw"}, nil, true, testConcurrency)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join("dst", "zombie.xmp")}, zombies)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// undoMain runs the undo subcommand with args, the command-line arguments
+// after "undo".
+func undoMain(ctx context.Context, args []string) {
+	f := newJobFlags("undo", "dst", "dry-run")
+	runID := f.String("run", "", "Run to undo, as listed by -list (default: the most recent run not undone yet)")
+	list := f.Bool("list", false, "List the runs recorded in -dst and exit")
+	job := f.parse(args)
+	logger := setUpLogging(job)
+
+	fsys := osFileSystem{}
+	if *list {
+		runs, err := listRuns(fsys, job.Dst)
+		if err != nil {
+			fatal(logger, "failed listing runs", errAttr(err))
+		}
+		for _, run := range runs {
+			if run.Undone {
+				fmt.Printf("%s (undone)\n", run.ID)
+			} else {
+				fmt.Println(run.ID)
+			}
+		}
+		return
+	}
+
+	restored, removed, err := undoRun(ctx, fsys, job.Dst, *runID, *job.DryRun, logger)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		fatal(logger, "failed undoing run", errAttr(err))
+	}
+	if err != nil {
+		logger.Warn("stopped before finishing", errAttr(err))
+	}
+	if *job.DryRun {
+		logger.Info("summary (dry run, nothing was modified)", "to-restore", restored, "to-remove", removed)
+	} else {
+		logger.Info("summary", "restored", restored, "removed", removed)
+	}
+	if err != nil {
+		logger.Info("run undo again to finish what was left")
+		os.Exit(exitInterrupted)
+	}
+}
+
+// undoRun reverses the run called id recorded in dirDst, or the most recent
+// run not undone yet if id is empty, going through what it did backwards:
+//   - files it moved to the trash (zombie edit files, and source files with
+//     -trash-sources) are moved back where they were, unless a file is there
+//     now; source files only if their card directory is there, i.e. the card
+//     is in the reader;
+//   - files it copied are removed from the destination, but only if the
+//     original is still on the card with the same content, so that undoing
+//     never loses the only copy of a file. Copies that replaced a file at the
+//     destination (-overwrite) are kept: what they replaced is gone.
+//
+// Files deleted rather than trashed can't be brought back. Once everything
+// that can be is undone, the run is marked undone. In dry-run mode, it only
+// logs what it would do. What it does is logged to logger.
+// It returns the number of files restored, the number of copies removed, and
+// any error.
+func undoRun(ctx context.Context, fsys FileSystem, dirDst, id string, dryRun bool, logger *slog.Logger) (int, int, error) {
+	runs, err := listRuns(fsys, dirDst)
+	if err != nil {
+		return 0, 0, err
+	}
+	run, err := findRun(runs, id)
+	if err != nil {
+		return 0, 0, err
+	}
+	actions, err := readRunRecord(fsys, run, logger)
+	if err != nil {
+		return 0, 0, err
+	}
+	if run.Undone {
+		logger.Warn("run was undone already; undoing what is left of it", "run", run.ID)
+	}
+	logger.Info("undoing run", "run", run.ID, "actions", len(actions))
+
+	var (
+		restored, removed int
+		errs              error
+	)
+	for _, a := range slices.Backward(actions) {
+		if err := ctx.Err(); err != nil {
+			errs = errors.Join(errs, err)
+			break
+		}
+		var (
+			done bool
+			err  error
+		)
+		switch a.Kind {
+		case actionRemove, actionDeleteZombie:
+			done, err = restoreFromTrash(ctx, fsys, a, dryRun, logger)
+			if done {
+				restored++
+			}
+		case actionCopy:
+			done, err = removeCopy(ctx, fsys, a, dryRun, logger)
+			if done {
+				removed++
+			}
+		}
+		errs = errors.Join(errs, err)
+	}
+	if errs != nil {
+		return restored, removed, errs
+	}
+
+	if !dryRun && !run.Undone {
+		if err := markUndone(fsys, run); err != nil {
+			return restored, removed, err
+		}
+	}
+	return restored, removed, nil
+}
+
+// restoreFromTrash moves the file that the removal or zombie deletion a moved
+// to the trash back where it was, and reports whether it did.
+func restoreFromTrash(ctx context.Context, fsys FileSystem, a Action, dryRun bool, logger *slog.Logger) (bool, error) {
+	original := a.Dst
+	if a.Kind == actionRemove {
+		original = a.Src
+	}
+	if a.Trash == "" {
+		logger.Warn("can't restore file: it was deleted, not moved to the trash", "file", original)
+		return false, nil
+	}
+	if _, err := fsys.Stat(a.Trash); err != nil {
+		logger.Warn("can't restore file: it is no longer in the trash", "file", original, "trash", a.Trash)
+		return false, nil
+	}
+	if _, err := fsys.Stat(original); err == nil {
+		logger.Warn("not restoring file: a file is there now", "file", original)
+		return false, nil
+	}
+	if a.Kind == actionRemove {
+		if _, err := fsys.Stat(filepath.Dir(original)); err != nil {
+			logger.Warn("not restoring file: its directory isn't there; is the card in the reader?", "file", original)
+			return false, nil
+		}
+	}
+
+	if dryRun {
+		logger.Info("[dry-run] would restore from the trash", "file", original, "trash", a.Trash)
+		return true, nil
+	}
+	if err := fsys.MkdirAll(filepath.Dir(original), 0755); err != nil {
+		return false, fmt.Errorf("failed to restore %s: %w", original, err)
+	}
+	if err := moveFile(ctx, fsys, a.Trash, original, logger); err != nil {
+		return false, fmt.Errorf("failed to restore %s: %w", original, err)
+	}
+	logger.Info("restored from the trash", "file", original, "trash", a.Trash)
+	return true, nil
+}
+
+// removeCopy removes the copy the copy a made, if the original is still on
+// the card with the same content, and reports whether it did.
+func removeCopy(ctx context.Context, fsys FileSystem, a Action, dryRun bool, logger *slog.Logger) (bool, error) {
+	if a.Overwrite {
+		logger.Warn("keeping copy: it replaced a file that is gone", "file", a.Dst)
+		return false, nil
+	}
+	if _, err := fsys.Stat(a.Dst); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if _, err := fsys.Stat(a.Src); err != nil {
+		logger.Warn("keeping copy: the original is no longer on the card", "file", a.Dst, "src", a.Src)
+		return false, nil
+	}
+	identical, err := sameContent(ctx, fsys, a.Src, a.Dst)
+	if err != nil {
+		return false, fmt.Errorf("failed to compare %s with the original: %w", a.Dst, err)
+	}
+	if !identical {
+		logger.Warn("keeping copy: it differs from the original", "file", a.Dst, "src", a.Src)
+		return false, nil
+	}
+
+	if dryRun {
+		logger.Info("[dry-run] would remove copy: the original is still on the card", "file", a.Dst, "src", a.Src)
+		return true, nil
+	}
+	if err := fsys.Remove(a.Dst); err != nil {
+		return false, fmt.Errorf("failed to remove %s: %w", a.Dst, err)
+	}
+	logger.Info("removed copy", "file", a.Dst, "src", a.Src)
+	return true, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUndoRun(t *testing.T) {
+	ctx := t.Context()
+	run := func(t *testing.T, fsys FileSystem, opts Options) {
+		t.Helper()
+		opts.DeleteZombieEditFiles = true
+		opts.Concurrency = testConcurrency
+		_, err := cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "src", "dst", "dst-jpg", "dst-video", opts)
+		require.NoError(t, err)
+	}
+	exists := func(fsys *fakeFileSystem, path string) bool {
+		_, ok := fsys.readFile(path)
+		return ok
+	}
+
+	t.Run("removes copies and restores trashed edit files", func(t *testing.T) {
+		fsys := newFakeFileSystem()
+		fsys.addFile(filepath.Join("src", "a.arw"), "a")
+		fsys.addFile(filepath.Join("dst", "2026", "zombie.xmp"), "edit of a RAW moved elsewhere")
+		run(t, fsys, Options{KeepSrc: true, Trash: true})
+		require.False(t, exists(fsys, filepath.Join("dst", "2026", "zombie.xmp")))
+
+		restored, removed, err := undoRun(ctx, fsys, "dst", "", false, slog.Default())
+		require.NoError(t, err)
+		assert.Equal(t, 1, restored)
+		assert.Equal(t, 1, removed)
+
+		content, _ := fsys.readFile(filepath.Join("dst", "2026", "zombie.xmp"))
+		assert.Equal(t, "edit of a RAW moved elsewhere", content)
+		assert.False(t, exists(fsys, filepath.Join("dst", "a.arw")))
+		assert.True(t, exists(fsys, filepath.Join("src", "a.arw")))
+
+		runs, err := listRuns(fsys, "dst")
+		require.NoError(t, err)
+		require.Len(t, runs, 1)
+		assert.True(t, runs[0].Undone)
+		_, _, err = undoRun(ctx, fsys, "dst", "", false, slog.Default())
+		assert.ErrorIs(t, err, errNoRun)
+	})
+
+	t.Run("keeps copies whose original is gone from the card", func(t *testing.T) {
+		fsys := newFakeFileSystem()
+		fsys.addFile(filepath.Join("src", "a.arw"), "a")
+		run(t, fsys, Options{KeepSrc: false})
+
+		restored, removed, err := undoRun(ctx, fsys, "dst", "", false, slog.Default())
+		require.NoError(t, err)
+		assert.Equal(t, 0, restored)
+		assert.Equal(t, 0, removed)
+		assert.True(t, exists(fsys, filepath.Join("dst", "a.arw")))
+	})
+
+	t.Run("puts trashed source files back on the card", func(t *testing.T) {
+		fsys := newFakeFileSystem()
+		fsys.addFile(filepath.Join("src", "a.arw"), "a")
+		// the card and the library are separate volumes, which files are
+		// copied across rather than renamed
+		volumes := crossDeviceFileSystem{fsys}
+		run(t, volumes, Options{KeepSrc: false, TrashSources: true})
+		require.False(t, exists(fsys, filepath.Join("src", "a.arw")))
+
+		restored, removed, err := undoRun(ctx, volumes, "dst", "", false, slog.Default())
+		require.NoError(t, err)
+		assert.Equal(t, 1, restored)
+		assert.Equal(t, 1, removed)
+		content, _ := fsys.readFile(filepath.Join("src", "a.arw"))
+		assert.Equal(t, "a", content)
+		assert.False(t, exists(fsys, filepath.Join("dst", "a.arw")))
+	})
+
+	t.Run("undoes the chosen run", func(t *testing.T) {
+		fsys := newFakeFileSystem()
+		fsys.addFile(filepath.Join("src", "a.arw"), "a")
+		run(t, fsys, Options{KeepSrc: true})
+		fsys.addFile(filepath.Join("src", "b.arw"), "b")
+		run(t, fsys, Options{KeepSrc: true})
+
+		runs, err := listRuns(fsys, "dst")
+		require.NoError(t, err)
+		require.Len(t, runs, 2)
+
+		_, removed, err := undoRun(ctx, fsys, "dst", runs[0].ID, false, slog.Default())
+		require.NoError(t, err)
+		assert.Equal(t, 1, removed)
+		assert.False(t, exists(fsys, filepath.Join("dst", "a.arw")))
+		assert.True(t, exists(fsys, filepath.Join("dst", "b.arw")))
+
+		_, _, err = undoRun(ctx, fsys, "dst", "19990101-000000", false, slog.Default())
+		assert.ErrorIs(t, err, errNoRun)
+	})
+
+	t.Run("dry run modifies nothing", func(t *testing.T) {
+		fsys := newFakeFileSystem()
+		fsys.addFile(filepath.Join("src", "a.arw"), "a")
+		fsys.addFile(filepath.Join("dst", "zombie.xmp"), "edit")
+		run(t, fsys, Options{KeepSrc: true, Trash: true})
+
+		restored, removed, err := undoRun(ctx, fsys, "dst", "", true, slog.Default())
+		require.NoError(t, err)
+		assert.Equal(t, 1, restored)
+		assert.Equal(t, 1, removed)
+		assert.True(t, exists(fsys, filepath.Join("dst", "a.arw")))
+		assert.False(t, exists(fsys, filepath.Join("dst", "zombie.xmp")))
+
+		runs, err := listRuns(fsys, "dst")
+		require.NoError(t, err)
+		assert.False(t, runs[0].Undone)
+	})
+}
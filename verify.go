@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// verifyStatus is how a file checked by verify stands.
+type verifyStatus string
+
+const (
+	// verifyOK means the copy is at its destination with the recorded size
+	// and content.
+	verifyOK verifyStatus = "verified"
+	// verifyMissing means there is no copy at the destination.
+	verifyMissing verifyStatus = "missing"
+	// verifyMismatch means the copy at the destination differs from what
+	// was copied.
+	verifyMismatch verifyStatus = "mismatched"
+	// verifyIncomplete means the import of the file never finished.
+	verifyIncomplete verifyStatus = "incomplete"
+	// verifyUnreadable means the file on the card can't be read, so there's
+	// no telling whether it is safely copied.
+	verifyUnreadable verifyStatus = "unreadable"
+)
+
+// verifyResult is how one file checked by verify stands.
+type verifyResult struct {
+	Src    string
+	Dst    string
+	Status verifyStatus
+	// Detail says what is wrong, for anything but verifyOK.
+	Detail string
+}
+
+// verifyImport checks every file the last import into dirDst recorded in its
+// journal (see openJournal) against its copy: that the copy is there, with
+// the size and SHA-256 recorded when it was verified. At most maxConcurrency
+// files are hashed at once. The results are sorted by source path. Anything
+// unreadable in the journal is logged to logger.
+func verifyImport(ctx context.Context, fsys FileSystem, dirDst string, maxConcurrency int, logger *slog.Logger) ([]verifyResult, error) {
+	history, err := loadJournal(fsys, dirDst, logger)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return nil, fmt.Errorf("no import journal in %s to verify against", dirDst)
+	}
+
+	entries := make([]journalEntry, 0, len(history))
+	for _, e := range history {
+		entries = append(entries, e)
+	}
+
+	var (
+		mu      sync.Mutex
+		results []verifyResult
+	)
+	_, err = forEachEntryConcurrently(ctx, entries, maxConcurrency, func(e journalEntry) (int, error) {
+		r := verifyEntry(ctx, fsys, e)
+		mu.Lock()
+		results = append(results, r)
+		mu.Unlock()
+		return 1, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Src < results[j].Src })
+	return results, nil
+}
+
+// verifyEntry checks the copy the journal entry e records.
+func verifyEntry(ctx context.Context, fsys FileSystem, e journalEntry) verifyResult {
+	r := verifyResult{Src: e.Src, Dst: e.Dst}
+	if !e.State.complete() {
+		r.Status, r.Detail = verifyIncomplete, fmt.Sprintf("the import stopped at %s; run import -resume", e.State)
+		return r
+	}
+
+	checkCopy(ctx, fsys, &r, e.Size, e.SHA256, "copied with")
+	return r
+}
+
+// checkCopy sets the status of r by checking the file at r.Dst against size
+// and hash, those of what it should be a copy of; what they are is worded by
+// of, as in "size 12, copied with 10".
+func checkCopy(ctx context.Context, fsys FileSystem, r *verifyResult, size int64, hash, of string) {
+	info, err := fsys.Stat(r.Dst)
+	if errors.Is(err, os.ErrNotExist) {
+		r.Status, r.Detail = verifyMissing, "no file at the destination"
+		return
+	}
+	if err != nil {
+		r.Status, r.Detail = verifyMissing, err.Error()
+		return
+	}
+	if info.Size() != size {
+		r.Status, r.Detail = verifyMismatch, fmt.Sprintf("size %d, %s %d", info.Size(), of, size)
+		return
+	}
+	dstHash, err := fsys.HashFile(ctx, r.Dst)
+	if err != nil {
+		r.Status, r.Detail = verifyMismatch, fmt.Sprintf("failed to hash: %s", err.Error())
+		return
+	}
+	if dstHash != hash {
+		r.Status, r.Detail = verifyMismatch, fmt.Sprintf("SHA-256 %s, %s %s", dstHash, of, hash)
+		return
+	}
+	r.Status = verifyOK
+}
+
+// verifyCard checks that every file on the card in dirSrc that an import
+// would copy is safely in the library: at the destination the import put it
+// (see discoverImport), with the same size and SHA-256. Destinations the last
+// import recorded in its journal in dirDst are used over those the layout
+// gives now. A file missing there is verified by an identical file anywhere
+// else in the library (see libraryIndex). At most opts.Concurrency files are
+// hashed at once. The results are sorted by source path.
+func verifyCard(ctx context.Context, fsys FileSystem, profile cameraProfile, dirSrc, dirDst, dirDstJPG, dirDstVideo string, opts Options) ([]verifyResult, error) {
+	history, err := loadJournal(fsys, dirDst, opts.logger())
+	if err != nil {
+		return nil, err
+	}
+	imp, err := discoverImport(ctx, fsys, history, profile, dirSrc, dirDst, dirDstJPG, dirDstVideo, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	type cardFile struct {
+		src, dst string
+		size     int64
+		index    *libraryIndex
+	}
+	var files []cardFile
+	indexes := make(map[string]*libraryIndex)
+	for _, g := range imp.groups {
+		if _, ok := indexes[g.dstDir]; !ok {
+			if indexes[g.dstDir], err = loadLibraryIndex(fsys, g.dstDir, opts.logger()); err != nil {
+				return nil, err
+			}
+		}
+		for _, dir := range imp.srcDirs {
+			for _, entry := range dir.Entries {
+				if entry.IsDir() || !matchesAnyExtension(entry.Name(), g.exts) {
+					continue
+				}
+				info, err := entry.Info()
+				if err != nil {
+					return nil, fmt.Errorf("failed to stat %s: %w", entry.Name(), err)
+				}
+				src := filepath.Join(dir.Path, entry.Name())
+				files = append(files, cardFile{src: src, dst: destinationPath(g.dstDir, src, imp.dstRelPaths), size: info.Size(), index: indexes[g.dstDir]})
+			}
+		}
+	}
+
+	var (
+		mu      sync.Mutex
+		results []verifyResult
+	)
+	_, err = forEachEntryConcurrently(ctx, files, opts.Concurrency, func(f cardFile) (int, error) {
+		r := verifyResult{Src: f.src, Dst: f.dst}
+		if hash, err := fsys.HashFile(ctx, f.src); err != nil {
+			r.Status, r.Detail = verifyUnreadable, err.Error()
+		} else {
+			checkCopy(ctx, fsys, &r, f.size, hash, "on the card")
+			if r.Status == verifyMissing {
+				if dup, found, err := f.index.find(ctx, fsys, f.size, hash); err == nil && found {
+					r.Dst, r.Status, r.Detail = dup, verifyOK, ""
+				}
+			}
+		}
+		mu.Lock()
+		results = append(results, r)
+		mu.Unlock()
+		return 1, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Src < results[j].Src })
+	return results, nil
+}
+
+// printVerifyReport writes results to w, one file per line, followed by the
+// count of each status. It reports whether every file was verified.
+func printVerifyReport(w io.Writer, results []verifyResult) (bool, error) {
+	counts := make(map[verifyStatus]int)
+	for _, r := range results {
+		counts[r.Status]++
+		line := fmt.Sprintf("%-10s %s -> %s", r.Status, r.Src, r.Dst)
+		if r.Detail != "" {
+			line += " (" + r.Detail + ")"
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return false, err
+		}
+	}
+
+	summary := fmt.Sprintf("%d verified, %d missing, %d mismatched", counts[verifyOK], counts[verifyMissing], counts[verifyMismatch])
+	for _, status := range []verifyStatus{verifyIncomplete, verifyUnreadable} {
+		if counts[status] > 0 {
+			summary += fmt.Sprintf(", %d %s", counts[status], status)
+		}
+	}
+	_, err := fmt.Fprintf(w, "\n%s\n", summary)
+	return counts[verifyOK] == len(results), err
+}
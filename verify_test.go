@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyImport(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	for _, name := range []string{"ok.arw", "gone.arw", "changed.arw", "rotted.arw"} {
+		fsys.addFile(filepath.Join("src", name), "content of "+name)
+	}
+	_, err := cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "src", "dst", "dst-jpg", "dst-video", Options{KeepSrc: false, Concurrency: testConcurrency})
+	require.NoError(t, err)
+
+	require.NoError(t, fsys.Remove(filepath.Join("dst", "gone.arw")))
+	fsys.addFile(filepath.Join("dst", "changed.arw"), "edited")
+	fsys.addFile(filepath.Join("dst", "rotted.arw"), "content of rotted.ARW")
+
+	results, err := verifyImport(ctx, fsys, "dst", testConcurrency, slog.Default())
+	require.NoError(t, err)
+	statuses := make(map[string]verifyStatus)
+	for _, r := range results {
+		statuses[filepath.Base(r.Src)] = r.Status
+	}
+	assert.Equal(t, map[string]verifyStatus{
+		"ok.arw":      verifyOK,
+		"gone.arw":    verifyMissing,
+		"changed.arw": verifyMismatch,
+		"rotted.arw":  verifyMismatch,
+	}, statuses)
+
+	var out bytes.Buffer
+	ok, err := printVerifyReport(&out, results)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Contains(t, out.String(), "1 verified, 1 missing, 2 mismatched\n")
+
+	_, err = verifyImport(ctx, fsys, "no-such-dst", testConcurrency, slog.Default())
+	assert.Error(t, err, "nothing to verify against")
+}
+
+func TestVerifyCard(t *testing.T) {
+	ctx := t.Context()
+	fsys := newFakeFileSystem()
+	for _, name := range []string{"a.arw", "b.arw", "c.arw", "c.jpg"} {
+		fsys.addFile(filepath.Join("src", name), "content of "+name)
+	}
+	opts := Options{KeepSrc: true, KeepJPG: true, Layout: "{seq:04}{ext}", Concurrency: testConcurrency}
+	_, err := cleanSDCard(ctx, fsys, []string{"xmp"}, testProfile, "src", "dst", "dst-jpg", "dst-video", opts)
+	require.NoError(t, err)
+
+	// Without a.arw, the layout would now number b.arw 0001: the journal
+	// keeps it at the 0002 it was imported as.
+	require.NoError(t, fsys.Remove(filepath.Join("src", "a.arw")))
+	fsys.addFile(filepath.Join("dst", "0003.arw"), "edited")
+	require.NoError(t, fsys.Remove(filepath.Join("dst-jpg", "0003.jpg")))
+
+	results, err := verifyCard(ctx, fsys, testProfile, "src", "dst", "dst-jpg", "dst-video", opts)
+	require.NoError(t, err)
+	assert.Equal(t, []verifyResult{
+		{Src: filepath.Join("src", "b.arw"), Dst: filepath.Join("dst", "0002.arw"), Status: verifyOK},
+		{Src: filepath.Join("src", "c.arw"), Dst: filepath.Join("dst", "0003.arw"), Status: verifyMismatch, Detail: "size 6, on the card 16"},
+		{Src: filepath.Join("src", "c.jpg"), Dst: filepath.Join("dst-jpg", "0003.jpg"), Status: verifyMissing, Detail: "no file at the destination"},
+	}, results)
+}